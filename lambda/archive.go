@@ -0,0 +1,91 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cdk-ecr-deployment-handler/internal/tarfile"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// archiveTransports are the transports that write the image to a single
+// local file.
+var archiveTransports = []string{"oci-archive", "docker-archive"}
+
+// GetArchivePath returns the local file an archive image is written to, as
+// in oci-archive:/tmp/out.tar[:reference].
+func GetArchivePath(image string) (string, bool) {
+	for _, t := range archiveTransports {
+		if strings.HasPrefix(image, t+":") {
+			path := strings.TrimPrefix(image, t+":")
+			if i := strings.Index(path, ":"); i >= 0 {
+				path = path[:i]
+			}
+			return path, path != ""
+		}
+	}
+	return "", false
+}
+
+// StageArchive returns image with its local file moved into dir, a new
+// temporary directory. An archive that is only written to be uploaded then
+// can't collide with one written by another copy in the same container.
+func StageArchive(image string) (staged string, dir string, err error) {
+	path, ok := GetArchivePath(image)
+	if !ok {
+		return "", "", fmt.Errorf("%v isn't an archive image", image)
+	}
+	dir, err = os.MkdirTemp("", "archive-")
+	if err != nil {
+		return "", "", err
+	}
+	i := strings.Index(image, path)
+	return image[:i] + filepath.Join(dir, filepath.Base(path)) + image[i+len(path):], dir, nil
+}
+
+func UploadFileToS3(ctx context.Context, path string, uri string) error {
+	s3uri, err := tarfile.ParseS3Uri(uri)
+	if err != nil {
+		return err
+	}
+	if s3uri.Bucket == "" || s3uri.Key == "" {
+		return fmt.Errorf("s3 uri must include a bucket and a key: %v", uri)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	client := s3.NewFromConfig(cfg)
+	log.Printf("Uploading %v (%d bytes) to %v", path, fi.Size(), uri)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s3uri.Bucket),
+		Key:           aws.String(s3uri.Key),
+		Body:          f,
+		ContentLength: fi.Size(),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading %v to %v: %v", path, uri, err.Error())
+	}
+	return nil
+}
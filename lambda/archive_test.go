@@ -0,0 +1,43 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetArchivePath(t *testing.T) {
+	path, ok := GetArchivePath("oci-archive:/tmp/out.tar")
+	assert.True(t, ok)
+	assert.Equal(t, "/tmp/out.tar", path)
+
+	path, ok = GetArchivePath("docker-archive:/tmp/out.tar:nginx:latest")
+	assert.True(t, ok)
+	assert.Equal(t, "/tmp/out.tar", path)
+
+	_, ok = GetArchivePath("oci-archive:")
+	assert.False(t, ok)
+	_, ok = GetArchivePath("docker://nginx:latest")
+	assert.False(t, ok)
+}
+
+func TestStageArchive(t *testing.T) {
+	staged, dir, err := StageArchive("docker-archive:/tmp/out.tar:nginx:latest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, "docker-archive:"+filepath.Join(dir, "out.tar")+":nginx:latest", staged)
+
+	other, otherDir, err := StageArchive("docker-archive:/tmp/out.tar:nginx:latest")
+	require.NoError(t, err)
+	defer os.RemoveAll(otherDir)
+	assert.NotEqual(t, staged, other)
+
+	_, _, err = StageArchive("docker://nginx:latest")
+	assert.Error(t, err)
+}
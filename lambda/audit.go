@@ -0,0 +1,189 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// EnvAuditLogGroup is the CloudWatch Logs group audit events are written
+	// to. No audit events are written when unset.
+	EnvAuditLogGroup = "AUDIT_LOG_GROUP"
+	// EnvAuditLogStream is the stream of the group audit events are written
+	// to. Defaults to the log stream of the Lambda container.
+	EnvAuditLogStream = "AUDIT_LOG_STREAM"
+
+	// AuditEventVersion is the version of the AuditEvent schema, raised on
+	// incompatible changes.
+	AuditEventVersion = "1"
+	auditEventName    = "ImageCopy"
+	defaultLogStream  = "cdk-ecr-deployment"
+)
+
+// AuditEvent is the record of who copied what when. Unlike CopyReport, it
+// has a fixed schema of flat fields, so events can be queried with
+// CloudWatch Logs Insights or CloudTrail Lake.
+type AuditEvent struct {
+	Version           string      `json:"version"`
+	EventName         string      `json:"eventName"`
+	EventTime         time.Time   `json:"eventTime"`
+	Actor             string      `json:"actor"`
+	RequestID         string      `json:"requestId"`
+	InvocationID      string      `json:"invocationId,omitempty"`
+	StackID           string      `json:"stackId"`
+	LogicalResourceID string      `json:"logicalResourceId"`
+	Source            interface{} `json:"source"`
+	Destination       interface{} `json:"destination"`
+	Digest            string      `json:"digest,omitempty"`
+	DestDigest        string      `json:"destDigest,omitempty"`
+	Result            string      `json:"result"`
+	Error             string      `json:"error,omitempty"`
+}
+
+// NewAuditEvent returns the audit event of report, the copy actor made.
+func NewAuditEvent(report CopyReport, actor string) AuditEvent {
+	event := AuditEvent{
+		Version:           AuditEventVersion,
+		EventName:         auditEventName,
+		EventTime:         report.StartedAt.Add(time.Duration(report.DurationMs) * time.Millisecond),
+		Actor:             actor,
+		RequestID:         report.RequestID,
+		InvocationID:      report.InvocationID,
+		StackID:           report.StackID,
+		LogicalResourceID: report.LogicalResourceID,
+		Source:            report.SrcImage,
+		Destination:       report.DestImage,
+		Result:            report.Result,
+		Error:             report.Error,
+	}
+	if s, ok := report.Data["SrcResolvedDigest"].(string); ok {
+		event.Digest = s
+	}
+	if s, ok := report.Data["DestManifestDigest"].(string); ok {
+		event.DestDigest = s
+	}
+	return event
+}
+
+type putLogEventsAPIClient interface {
+	CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error)
+}
+
+// auditStreams are the log streams created by this Lambda container, so
+// each is only created once.
+var auditStreams sync.Map
+
+// AuditLogStream returns the stream audit events are written to, set with
+// AUDIT_LOG_STREAM or else the log stream of the Lambda container.
+func AuditLogStream() string {
+	if s := os.Getenv(EnvAuditLogStream); s != "" {
+		return s
+	}
+	if s := os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"); s != "" {
+		return s
+	}
+	return defaultLogStream
+}
+
+// WriteAuditEvent writes event as JSON to stream of group, creating the
+// stream if it doesn't exist yet.
+func WriteAuditEvent(ctx context.Context, client putLogEventsAPIClient, group, stream string, event AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	key := group + "/" + stream
+	if _, ok := auditStreams.Load(key); !ok {
+		_, err := client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(group),
+			LogStreamName: aws.String(stream),
+		})
+		var exists *cwltypes.ResourceAlreadyExistsException
+		if err != nil && !errors.As(err, &exists) {
+			return fmt.Errorf("error creating audit log stream %s: %v", key, err.Error())
+		}
+		auditStreams.Store(key, struct{}{})
+	}
+	_, err = client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		LogEvents: []cwltypes.InputLogEvent{{
+			Message:   aws.String(string(b)),
+			Timestamp: aws.Int64(event.EventTime.UnixNano() / int64(time.Millisecond)),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error writing audit event to %s: %v", key, err.Error())
+	}
+	return nil
+}
+
+// RoleARN returns the IAM role ARN of an assumed-role session ARN, like
+// arn:aws:sts::123456789012:assumed-role/deploy/handler, which is what the
+// Lambda execution role calls itself. Session ARNs don't carry the path of
+// the role, so it is returned without one. Other ARNs are returned as they
+// are.
+func RoleARN(sessionARN string) string {
+	parts := strings.SplitN(sessionARN, ":", 6)
+	if len(parts) != 6 || parts[2] != "sts" || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return sessionARN
+	}
+	role := strings.SplitN(strings.TrimPrefix(parts[5], "assumed-role/"), "/", 2)[0]
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], parts[4], role)
+}
+
+// auditActor is the ARN of the execution role, looked up once per Lambda
+// container. A failed lookup isn't cached, the next audit event tries again.
+var auditActor struct {
+	mu  sync.Mutex
+	arn string
+}
+
+type getCallerIdentityAPIClient interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+func lookupAuditActor(ctx context.Context, client getCallerIdentityAPIClient) string {
+	auditActor.mu.Lock()
+	defer auditActor.mu.Unlock()
+	if auditActor.arn != "" {
+		return auditActor.arn
+	}
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		loggerFrom(ctx).Warnf("Looking up audit actor failed: %v", err)
+		return ""
+	}
+	auditActor.arn = RoleARN(aws.ToString(identity.Arn))
+	return auditActor.arn
+}
+
+// writeAuditEvent writes the audit event of report to group. Like the copy
+// report, it is best effort: failures are logged and don't fail the request.
+func writeAuditEvent(ctx context.Context, group string, report CopyReport) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warnf("Writing audit event failed: api client configuration error: %v", err)
+		return
+	}
+	event := NewAuditEvent(report, lookupAuditActor(ctx, sts.NewFromConfig(cfg)))
+	if err := WriteAuditEvent(ctx, cloudwatchlogs.NewFromConfig(cfg), group, AuditLogStream(), event); err != nil {
+		loggerFrom(ctx).Warnf("Writing audit event failed: %v", err)
+	}
+}
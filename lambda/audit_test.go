@@ -0,0 +1,104 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLogsClient struct {
+	streamsCreated int
+	createErr      error
+	messages       []string
+}
+
+func (c *fakeLogsClient) CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	c.streamsCreated++
+	return &cloudwatchlogs.CreateLogStreamOutput{}, c.createErr
+}
+
+func (c *fakeLogsClient) PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	for _, e := range params.LogEvents {
+		c.messages = append(c.messages, aws.ToString(e.Message))
+	}
+	return &cloudwatchlogs.PutLogEventsOutput{}, nil
+}
+
+func TestAuditEvent(t *testing.T) {
+	report := CopyReport{
+		RequestID:  "c0ffee",
+		SrcImage:   "docker://nginx:1.25",
+		DestImage:  "docker://registry.example.com/nginx:1.25",
+		Result:     "copied",
+		StartedAt:  time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		DurationMs: 1500,
+		Data:       map[string]interface{}{"SrcResolvedDigest": "sha256:abc", "DestManifestDigest": "sha256:def"},
+	}
+	role := "arn:aws:iam::123456789012:role/deploy"
+	event := NewAuditEvent(report, role)
+	assert.Equal(t, AuditEventVersion, event.Version)
+	assert.Equal(t, role, event.Actor)
+	assert.Equal(t, "sha256:abc", event.Digest)
+	assert.Equal(t, "sha256:def", event.DestDigest)
+	assert.Equal(t, time.Date(2023, 1, 2, 3, 4, 6, 500000000, time.UTC), event.EventTime)
+
+	client := &fakeLogsClient{}
+	require.NoError(t, WriteAuditEvent(context.Background(), client, "audit", "stream-1", event))
+	require.NoError(t, WriteAuditEvent(context.Background(), client, "audit", "stream-1", event))
+	assert.Equal(t, 1, client.streamsCreated)
+	require.Len(t, client.messages, 2)
+	var written map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(client.messages[0]), &written))
+	assert.Equal(t, "c0ffee", written["requestId"])
+	assert.Equal(t, "docker://nginx:1.25", written["source"])
+	assert.Equal(t, "copied", written["result"])
+
+	exists := &fakeLogsClient{createErr: &cwltypes.ResourceAlreadyExistsException{}}
+	assert.NoError(t, WriteAuditEvent(context.Background(), exists, "audit", "stream-2", event))
+	denied := &fakeLogsClient{createErr: errors.New("access denied")}
+	assert.Error(t, WriteAuditEvent(context.Background(), denied, "audit", "stream-3", event))
+	assert.Empty(t, denied.messages)
+}
+
+func TestRoleARN(t *testing.T) {
+	assert.Equal(t, "arn:aws:iam::123456789012:role/deploy", RoleARN("arn:aws:sts::123456789012:assumed-role/deploy/handler"))
+	assert.Equal(t, "arn:aws-cn:iam::123456789012:role/deploy", RoleARN("arn:aws-cn:sts::123456789012:assumed-role/deploy/handler"))
+	assert.Equal(t, "arn:aws:iam::123456789012:user/ci", RoleARN("arn:aws:iam::123456789012:user/ci"))
+	assert.Equal(t, "", RoleARN(""))
+}
+
+type fakeSTSClient struct {
+	calls int
+	errs  int
+}
+
+func (c *fakeSTSClient) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	c.calls++
+	if c.calls <= c.errs {
+		return nil, errors.New("throttled")
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/deploy/handler")}, nil
+}
+
+func TestLookupAuditActor(t *testing.T) {
+	t.Cleanup(func() { auditActor.arn = "" })
+	auditActor.arn = ""
+	client := &fakeSTSClient{errs: 1}
+	// A failed lookup isn't cached.
+	assert.Equal(t, "", lookupAuditActor(context.Background(), client))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/deploy", lookupAuditActor(context.Background(), client))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/deploy", lookupAuditActor(context.Background(), client))
+	assert.Equal(t, 2, client.calls)
+}
@@ -0,0 +1,77 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const EnvTotalBudget = "TOTAL_BUDGET"
+
+var errBudgetExceeded = errors.New("exceeded total time budget")
+
+// totalBudget is the most wall-clock time a request may take, or 0 for no
+// budget.
+var totalBudget time.Duration
+
+type budgetKey struct{}
+
+func parseTotalBudget(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", EnvTotalBudget, err)
+	}
+	if d <= 0 {
+		return 0, errors.New(EnvTotalBudget + " must be positive")
+	}
+	return d, nil
+}
+
+// withBudget returns a context that is cancelled once budget is spent, and
+// that checkBudget fails on from then on. A zero budget, or a ctx that
+// already has one, is returned as is, so nested copies share the budget of
+// the request.
+func withBudget(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := budgetDeadline(ctx); ok || budget <= 0 {
+		return ctx, func() {}
+	}
+	return withBudgetDeadline(ctx, time.Now().Add(budget))
+}
+
+func withBudgetDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(context.WithValue(ctx, budgetKey{}, deadline), deadline)
+}
+
+func budgetDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(budgetKey{}).(time.Time)
+	return deadline, ok
+}
+
+// checkBudget fails once the budget of ctx is spent. stage names the stage
+// just finished.
+func checkBudget(ctx context.Context, stage string) error {
+	if deadline, ok := budgetDeadline(ctx); ok && !time.Now().Before(deadline) {
+		return fmt.Errorf("%w after %s stage", errBudgetExceeded, stage)
+	}
+	return nil
+}
+
+// budgetError replaces err with a budget error if the budget of ctx ran
+// out, so a copy cancelled by it doesn't fail with a bare "context deadline
+// exceeded".
+func budgetError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, errBudgetExceeded) {
+		return err
+	}
+	if budgetErr := checkBudget(ctx, "last"); budgetErr != nil {
+		return fmt.Errorf("%w: %v", errBudgetExceeded, err)
+	}
+	return err
+}
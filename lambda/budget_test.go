@@ -0,0 +1,65 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTotalBudget(t *testing.T) {
+	d, err := parseTotalBudget("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d)
+	d, err = parseTotalBudget("10m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, d)
+	_, err = parseTotalBudget("0s")
+	assert.Error(t, err)
+	_, err = parseTotalBudget("soon")
+	assert.Error(t, err)
+}
+
+func TestBudget(t *testing.T) {
+	ctx, cancel := withBudget(context.Background(), 0)
+	defer cancel()
+	assert.NoError(t, checkBudget(ctx, "parse"))
+
+	ctx, cancel = withBudget(context.Background(), time.Millisecond)
+	defer cancel()
+	// A nested budget doesn't extend the outer one.
+	nested, cancelNested := withBudget(ctx, time.Hour)
+	defer cancelNested()
+	<-nested.Done()
+
+	err := checkBudget(nested, "copy")
+	assert.True(t, errors.Is(err, errBudgetExceeded))
+	assert.EqualError(t, err, "exceeded total time budget after copy stage")
+	assert.True(t, errors.Is(budgetError(ctx, context.DeadlineExceeded), errBudgetExceeded))
+	assert.NoError(t, budgetError(ctx, nil))
+
+	copyCtx, cancelCopy := newTimeoutContext(ctx)
+	defer cancelCopy()
+	assert.Error(t, copyCtx.Err())
+}
+
+func TestHandleImagesTotalBudget(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	ctx, cancel := withBudget(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := handleImages(ctx, map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, make(map[string]interface{}))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errBudgetExceeded))
+}
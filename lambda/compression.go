@@ -0,0 +1,52 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+)
+
+// ResolveCompression returns the algorithm to recompress layers with, or
+// nil to leave them as they are.
+func ResolveCompression(format string) (*compression.Algorithm, error) {
+	if format == "" {
+		return nil, nil
+	}
+	algo, err := compression.AlgorithmByName(strings.ToLower(format))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v %q, expected gzip or zstd", COMPRESSION_FORMAT, format)
+	}
+	return &algo, nil
+}
+
+func layersSize(layers []types.ImageInspectLayer) int64 {
+	var size int64
+	for _, l := range layers {
+		if l.Size > 0 {
+			size += l.Size
+		}
+	}
+	return size
+}
+
+// manifestLayersSize returns the total size of the layers in the image
+// manifest m.
+func manifestLayersSize(m []byte) (int64, error) {
+	parsed, err := manifest.FromBlob(m, manifest.GuessMIMEType(m))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, l := range parsed.LayerInfos() {
+		if l.Size > 0 {
+			size += l.Size
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,31 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	compressiontypes "github.com/containers/image/v5/pkg/compression/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCompression(t *testing.T) {
+	algo, err := ResolveCompression("")
+	assert.NoError(t, err)
+	assert.Nil(t, algo)
+
+	algo, err = ResolveCompression("gzip")
+	require.NoError(t, err)
+	assert.Equal(t, compressiontypes.GzipAlgorithmName, algo.Name())
+
+	algo, err = ResolveCompression("ZSTD")
+	require.NoError(t, err)
+	assert.Equal(t, compressiontypes.ZstdAlgorithmName, algo.Name())
+
+	for _, format := range []string{"lz4", "zstd:auto"} {
+		_, err = ResolveCompression(format)
+		assert.Error(t, err, format)
+	}
+}
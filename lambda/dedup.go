@@ -0,0 +1,148 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// EnvDedupStore selects where handled request ids are remembered:
+	// "memory" for the current Lambda container, or "dynamodb:<table>" for a
+	// DynamoDB table with a string partition key "RequestId" and TTL on
+	// "ExpiresAt". Deduplication is disabled when unset.
+	EnvDedupStore = "DEDUP_STORE"
+	// EnvDedupTTL is how long a handled request id is remembered.
+	EnvDedupTTL = "DEDUP_TTL"
+
+	defaultDedupTTL = time.Hour
+)
+
+// RequestStore remembers CloudFormation request ids that have been handled
+// successfully so a re-delivered event can be acknowledged without copying.
+type RequestStore interface {
+	Seen(ctx context.Context, requestID string) (bool, error)
+	Record(ctx context.Context, requestID string) error
+}
+
+// NewRequestStore returns the store configured by spec, or nil if spec is
+// empty.
+func NewRequestStore(spec string, ttl time.Duration) (RequestStore, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "memory":
+		return NewMemoryRequestStore(ttl), nil
+	case strings.HasPrefix(spec, "dynamodb:"):
+		table := strings.TrimPrefix(spec, "dynamodb:")
+		if table == "" {
+			return nil, fmt.Errorf("%s: missing DynamoDB table name", EnvDedupStore)
+		}
+		cfg, err := config.LoadDefaultConfig(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+		}
+		return &dynamoRequestStore{dynamodb.NewFromConfig(cfg), table, ttl}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown store %q", EnvDedupStore, spec)
+}
+
+type memoryRequestStore struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	now  func() time.Time
+	seen map[string]time.Time
+}
+
+func NewMemoryRequestStore(ttl time.Duration) *memoryRequestStore {
+	return &memoryRequestStore{ttl: ttl, now: time.Now, seen: make(map[string]time.Time)}
+}
+
+func (s *memoryRequestStore) Seen(ctx context.Context, requestID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.seen[requestID]
+	return ok && s.now().Before(expiresAt), nil
+}
+
+func (s *memoryRequestStore) Record(ctx context.Context, requestID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for id, expiresAt := range s.seen {
+		if !now.Before(expiresAt) {
+			delete(s.seen, id)
+		}
+	}
+	s.seen[requestID] = now.Add(s.ttl)
+	return nil
+}
+
+type dynamoRequestStore struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+}
+
+func (s *dynamoRequestStore) Seen(ctx context.Context, requestID string) (bool, error) {
+	resp, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]dynamodbtypes.AttributeValue{"RequestId": &dynamodbtypes.AttributeValueMemberS{Value: requestID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading request %s from %s: %v", requestID, s.table, err.Error())
+	}
+	if resp.Item == nil {
+		return false, nil
+	}
+	// TTL deletion is lazy, so expired items may still be returned
+	if v, ok := resp.Item["ExpiresAt"].(*dynamodbtypes.AttributeValueMemberN); ok {
+		expiresAt, err := strconv.ParseInt(v.Value, 10, 64)
+		if err == nil && time.Now().Unix() >= expiresAt {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *dynamoRequestStore) Record(ctx context.Context, requestID string) error {
+	expiresAt := time.Now().Add(s.ttl).Unix()
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]dynamodbtypes.AttributeValue{
+			"RequestId": &dynamodbtypes.AttributeValueMemberS{Value: requestID},
+			"ExpiresAt": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error recording request %s in %s: %v", requestID, s.table, err.Error())
+	}
+	return nil
+}
+
+func parseDedupTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultDedupTTL, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", EnvDedupTTL, err)
+	}
+	if ttl <= 0 {
+		return 0, errors.New(EnvDedupTTL + " must be positive")
+	}
+	return ttl, nil
+}
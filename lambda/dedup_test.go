@@ -0,0 +1,61 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRequestStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryRequestStore(time.Minute)
+	store.now = func() time.Time { return now }
+
+	seen, err := store.Seen(ctx, "req-1")
+	assert.NoError(t, err)
+	assert.False(t, seen)
+
+	assert.NoError(t, store.Record(ctx, "req-1"))
+	seen, _ = store.Seen(ctx, "req-1")
+	assert.True(t, seen)
+	seen, _ = store.Seen(ctx, "req-2")
+	assert.False(t, seen)
+
+	now = now.Add(2 * time.Minute)
+	seen, _ = store.Seen(ctx, "req-1")
+	assert.False(t, seen)
+}
+
+func TestNewRequestStore(t *testing.T) {
+	store, err := NewRequestStore("", time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, store)
+
+	store, err = NewRequestStore("memory", time.Minute)
+	assert.NoError(t, err)
+	assert.NotNil(t, store)
+
+	_, err = NewRequestStore("dynamodb:", time.Minute)
+	assert.Error(t, err)
+	_, err = NewRequestStore("redis", time.Minute)
+	assert.Error(t, err)
+}
+
+func TestParseDedupTTL(t *testing.T) {
+	ttl, err := parseDedupTTL("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDedupTTL, ttl)
+	ttl, err = parseDedupTTL("10m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, ttl)
+	_, err = parseDedupTTL("-1m")
+	assert.Error(t, err)
+	_, err = parseDedupTTL("soon")
+	assert.Error(t, err)
+}
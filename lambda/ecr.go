@@ -0,0 +1,491 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/containers/image/v5/manifest"
+)
+
+var ecrHostRe = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ECRRepository identifies a private ECR repository.
+type ECRRepository struct {
+	RegistryID string
+	Region     string
+	Name       string
+}
+
+// GetECRRepository returns the ECR repository info refers to, if its
+// registry is a private ECR registry.
+func GetECRRepository(info ImageRefInfo) (ECRRepository, bool) {
+	m := ecrHostRe.FindStringSubmatch(info.Registry)
+	if m == nil || info.Repository == "" {
+		return ECRRepository{}, false
+	}
+	return ECRRepository{RegistryID: m[1], Region: m[2], Name: info.Repository}, true
+}
+
+func NewECRClient(ctx context.Context, region string) (*ecr.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	return ecr.NewFromConfig(cfg), nil
+}
+
+// FindPullThroughCacheRule returns the pull through cache rule whose prefix
+// covers repo, or nil if there is none.
+func FindPullThroughCacheRule(ctx context.Context, client ecr.DescribePullThroughCacheRulesAPIClient, repo ECRRepository) (*ecrtypes.PullThroughCacheRule, error) {
+	p := ecr.NewDescribePullThroughCacheRulesPaginator(client, &ecr.DescribePullThroughCacheRulesInput{
+		RegistryId: aws.String(repo.RegistryID),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i, rule := range page.PullThroughCacheRules {
+			prefix := aws.ToString(rule.EcrRepositoryPrefix)
+			if prefix != "" && (repo.Name == prefix || strings.HasPrefix(repo.Name, prefix+"/")) {
+				return &page.PullThroughCacheRules[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+const destRepositoryPollInterval = 5 * time.Second
+
+// WaitForECRRepository waits up to timeout for repo to exist, polling every
+// interval. ECR repositories have no deleting state: one torn down by a
+// stack that is being replaced is reported as not found until it has been
+// created again. A zero timeout checks once.
+func WaitForECRRepository(ctx context.Context, client ecr.DescribeRepositoriesAPIClient, repo ECRRepository, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+			RegistryId:      aws.String(repo.RegistryID),
+			RepositoryNames: []string{repo.Name},
+		})
+		var notFound *ecrtypes.RepositoryNotFoundException
+		if err == nil {
+			return nil
+		} else if !errors.As(err, &notFound) {
+			return fmt.Errorf("describing destination repository %s failed: %v", repo.Name, err)
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return fmt.Errorf("destination repository %s does not exist after waiting %v, it may still be being deleted or not created yet", repo.Name, timeout)
+		}
+		loggerFrom(ctx).Warnf("Destination repository %s does not exist, it may be being deleted or recreated; checking again in %v", repo.Name, interval)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitForScanOnPush waits up to timeout for repo to have scan on push
+// enabled, polling every interval. A zero timeout checks once. Only the
+// repository setting is checked; registry-level enhanced scanning rules
+// aren't.
+func WaitForScanOnPush(ctx context.Context, client ecr.DescribeRepositoriesAPIClient, repo ECRRepository, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+			RegistryId:      aws.String(repo.RegistryID),
+			RepositoryNames: []string{repo.Name},
+		})
+		if err != nil {
+			return fmt.Errorf("describing destination repository %s failed: %v", repo.Name, err)
+		}
+		if len(out.Repositories) > 0 {
+			if c := out.Repositories[0].ImageScanningConfiguration; c != nil && c.ScanOnPush {
+				return nil
+			}
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			return fmt.Errorf("destination repository %s does not have scan on push enabled after waiting %v", repo.Name, timeout)
+		}
+		loggerFrom(ctx).Warnf("Destination repository %s does not have scan on push enabled yet; checking again in %v", repo.Name, interval)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CheckTagImmutability returns an error unless repo has image tag
+// immutability enabled.
+func CheckTagImmutability(ctx context.Context, client ecr.DescribeRepositoriesAPIClient, repo ECRRepository) error {
+	out, err := client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(repo.RegistryID),
+		RepositoryNames: []string{repo.Name},
+	})
+	if err != nil {
+		return fmt.Errorf("describing destination repository %s failed: %v", repo.Name, err)
+	}
+	if len(out.Repositories) == 0 {
+		return fmt.Errorf("destination repository %s not found", repo.Name)
+	}
+	if mutability := out.Repositories[0].ImageTagMutability; mutability != ecrtypes.ImageTagMutabilityImmutable {
+		return fmt.Errorf("destination repository %s has image tag mutability %s, expected %s", repo.Name, mutability, ecrtypes.ImageTagMutabilityImmutable)
+	}
+	return nil
+}
+
+type ecrPruneAPIClient interface {
+	ecr.DescribeImagesAPIClient
+	BatchDeleteImage(ctx context.Context, params *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error)
+}
+
+// maxBatchDeleteImageIds is the most image ids BatchDeleteImage takes.
+const maxBatchDeleteImageIds = 100
+
+// PruneTags deletes the tags of repo whose images were pushed before
+// olderThan, except keep, and returns them sorted. Deleting a tag of an
+// image with other tags only untags it.
+func PruneTags(ctx context.Context, client ecrPruneAPIClient, repo ECRRepository, keep string, olderThan time.Time) ([]string, error) {
+	pushedAt, err := GetECRTagsPushedAt(ctx, client, repo)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for tag, at := range pushedAt {
+		if tag != keep && at.Before(olderThan) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	var pruned []string
+	for start := 0; start < len(tags); start += maxBatchDeleteImageIds {
+		end := start + maxBatchDeleteImageIds
+		if end > len(tags) {
+			end = len(tags)
+		}
+		ids := make([]ecrtypes.ImageIdentifier, 0, end-start)
+		for _, tag := range tags[start:end] {
+			ids = append(ids, ecrtypes.ImageIdentifier{ImageTag: aws.String(tag)})
+		}
+		out, err := client.BatchDeleteImage(ctx, &ecr.BatchDeleteImageInput{
+			RegistryId:     aws.String(repo.RegistryID),
+			RepositoryName: aws.String(repo.Name),
+			ImageIds:       ids,
+		})
+		if err != nil {
+			return pruned, fmt.Errorf("deleting tags of %s failed: %v", repo.Name, err)
+		}
+		for _, id := range out.ImageIds {
+			pruned = append(pruned, aws.ToString(id.ImageTag))
+		}
+		for _, failure := range out.Failures {
+			loggerFrom(ctx).Warnf("Deleting tag %s of %s failed: %s", aws.ToString(failure.ImageId.ImageTag), repo.Name, aws.ToString(failure.FailureReason))
+		}
+	}
+	sort.Strings(pruned)
+	return pruned, nil
+}
+
+// awsPartition returns the AWS partition region is in.
+func awsPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	default:
+		return "aws"
+	}
+}
+
+// awsDNSSuffix returns the DNS suffix of the AWS endpoints of region.
+func awsDNSSuffix(region string) string {
+	if awsPartition(region) == "aws-cn" {
+		return "amazonaws.com.cn"
+	}
+	return "amazonaws.com"
+}
+
+// ECRRegistryHost returns the ECR registry host of account in region.
+func ECRRegistryHost(account, region string) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.%s", account, region, awsDNSSuffix(region))
+}
+
+// CheckECRPartition returns an error if info is an ECR image outside the
+// partition of localRegion, the function's region, that has no creds.
+// ECR auto login uses the function's credentials, which are only valid in
+// its own partition.
+func CheckECRPartition(info ImageRefInfo, creds string, localRegion string, credsProp string) error {
+	repo, ok := GetECRRepository(info)
+	if !ok || creds != "" || localRegion == "" {
+		return nil
+	}
+	if partition, local := awsPartition(repo.Region), awsPartition(localRegion); partition != local {
+		return fmt.Errorf("%s is in the %s partition but this function runs in %s, and ECR auto login doesn't span partitions: set %v, e.g. to AWS credentials for %s",
+			info.Registry, partition, local, credsProp, partition)
+	}
+	return nil
+}
+
+// ECRLimits are the ECR service quotas an image is checked against before it's
+// pushed. A zero limit isn't checked.
+type ECRLimits struct {
+	MaxLayers        int
+	MaxLayerSize     int64
+	MaxManifestBytes int64
+}
+
+// defaultECRLimits are the fixed ECR quotas at the time of writing: 127 layers
+// per image, 52,000 MiB per layer and 4 MiB per manifest.
+var defaultECRLimits = ECRLimits{
+	MaxLayers:        127,
+	MaxLayerSize:     52000 * 1024 * 1024,
+	MaxManifestBytes: 4 * 1024 * 1024,
+}
+
+// CheckECRLimits fails if the source manifest m exceeds limits, naming the
+// limit that was exceeded. Only the manifest size of a manifest list is
+// checked, the layers of its instances aren't known until they're copied.
+func CheckECRLimits(m []byte, limits ECRLimits) error {
+	if limits.MaxManifestBytes > 0 && int64(len(m)) > limits.MaxManifestBytes {
+		return fmt.Errorf("source manifest is %d bytes, exceeds the ECR max manifest size of %d bytes", len(m), limits.MaxManifestBytes)
+	}
+	if manifest.MIMETypeIsMultiImage(manifest.GuessMIMEType(m)) {
+		return nil
+	}
+	layers, err := ManifestLayers(m)
+	if err != nil {
+		return err
+	}
+	if limits.MaxLayers > 0 && len(layers) > limits.MaxLayers {
+		return fmt.Errorf("source image has %d layers, exceeds the ECR max of %d layers per image", len(layers), limits.MaxLayers)
+	}
+	if limits.MaxLayerSize > 0 {
+		for _, l := range layers {
+			if l.Size > limits.MaxLayerSize {
+				return fmt.Errorf("source layer %s is %d bytes, exceeds the ECR max layer size of %d bytes", l.Digest, l.Size, limits.MaxLayerSize)
+			}
+		}
+	}
+	return nil
+}
+
+type ecrReplicationAPIClient interface {
+	DescribeRegistry(ctx context.Context, params *ecr.DescribeRegistryInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRegistryOutput, error)
+	PutReplicationConfiguration(ctx context.Context, params *ecr.PutReplicationConfigurationInput, optFns ...func(*ecr.Options)) (*ecr.PutReplicationConfigurationOutput, error)
+	DescribeRepositories(ctx context.Context, params *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error)
+}
+
+const (
+	// ecrMaxReplicationRules and ecrMaxReplicationDestinations are the ECR
+	// limits of a replication configuration: rules, and unique destinations
+	// across them.
+	ecrMaxReplicationRules        = 10
+	ecrMaxReplicationDestinations = 25
+	// replicationAttempts is how often the replication configuration is
+	// written when another writer keeps replacing it.
+	replicationAttempts = 3
+)
+
+// replicationMu serializes the replication configuration changes of the
+// copies in a container.
+var replicationMu sync.Mutex
+
+// replicationRuleMatches reports whether rule replicates the repository
+// name: rules without filters replicate every repository.
+func replicationRuleMatches(rule ecrtypes.ReplicationRule, name string) bool {
+	if len(rule.RepositoryFilters) == 0 {
+		return true
+	}
+	for _, f := range rule.RepositoryFilters {
+		if f.FilterType == ecrtypes.RepositoryFilterTypePrefixMatch && strings.HasPrefix(name, aws.ToString(f.Filter)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRepositoryRule reports whether rule is filtered to the repository name
+// alone, as the rules EnsureReplication adds are.
+func isRepositoryRule(rule ecrtypes.ReplicationRule, name string) bool {
+	return len(rule.RepositoryFilters) == 1 &&
+		rule.RepositoryFilters[0].FilterType == ecrtypes.RepositoryFilterTypePrefixMatch &&
+		aws.ToString(rule.RepositoryFilters[0].Filter) == name
+}
+
+// mergeReplication returns rules replicating repo to regions, and the
+// regions no rule replicated it to yet. They are added to the rule of the
+// repository if there is one, or to a new rule. rules isn't modified.
+func mergeReplication(rules []ecrtypes.ReplicationRule, repo ECRRepository, regions []string) ([]ecrtypes.ReplicationRule, []string, error) {
+	covered := make(map[string]bool)
+	for _, rule := range rules {
+		if !replicationRuleMatches(rule, repo.Name) {
+			continue
+		}
+		for _, d := range rule.Destinations {
+			if aws.ToString(d.RegistryId) == repo.RegistryID {
+				covered[aws.ToString(d.Region)] = true
+			}
+		}
+	}
+	var missing []string
+	var destinations []ecrtypes.ReplicationDestination
+	for _, region := range regions {
+		if region == repo.Region {
+			return nil, nil, fmt.Errorf("can't replicate %s to its own region %s", repo.Name, region)
+		}
+		if covered[region] {
+			continue
+		}
+		covered[region] = true
+		missing = append(missing, region)
+		destinations = append(destinations, ecrtypes.ReplicationDestination{Region: aws.String(region), RegistryId: aws.String(repo.RegistryID)})
+	}
+	if len(missing) == 0 {
+		return rules, nil, nil
+	}
+	merged := append([]ecrtypes.ReplicationRule(nil), rules...)
+	for i, rule := range merged {
+		if isRepositoryRule(rule, repo.Name) {
+			merged[i].Destinations = append(append([]ecrtypes.ReplicationDestination(nil), rule.Destinations...), destinations...)
+			return merged, missing, nil
+		}
+	}
+	merged = append(merged, ecrtypes.ReplicationRule{
+		Destinations: destinations,
+		RepositoryFilters: []ecrtypes.RepositoryFilter{{
+			Filter:     aws.String(repo.Name),
+			FilterType: ecrtypes.RepositoryFilterTypePrefixMatch,
+		}},
+	})
+	return merged, missing, nil
+}
+
+// checkReplicationLimits checks rules against the ECR limits, which
+// PutReplicationConfiguration would only report as a validation error.
+func checkReplicationLimits(rules []ecrtypes.ReplicationRule, repo ECRRepository) error {
+	if len(rules) > ecrMaxReplicationRules {
+		return fmt.Errorf("can't add a replication rule for %s, the registry already has the ECR max of %d rules; add its regions to an existing rule instead",
+			repo.Name, ecrMaxReplicationRules)
+	}
+	destinations := make(map[string]bool)
+	for _, rule := range rules {
+		for _, d := range rule.Destinations {
+			destinations[aws.ToString(d.RegistryId)+"/"+aws.ToString(d.Region)] = true
+		}
+	}
+	if len(destinations) > ecrMaxReplicationDestinations {
+		return fmt.Errorf("can't replicate %s, the replication configuration would have %d destinations, more than the ECR max of %d",
+			repo.Name, len(destinations), ecrMaxReplicationDestinations)
+	}
+	return nil
+}
+
+// checkReplicationOverMatch fails if other repositories of the registry
+// start with the name of repo. ECR only filters replication by prefix, so
+// a rule for repo would replicate them too.
+func checkReplicationOverMatch(ctx context.Context, client ecrReplicationAPIClient, repo ECRRepository) error {
+	var others []string
+	paginator := ecr.NewDescribeRepositoriesPaginator(client, &ecr.DescribeRepositoriesInput{RegistryId: aws.String(repo.RegistryID)})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing the repositories a replication rule for %s would match failed: %v", repo.Name, err)
+		}
+		for _, r := range out.Repositories {
+			name := aws.ToString(r.RepositoryName)
+			if name != repo.Name && strings.HasPrefix(name, repo.Name) {
+				others = append(others, name)
+			}
+		}
+	}
+	if len(others) > 0 {
+		sort.Strings(others)
+		return fmt.Errorf("a replication rule for %s would also replicate %s, ECR only filters replication by repository name prefix; configure their replication yourself",
+			repo.Name, strings.Join(others, ", "))
+	}
+	return nil
+}
+
+// EnsureReplication makes the replication configuration of the registry of
+// repo replicate it to regions in the same registry. Regions no rule covers
+// yet are added to a rule filtered to the repository; other rules are kept
+// as they are. It returns the regions that were added.
+//
+// ECR has no conditional writes, so the configuration is merged with the
+// latest one right before each write and read back after it, and written
+// again if another writer replaced it in between.
+func EnsureReplication(ctx context.Context, client ecrReplicationAPIClient, repo ECRRepository, regions []string) ([]string, error) {
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	written := make(map[string]bool)
+	checked := false
+	for attempt := 0; ; attempt++ {
+		out, err := client.DescribeRegistry(ctx, &ecr.DescribeRegistryInput{})
+		if err != nil {
+			return nil, fmt.Errorf("describing the registry of %s failed: %v", repo.Name, err)
+		}
+		if id := aws.ToString(out.RegistryId); id != repo.RegistryID {
+			return nil, fmt.Errorf("can't configure replication of registry %s from registry %s, the destination must be in the function's own account", repo.RegistryID, id)
+		}
+		var rules []ecrtypes.ReplicationRule
+		if out.ReplicationConfiguration != nil {
+			rules = out.ReplicationConfiguration.Rules
+		}
+		rules, missing, err := mergeReplication(rules, repo, regions)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 {
+			var added []string
+			for _, region := range regions {
+				if written[region] {
+					added = append(added, region)
+					written[region] = false
+				}
+			}
+			return added, nil
+		}
+		if attempt == replicationAttempts {
+			return nil, fmt.Errorf("replication of %s to %s was replaced by another change of the replication configuration %d times", repo.Name, strings.Join(missing, ", "), attempt)
+		}
+		if err := checkReplicationLimits(rules, repo); err != nil {
+			return nil, err
+		}
+		if !checked {
+			if err := checkReplicationOverMatch(ctx, client, repo); err != nil {
+				return nil, err
+			}
+			checked = true
+		}
+		_, err = client.PutReplicationConfiguration(ctx, &ecr.PutReplicationConfigurationInput{
+			ReplicationConfiguration: &ecrtypes.ReplicationConfiguration{Rules: rules},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("updating the replication configuration for %s failed: %v", repo.Name, err)
+		}
+		for _, region := range missing {
+			written[region] = true
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeECRClient struct {
+	rules []ecrtypes.PullThroughCacheRule
+	// missingDescribes is how many DescribeRepositories calls report the
+	// repository as not found.
+	missingDescribes int
+	describes        int
+	// scanOnPushDescribes is how many DescribeRepositories calls report
+	// scan on push as disabled.
+	scanOnPushDescribes int
+	registryID          string
+	replication         *ecrtypes.ReplicationConfiguration
+	replicationPuts     int
+	tagMutability       ecrtypes.ImageTagMutability
+	// repositories are listed by DescribeRepositories without names.
+	repositories []string
+}
+
+func (c *fakeECRClient) DescribeRepositories(ctx context.Context, params *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	if len(params.RepositoryNames) == 0 {
+		out := &ecr.DescribeRepositoriesOutput{}
+		for _, name := range c.repositories {
+			out.Repositories = append(out.Repositories, ecrtypes.Repository{RepositoryName: aws.String(name)})
+		}
+		return out, nil
+	}
+	c.describes++
+	if c.describes <= c.missingDescribes {
+		return nil, &ecrtypes.RepositoryNotFoundException{Message: aws.String("repository does not exist")}
+	}
+	return &ecr.DescribeRepositoriesOutput{Repositories: []ecrtypes.Repository{{
+		RepositoryName:             aws.String(params.RepositoryNames[0]),
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{ScanOnPush: c.describes > c.scanOnPushDescribes},
+		ImageTagMutability:         c.tagMutability,
+	}}}, nil
+}
+
+func (c *fakeECRClient) DescribePullThroughCacheRules(ctx context.Context, params *ecr.DescribePullThroughCacheRulesInput, optFns ...func(*ecr.Options)) (*ecr.DescribePullThroughCacheRulesOutput, error) {
+	return &ecr.DescribePullThroughCacheRulesOutput{PullThroughCacheRules: c.rules}, nil
+}
+
+func (c *fakeECRClient) DescribeRegistry(ctx context.Context, params *ecr.DescribeRegistryInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRegistryOutput, error) {
+	return &ecr.DescribeRegistryOutput{RegistryId: aws.String(c.registryID), ReplicationConfiguration: c.replication}, nil
+}
+
+func (c *fakeECRClient) PutReplicationConfiguration(ctx context.Context, params *ecr.PutReplicationConfigurationInput, optFns ...func(*ecr.Options)) (*ecr.PutReplicationConfigurationOutput, error) {
+	c.replicationPuts++
+	c.replication = params.ReplicationConfiguration
+	return &ecr.PutReplicationConfigurationOutput{ReplicationConfiguration: params.ReplicationConfiguration}, nil
+}
+
+func TestGetECRRepository(t *testing.T) {
+	repo, ok := GetECRRepository(ImageRefInfo{Registry: "123456789012.dkr.ecr.us-west-2.amazonaws.com", Repository: "team/app"})
+	assert.True(t, ok)
+	assert.Equal(t, ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "team/app"}, repo)
+
+	repo, ok = GetECRRepository(ImageRefInfo{Registry: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", Repository: "app"})
+	assert.True(t, ok)
+	assert.Equal(t, "cn-north-1", repo.Region)
+
+	_, ok = GetECRRepository(ImageRefInfo{Registry: "docker.io", Repository: "library/nginx"})
+	assert.False(t, ok)
+	_, ok = GetECRRepository(ImageRefInfo{Registry: "public.ecr.aws", Repository: "nginx/nginx"})
+	assert.False(t, ok)
+}
+
+func TestFindPullThroughCacheRule(t *testing.T) {
+	client := &fakeECRClient{rules: []ecrtypes.PullThroughCacheRule{
+		{EcrRepositoryPrefix: aws.String("quay"), UpstreamRegistryUrl: aws.String("quay.io")},
+		{EcrRepositoryPrefix: aws.String("ecr-public"), UpstreamRegistryUrl: aws.String("public.ecr.aws")},
+	}}
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-west-2"}
+
+	repo.Name = "ecr-public/nginx/nginx"
+	rule, err := FindPullThroughCacheRule(context.Background(), client, repo)
+	assert.NoError(t, err)
+	assert.Equal(t, "public.ecr.aws", aws.ToString(rule.UpstreamRegistryUrl))
+
+	repo.Name = "quayside/app"
+	rule, err = FindPullThroughCacheRule(context.Background(), client, repo)
+	assert.NoError(t, err)
+	assert.Nil(t, rule)
+}
+
+func TestWaitForECRRepository(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "app"}
+
+	client := &fakeECRClient{missingDescribes: 2}
+	assert.NoError(t, WaitForECRRepository(context.Background(), client, repo, time.Second, time.Millisecond))
+	assert.Equal(t, 3, client.describes)
+
+	client = &fakeECRClient{missingDescribes: 1}
+	err := WaitForECRRepository(context.Background(), client, repo, 0, time.Millisecond)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "destination repository app does not exist")
+	assert.Equal(t, 1, client.describes)
+}
+
+func TestCheckECRPartition(t *testing.T) {
+	gov := ImageRefInfo{Registry: "123456789012.dkr.ecr.us-gov-west-1.amazonaws.com", Repository: "app"}
+	commercial := ImageRefInfo{Registry: "123456789012.dkr.ecr.us-west-2.amazonaws.com", Repository: "app"}
+
+	assert.NoError(t, CheckECRPartition(commercial, "", "us-east-1", DEST_CREDS))
+	assert.NoError(t, CheckECRPartition(gov, "", "us-gov-east-1", DEST_CREDS))
+	assert.NoError(t, CheckECRPartition(gov, "gov-secret", "us-east-1", DEST_CREDS))
+	assert.NoError(t, CheckECRPartition(ImageRefInfo{Registry: "docker.io", Repository: "library/nginx"}, "", "us-gov-west-1", SRC_CREDS))
+	assert.EqualError(t, CheckECRPartition(gov, "", "us-east-1", DEST_CREDS),
+		"123456789012.dkr.ecr.us-gov-west-1.amazonaws.com is in the aws-us-gov partition but this function runs in aws, "+
+			"and ECR auto login doesn't span partitions: set DestCreds, e.g. to AWS credentials for aws-us-gov")
+	assert.Error(t, CheckECRPartition(commercial, "", "cn-north-1", SRC_CREDS))
+}
+
+func TestWaitForScanOnPush(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "app"}
+
+	client := &fakeECRClient{scanOnPushDescribes: 2}
+	assert.NoError(t, WaitForScanOnPush(context.TODO(), client, repo, time.Second, time.Millisecond))
+	assert.Equal(t, 3, client.describes)
+
+	client = &fakeECRClient{scanOnPushDescribes: 100}
+	err := WaitForScanOnPush(context.TODO(), client, repo, 0, time.Millisecond)
+	assert.EqualError(t, err, "destination repository app does not have scan on push enabled after waiting 0s")
+	assert.Equal(t, 1, client.describes)
+}
+
+func TestCheckTagImmutability(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "app"}
+
+	client := &fakeECRClient{tagMutability: ecrtypes.ImageTagMutabilityImmutable}
+	assert.NoError(t, CheckTagImmutability(context.TODO(), client, repo))
+
+	client = &fakeECRClient{tagMutability: ecrtypes.ImageTagMutabilityMutable}
+	err := CheckTagImmutability(context.TODO(), client, repo)
+	assert.EqualError(t, err, "destination repository app has image tag mutability MUTABLE, expected IMMUTABLE")
+
+	client = &fakeECRClient{missingDescribes: 1}
+	err = CheckTagImmutability(context.TODO(), client, repo)
+	assert.Contains(t, err.Error(), "describing destination repository app failed: ")
+}
+
+type fakePruneClient struct {
+	fakeDescribeImagesClient
+	deletes [][]string
+}
+
+func (c *fakePruneClient) BatchDeleteImage(ctx context.Context, params *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+	var tags []string
+	out := &ecr.BatchDeleteImageOutput{}
+	for _, id := range params.ImageIds {
+		id := id
+		tags = append(tags, aws.ToString(id.ImageTag))
+		if aws.ToString(id.ImageTag) == "locked" {
+			out.Failures = append(out.Failures, ecrtypes.ImageFailure{ImageId: &id, FailureReason: aws.String("denied")})
+		} else {
+			out.ImageIds = append(out.ImageIds, id)
+		}
+	}
+	c.deletes = append(c.deletes, tags)
+	return out, nil
+}
+
+func TestPruneTags(t *testing.T) {
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	client := &fakePruneClient{fakeDescribeImagesClient: fakeDescribeImagesClient{pages: [][]ecrtypes.ImageDetail{{
+		{ImageTags: []string{"latest", "sha-old"}, ImagePushedAt: aws.Time(now.Add(-48 * time.Hour))},
+		{ImageTags: []string{"sha-recent"}, ImagePushedAt: aws.Time(now.Add(-time.Hour))},
+		{ImageTags: []string{"sha-older", "locked"}, ImagePushedAt: aws.Time(now.Add(-72 * time.Hour))},
+	}}}}
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "app"}
+
+	pruned, err := PruneTags(context.TODO(), client, repo, "latest", now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sha-old", "sha-older"}, pruned)
+	assert.Equal(t, [][]string{{"locked", "sha-old", "sha-older"}}, client.deletes)
+}
+
+func TestCheckECRLimits(t *testing.T) {
+	const layer = `{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":%d,"digest":"sha256:%064d"}`
+	m := func(sizes ...int64) []byte {
+		layers := make([]string, 0, len(sizes))
+		for i, size := range sizes {
+			layers = append(layers, fmt.Sprintf(layer, size, i))
+		}
+		return []byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+			`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":"sha256:` + strings.Repeat("a", 64) + `"},` +
+			`"layers":[` + strings.Join(layers, ",") + `]}`)
+	}
+
+	assert.NoError(t, CheckECRLimits(m(10, 20), defaultECRLimits))
+	assert.EqualError(t, CheckECRLimits(m(10, 20, 30), ECRLimits{MaxLayers: 2}),
+		"source image has 3 layers, exceeds the ECR max of 2 layers per image")
+	assert.EqualError(t, CheckECRLimits(m(10, 200), ECRLimits{MaxLayerSize: 100}),
+		"source layer sha256:"+fmt.Sprintf("%064d", 1)+" is 200 bytes, exceeds the ECR max layer size of 100 bytes")
+	assert.Contains(t, CheckECRLimits(m(10), ECRLimits{MaxManifestBytes: 100}).Error(), "exceeds the ECR max manifest size of 100 bytes")
+	assert.NoError(t, CheckECRLimits(m(10, 20, 30), ECRLimits{}))
+
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	assert.NoError(t, CheckECRLimits(index, ECRLimits{MaxLayers: 1}))
+}
+
+func TestEnsureReplication(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-east-1", Name: "team/app"}
+	unrelated := ecrtypes.ReplicationRule{
+		Destinations:      []ecrtypes.ReplicationDestination{{Region: aws.String("eu-west-1"), RegistryId: aws.String("123456789012")}},
+		RepositoryFilters: []ecrtypes.RepositoryFilter{{Filter: aws.String("other/"), FilterType: ecrtypes.RepositoryFilterTypePrefixMatch}},
+	}
+	covering := ecrtypes.ReplicationRule{
+		Destinations:      []ecrtypes.ReplicationDestination{{Region: aws.String("us-west-2"), RegistryId: aws.String("123456789012")}},
+		RepositoryFilters: []ecrtypes.RepositoryFilter{{Filter: aws.String("team/"), FilterType: ecrtypes.RepositoryFilterTypePrefixMatch}},
+	}
+	client := &fakeECRClient{
+		registryID:   "123456789012",
+		replication:  &ecrtypes.ReplicationConfiguration{Rules: []ecrtypes.ReplicationRule{unrelated, covering}},
+		repositories: []string{"team/app", "team/other", "other/app"},
+	}
+
+	added, err := EnsureReplication(context.Background(), client, repo, []string{"us-west-2", "eu-west-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eu-west-1"}, added)
+	require.Len(t, client.replication.Rules, 3)
+	assert.Equal(t, unrelated, client.replication.Rules[0])
+	assert.Equal(t, covering, client.replication.Rules[1])
+	assert.Equal(t, "eu-west-1", aws.ToString(client.replication.Rules[2].Destinations[0].Region))
+	assert.Equal(t, "team/app", aws.ToString(client.replication.Rules[2].RepositoryFilters[0].Filter))
+
+	// Once covered, nothing is written again.
+	added, err = EnsureReplication(context.Background(), client, repo, []string{"us-west-2", "eu-west-1"})
+	require.NoError(t, err)
+	assert.Empty(t, added)
+	assert.Equal(t, 1, client.replicationPuts)
+
+	// Further regions go to the rule of the repository.
+	added, err = EnsureReplication(context.Background(), client, repo, []string{"ap-south-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ap-south-1"}, added)
+	require.Len(t, client.replication.Rules, 3)
+	assert.Len(t, client.replication.Rules[2].Destinations, 2)
+
+	_, err = EnsureReplication(context.Background(), client, repo, []string{"us-east-1"})
+	assert.EqualError(t, err, "can't replicate team/app to its own region us-east-1")
+	_, err = EnsureReplication(context.Background(), &fakeECRClient{registryID: "210987654321"}, repo, []string{"us-west-2"})
+	assert.Error(t, err)
+}
+
+func TestEnsureReplicationOverMatch(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-east-1", Name: "team/app"}
+	client := &fakeECRClient{registryID: "123456789012", repositories: []string{"team/app", "team/app-cache", "team/apple"}}
+	_, err := EnsureReplication(context.Background(), client, repo, []string{"us-west-2"})
+	assert.EqualError(t, err, "a replication rule for team/app would also replicate team/app-cache, team/apple, ECR only filters replication by repository name prefix; configure their replication yourself")
+	assert.Equal(t, 0, client.replicationPuts)
+}
+
+func TestEnsureReplicationLimits(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-east-1", Name: "team/app"}
+	var rules []ecrtypes.ReplicationRule
+	for i := 0; i < ecrMaxReplicationRules; i++ {
+		rules = append(rules, ecrtypes.ReplicationRule{
+			Destinations:      []ecrtypes.ReplicationDestination{{Region: aws.String("eu-west-1"), RegistryId: aws.String("123456789012")}},
+			RepositoryFilters: []ecrtypes.RepositoryFilter{{Filter: aws.String(fmt.Sprintf("other%d/", i)), FilterType: ecrtypes.RepositoryFilterTypePrefixMatch}},
+		})
+	}
+	client := &fakeECRClient{registryID: "123456789012", replication: &ecrtypes.ReplicationConfiguration{Rules: rules}}
+	_, err := EnsureReplication(context.Background(), client, repo, []string{"us-west-2"})
+	assert.EqualError(t, err, "can't add a replication rule for team/app, the registry already has the ECR max of 10 rules; add its regions to an existing rule instead")
+	assert.Equal(t, 0, client.replicationPuts)
+
+	var destinations []ecrtypes.ReplicationDestination
+	for i := 0; i < ecrMaxReplicationDestinations; i++ {
+		destinations = append(destinations, ecrtypes.ReplicationDestination{Region: aws.String("eu-west-1"), RegistryId: aws.String(fmt.Sprintf("%012d", i))})
+	}
+	client.replication = &ecrtypes.ReplicationConfiguration{Rules: []ecrtypes.ReplicationRule{{
+		Destinations:      destinations,
+		RepositoryFilters: []ecrtypes.RepositoryFilter{{Filter: aws.String("other/"), FilterType: ecrtypes.RepositoryFilterTypePrefixMatch}},
+	}}}
+	_, err = EnsureReplication(context.Background(), client, repo, []string{"us-west-2"})
+	assert.EqualError(t, err, "can't replicate team/app, the replication configuration would have 26 destinations, more than the ECR max of 25")
+}
+
+// replacingECRClient has another writer replace the replication
+// configuration right after each of the first replaced writes.
+type replacingECRClient struct {
+	*fakeECRClient
+	replaced int
+	other    *ecrtypes.ReplicationConfiguration
+}
+
+func (c *replacingECRClient) PutReplicationConfiguration(ctx context.Context, params *ecr.PutReplicationConfigurationInput, optFns ...func(*ecr.Options)) (*ecr.PutReplicationConfigurationOutput, error) {
+	out, err := c.fakeECRClient.PutReplicationConfiguration(ctx, params, optFns...)
+	if c.replaced > 0 {
+		c.replaced--
+		c.replication = c.other
+	}
+	return out, err
+}
+
+func TestEnsureReplicationConcurrentChange(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-east-1", Name: "team/app"}
+	other := &ecrtypes.ReplicationConfiguration{Rules: []ecrtypes.ReplicationRule{{
+		Destinations:      []ecrtypes.ReplicationDestination{{Region: aws.String("eu-west-1"), RegistryId: aws.String("123456789012")}},
+		RepositoryFilters: []ecrtypes.RepositoryFilter{{Filter: aws.String("other/"), FilterType: ecrtypes.RepositoryFilterTypePrefixMatch}},
+	}}}
+	client := &replacingECRClient{fakeECRClient: &fakeECRClient{registryID: "123456789012"}, replaced: 1, other: other}
+	added, err := EnsureReplication(context.Background(), client, repo, []string{"us-west-2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"us-west-2"}, added)
+	assert.Equal(t, 2, client.replicationPuts)
+	// The rule of the other writer is kept.
+	require.Len(t, client.replication.Rules, 2)
+	assert.Equal(t, other.Rules[0], client.replication.Rules[0])
+
+	client = &replacingECRClient{fakeECRClient: &fakeECRClient{registryID: "123456789012"}, replaced: replicationAttempts, other: other}
+	_, err = EnsureReplication(context.Background(), client, repo, []string{"us-west-2"})
+	assert.EqualError(t, err, "replication of team/app to us-west-2 was replaced by another change of the replication configuration 3 times")
+}
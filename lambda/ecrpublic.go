@@ -0,0 +1,150 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	ecrpublictypes "github.com/aws/aws-sdk-go-v2/service/ecrpublic/types"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+)
+
+const (
+	ecrPublicHost = "public.ecr.aws"
+	// ECR Public's API is only served in us-east-1.
+	ecrPublicRegion = "us-east-1"
+)
+
+// publicAliasRe matches ECR Public registry aliases: 2 to 50 lowercase
+// letters, numbers and hyphens.
+var publicAliasRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,49}$`)
+
+// WithPublicRegistryAlias returns ref, a docker reference to ECR Public,
+// with its repository under alias, e.g. public.ecr.aws/app:1 becomes
+// public.ecr.aws/<alias>/app:1. A ref already under alias is returned as is.
+func WithPublicRegistryAlias(ref types.ImageReference, alias string) (types.ImageReference, error) {
+	if !publicAliasRe.MatchString(alias) {
+		return nil, fmt.Errorf("invalid registry alias %q, expected 2 to 50 lowercase letters, numbers and hyphens", alias)
+	}
+	if ref.Transport().Name() != docker.Transport.Name() || reference.Domain(ref.DockerReference()) != ecrPublicHost {
+		return nil, fmt.Errorf("requires a docker://%s DestImage", ecrPublicHost)
+	}
+	path := reference.Path(ref.DockerReference())
+	if strings.HasPrefix(path, alias+"/") {
+		return ref, nil
+	}
+	return withRepositoryPath(ref, alias+"/"+path)
+}
+
+// PublicRepositoryName returns the name the ECR Public API knows the
+// repository of info by, which doesn't include the registry alias.
+func PublicRepositoryName(info ImageRefInfo, alias string) string {
+	return strings.TrimPrefix(info.Repository, alias+"/")
+}
+
+// GetECRPublicLogin returns registry credentials for pushing to ECR Public.
+func GetECRPublicLogin(ctx context.Context) (ECRAuth, error) {
+	client, err := NewECRPublicClient(ctx)
+	if err != nil {
+		return ECRAuth{}, err
+	}
+	resp, err := client.GetAuthorizationToken(ctx, &ecrpublic.GetAuthorizationTokenInput{})
+	if err != nil {
+		return ECRAuth{}, fmt.Errorf("error login into ECR Public: %v", err.Error())
+	}
+	if resp.AuthorizationData == nil || resp.AuthorizationData.AuthorizationToken == nil {
+		return ECRAuth{}, errors.New("empty ECR Public login auth token")
+	}
+	data, err := base64.StdEncoding.DecodeString(*resp.AuthorizationData.AuthorizationToken)
+	if err != nil {
+		return ECRAuth{}, err
+	}
+	token := strings.SplitN(string(data), ":", 2)
+	if len(token) != 2 {
+		return ECRAuth{}, errors.New("malformed ECR Public login auth token")
+	}
+	return ECRAuth{
+		Token:         *resp.AuthorizationData.AuthorizationToken,
+		User:          token[0],
+		Pass:          token[1],
+		ProxyEndpoint: ecrPublicHost,
+		ExpiresAt:     aws.ToTime(resp.AuthorizationData.ExpiresAt),
+	}, nil
+}
+
+func NewECRPublicClient(ctx context.Context) (*ecrpublic.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(ecrPublicRegion))
+	if err != nil {
+		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	return ecrpublic.NewFromConfig(cfg), nil
+}
+
+type ecrPublicCreateRepositoryAPIClient interface {
+	CreateRepository(ctx context.Context, params *ecrpublic.CreateRepositoryInput, optFns ...func(*ecrpublic.Options)) (*ecrpublic.CreateRepositoryOutput, error)
+}
+
+// EnsurePublicRepository creates the ECR Public repository name with the
+// given catalog data. created is false if it already existed, in which case
+// its catalog data is left as it is.
+func EnsurePublicRepository(ctx context.Context, client ecrPublicCreateRepositoryAPIClient, name string, catalog *ecrpublictypes.RepositoryCatalogDataInput) (created bool, err error) {
+	_, err = client.CreateRepository(ctx, &ecrpublic.CreateRepositoryInput{
+		RepositoryName: aws.String(name),
+		CatalogData:    catalog,
+	})
+	var exists *ecrpublictypes.RepositoryAlreadyExistsException
+	if errors.As(err, &exists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("creating public repository %s failed: %v", name, err)
+	}
+	return true, nil
+}
+
+// ParsePublicCatalogData returns the catalog data of a PublicRepositoryCatalogData
+// property. Architectures and operatingSystems are comma separated.
+func ParsePublicCatalogData(m map[string]string) (*ecrpublictypes.RepositoryCatalogDataInput, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	catalog := &ecrpublictypes.RepositoryCatalogDataInput{}
+	for k, v := range m {
+		switch k {
+		case "description":
+			catalog.Description = aws.String(v)
+		case "aboutText":
+			catalog.AboutText = aws.String(v)
+		case "usageText":
+			catalog.UsageText = aws.String(v)
+		case "architectures":
+			catalog.Architectures = splitList(v)
+		case "operatingSystems":
+			catalog.OperatingSystems = splitList(v)
+		default:
+			return nil, fmt.Errorf("unknown catalog data field %q, expected description, aboutText, usageText, architectures or operatingSystems", k)
+		}
+	}
+	return catalog, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,73 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	ecrpublictypes "github.com/aws/aws-sdk-go-v2/service/ecrpublic/types"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeECRPublicClient struct {
+	repos map[string]*ecrpublictypes.RepositoryCatalogDataInput
+}
+
+func (c *fakeECRPublicClient) CreateRepository(ctx context.Context, params *ecrpublic.CreateRepositoryInput, optFns ...func(*ecrpublic.Options)) (*ecrpublic.CreateRepositoryOutput, error) {
+	name := aws.ToString(params.RepositoryName)
+	if _, ok := c.repos[name]; ok {
+		return nil, &ecrpublictypes.RepositoryAlreadyExistsException{Message: aws.String("repository already exists")}
+	}
+	c.repos[name] = params.CatalogData
+	return &ecrpublic.CreateRepositoryOutput{}, nil
+}
+
+func TestWithPublicRegistryAlias(t *testing.T) {
+	for _, tc := range []struct{ dest, alias, expected string }{
+		{"docker://public.ecr.aws/app:1", "my-alias", "docker://public.ecr.aws/my-alias/app:1"},
+		{"docker://public.ecr.aws/team/app:1", "my-alias", "docker://public.ecr.aws/my-alias/team/app:1"},
+		{"docker://public.ecr.aws/my-alias/app:1", "my-alias", "docker://public.ecr.aws/my-alias/app:1"},
+	} {
+		ref, err := alltransports.ParseImageName(tc.dest)
+		assert.NoError(t, err)
+		ref, err = WithPublicRegistryAlias(ref, tc.alias)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, transports.ImageName(ref))
+	}
+
+	ref, err := alltransports.ParseImageName("docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/app:1")
+	assert.NoError(t, err)
+	_, err = WithPublicRegistryAlias(ref, "my-alias")
+	assert.Error(t, err)
+
+	ref, err = alltransports.ParseImageName("docker://public.ecr.aws/app:1")
+	assert.NoError(t, err)
+	_, err = WithPublicRegistryAlias(ref, "My_Alias")
+	assert.Error(t, err)
+}
+
+func TestEnsurePublicRepository(t *testing.T) {
+	client := &fakeECRPublicClient{repos: map[string]*ecrpublictypes.RepositoryCatalogDataInput{}}
+	catalog, err := ParsePublicCatalogData(map[string]string{"description": "My app", "architectures": "x86-64, ARM 64"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x86-64", "ARM 64"}, catalog.Architectures)
+
+	created, err := EnsurePublicRepository(context.TODO(), client, "app", catalog)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "My app", aws.ToString(client.repos["app"].Description))
+
+	created, err = EnsurePublicRepository(context.TODO(), client, "app", nil)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "My app", aws.ToString(client.repos["app"].Description))
+
+	_, err = ParsePublicCatalogData(map[string]string{"logo": "x"})
+	assert.Error(t, err)
+}
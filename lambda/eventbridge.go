@@ -0,0 +1,134 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/containers/image/v5/transports/alltransports"
+)
+
+const (
+	// EnvInvoker set to EVENTBRIDGE makes every event an ECR push event,
+	// and set to VALIDATE only validates the properties of every event.
+	// Otherwise events with a detail-type are taken for EventBridge events
+	// and the rest for CloudFormation requests.
+	EnvInvoker         = "INVOKER"
+	invokerEventBridge = "EVENTBRIDGE"
+
+	// EnvDestImageTemplate is the DestImageTemplate of ECR push events,
+	// which have no resource properties to carry one.
+	EnvDestImageTemplate = "DEST_IMAGE_TEMPLATE"
+
+	ecrEventSource     = "aws.ecr"
+	ecrImageActionType = "ECR Image Action"
+)
+
+// ECRImageAction is the detail of an "ECR Image Action" EventBridge event.
+type ECRImageAction struct {
+	ActionType     string `json:"action-type"`
+	Result         string `json:"result"`
+	RepositoryName string `json:"repository-name"`
+	ImageDigest    string `json:"image-digest"`
+	ImageTag       string `json:"image-tag"`
+}
+
+// ECRPushEventImages returns the pushed image of event as SrcImage, pinned
+// to its digest, and the DestImage tmpl expands to for it. ok is false for
+// events other than successful pushes, which aren't mirrored.
+//
+// Besides {region}, {accountId} and {dnsSuffix} of the event, tmpl can use
+// {repositoryName}, {tag} and {digest} of the pushed image.
+func ECRPushEventImages(event events.CloudWatchEvent, tmpl string) (srcImage, destImage string, ok bool, err error) {
+	if event.Source != ecrEventSource || event.DetailType != ecrImageActionType {
+		return "", "", false, fmt.Errorf("unsupported event %q from %q, expected %q from %q", event.DetailType, event.Source, ecrImageActionType, ecrEventSource)
+	}
+	var detail ECRImageAction
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		return "", "", false, fmt.Errorf("invalid %s detail: %v", ecrImageActionType, err)
+	}
+	if detail.ActionType != "PUSH" || detail.Result != "SUCCESS" {
+		return "", "", false, nil
+	}
+	if detail.RepositoryName == "" || detail.ImageDigest == "" {
+		return "", "", false, fmt.Errorf("%s has no repository-name or image-digest", ecrImageActionType)
+	}
+	if tmpl == "" {
+		return "", "", false, fmt.Errorf("%s is required for %s events", EnvDestImageTemplate, ecrImageActionType)
+	}
+
+	srcImage = fmt.Sprintf("docker://%s/%s@%s", ECRRegistryHost(event.AccountID, event.Region), detail.RepositoryName, detail.ImageDigest)
+	destImage, err = ExpandTemplate(tmpl, map[string]string{
+		"region":         event.Region,
+		"accountId":      event.AccountID,
+		"dnsSuffix":      awsDNSSuffix(event.Region),
+		"repositoryName": detail.RepositoryName,
+		"tag":            detail.ImageTag,
+		"digest":         detail.ImageDigest,
+	})
+	if err != nil {
+		return "", "", false, err
+	}
+	if _, err := alltransports.ParseImageName(destImage); err != nil {
+		return "", "", false, fmt.Errorf("invalid %v %q: %v", EnvDestImageTemplate, destImage, err.Error())
+	}
+	return srcImage, destImage, true, nil
+}
+
+// handleECRPushEvent mirrors the image pushed in an ECR push event.
+func handleECRPushEvent(ctx context.Context, event events.CloudWatchEvent) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	srcImage, destImage, ok, err := ECRPushEventImages(event, os.Getenv(EnvDestImageTemplate))
+	if err != nil {
+		return data, err
+	}
+	if !ok {
+		log.Printf("Ignoring %s event %s", ecrImageActionType, event.ID)
+		data["Result"] = "skipped: not a successful push"
+		return data, nil
+	}
+	props := map[string]interface{}{
+		SRC_IMAGE:  srcImage,
+		DEST_IMAGE: destImage,
+	}
+	err = recordCopy(ctx, copyRequest{RequestID: event.ID}, props, data, func(ctx context.Context) error {
+		budgetCtx, cancel := withBudget(ctx, totalBudget)
+		defer cancel()
+		return budgetError(budgetCtx, handleImages(budgetCtx, props, data))
+	})
+	return data, err
+}
+
+// dispatch routes an invocation to the validation, the EventBridge or the
+// CloudFormation handler.
+func dispatch(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var probe struct {
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(os.Getenv(EnvInvoker), invokerValidate) {
+		return handleValidate(raw)
+	}
+	if strings.EqualFold(os.Getenv(EnvInvoker), invokerEventBridge) || probe.DetailType != "" {
+		var event events.CloudWatchEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return handleECRPushEvent(ctx, event)
+	}
+	var event cfn.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+	return cfn.LambdaWrap(handler)(ctx, event)
+}
@@ -0,0 +1,78 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// samplePushEvent is an ECR push event as delivered by EventBridge.
+const samplePushEvent = `{
+  "version": "0",
+  "id": "13cde686-328b-6117-af20-0e5566167482",
+  "detail-type": "ECR Image Action",
+  "source": "aws.ecr",
+  "account": "123456789012",
+  "time": "2019-11-16T01:54:34Z",
+  "region": "us-west-2",
+  "resources": [],
+  "detail": {
+    "result": "SUCCESS",
+    "repository-name": "team/app",
+    "image-digest": "sha256:7f5b2640fe6fb4f46592dfd3410c4a79dac4f89e4782432e0378abcd1234abcd",
+    "action-type": "PUSH",
+    "image-tag": "1.2.3"
+  }
+}`
+
+func TestECRPushEventImages(t *testing.T) {
+	var event events.CloudWatchEvent
+	require.NoError(t, json.Unmarshal([]byte(samplePushEvent), &event))
+
+	src, dest, ok, err := ECRPushEventImages(event, "docker://{accountId}.dkr.ecr.eu-west-1.amazonaws.com/mirror/{repositoryName}:{tag}")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/team/app@sha256:7f5b2640fe6fb4f46592dfd3410c4a79dac4f89e4782432e0378abcd1234abcd", src)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.eu-west-1.amazonaws.com/mirror/team/app:1.2.3", dest)
+
+	cn := event
+	cn.Region = "cn-north-1"
+	src, dest, _, err = ECRPushEventImages(cn, "docker://{accountId}.dkr.ecr.cn-northwest-1.{dnsSuffix}/mirror/{repositoryName}:{tag}")
+	require.NoError(t, err)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/team/app@sha256:7f5b2640fe6fb4f46592dfd3410c4a79dac4f89e4782432e0378abcd1234abcd", src)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.cn-northwest-1.amazonaws.com.cn/mirror/team/app:1.2.3", dest)
+
+	_, _, _, err = ECRPushEventImages(event, "")
+	assert.Error(t, err)
+	_, _, _, err = ECRPushEventImages(event, "docker://registry/{image}")
+	assert.Error(t, err)
+
+	event.Detail = json.RawMessage(`{"result": "FAILURE", "action-type": "PUSH", "repository-name": "team/app"}`)
+	_, _, ok, err = ECRPushEventImages(event, "docker://registry/{repositoryName}")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	event.DetailType = "ECR Image Scan"
+	_, _, _, err = ECRPushEventImages(event, "docker://registry/{repositoryName}")
+	assert.Error(t, err)
+}
+
+func TestDispatchECRPushEvent(t *testing.T) {
+	t.Setenv(EnvDestImageTemplate, "docker://registry.example.com/{repositoryName}:{tag}")
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(samplePushEvent), &event))
+	event["detail"].(map[string]interface{})["action-type"] = "DELETE"
+	raw, err := json.Marshal(event)
+	require.NoError(t, err)
+
+	out, err := dispatch(context.Background(), raw)
+	require.NoError(t, err)
+	assert.Equal(t, "skipped: not a successful push", out.(map[string]interface{})["Result"])
+}
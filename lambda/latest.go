@@ -0,0 +1,299 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+)
+
+const (
+	// latestTagsSemver orders tags by semantic version. Tags that aren't
+	// versions are left out.
+	latestTagsSemver = "semver"
+	// latestTagsPushedAt orders tags by when they were pushed to ECR.
+	latestTagsPushedAt = "pushedAt"
+)
+
+// parseVersion parses tag as a version, like v1, 1.25 or 1.25.3-rc.1+build.
+// Missing minor and patch numbers count as 0.
+func parseVersion(tag string) (*semver.Version, bool) {
+	v, err := semver.NewVersion(tag)
+	return v, err == nil
+}
+
+// ParseSemverConstraint parses constraints like ">=1.20.0 <2.0.0", "^1.20"
+// or "~1.20.3". The comparators of an alternative are separated by spaces
+// or commas, and alternatives by ||.
+func ParseSemverConstraint(s string) (*semver.Constraints, error) {
+	c, err := semver.NewConstraint(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid semver constraint %q: %v", s, err)
+	}
+	return c, nil
+}
+
+// SemverMatchingTags returns the tags whose versions match c, and the tags
+// that aren't versions. Prereleases only match a constraint naming a
+// prerelease, so ">=1.20.0 <2.0.0" doesn't match 2.0.0-rc.1.
+func SemverMatchingTags(tags []string, c *semver.Constraints) (matching, unversioned []string) {
+	for _, tag := range tags {
+		v, ok := parseVersion(tag)
+		if !ok {
+			unversioned = append(unversioned, tag)
+		} else if c.Check(v) {
+			matching = append(matching, tag)
+		}
+	}
+	return matching, unversioned
+}
+
+// LatestSemverTags returns the n tags with the highest versions, newest
+// first. Equal versions, e.g. 1.25 and 1.25.0, are ordered by name.
+func LatestSemverTags(tags []string, n int) []string {
+	versions := make(map[string]*semver.Version)
+	var versioned []string
+	for _, tag := range tags {
+		if v, ok := parseVersion(tag); ok {
+			versions[tag] = v
+			versioned = append(versioned, tag)
+		}
+	}
+	sort.SliceStable(versioned, func(i, j int) bool {
+		if c := versions[versioned[i]].Compare(versions[versioned[j]]); c != 0 {
+			return c > 0
+		}
+		return versioned[i] < versioned[j]
+	})
+	if len(versioned) > n {
+		versioned = versioned[:n]
+	}
+	return versioned
+}
+
+// LatestPushedTags returns the n most recently pushed of the tags in
+// pushedAt, newest first. Tags of the same image, pushed at the same time,
+// are ordered by name.
+func LatestPushedTags(pushedAt map[string]time.Time, n int) []string {
+	tags := make([]string, 0, len(pushedAt))
+	for tag := range pushedAt {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		a, b := pushedAt[tags[i]], pushedAt[tags[j]]
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return tags[i] < tags[j]
+	})
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+	return tags
+}
+
+// GetECRTagsPushedAt returns when each tag in repo was pushed.
+func GetECRTagsPushedAt(ctx context.Context, client ecr.DescribeImagesAPIClient, repo ECRRepository) (map[string]time.Time, error) {
+	pushedAt := make(map[string]time.Time)
+	paginator := ecr.NewDescribeImagesPaginator(client, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(repo.RegistryID),
+		RepositoryName: aws.String(repo.Name),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing images of %s failed: %v", repo.Name, err)
+		}
+		for _, image := range page.ImageDetails {
+			for _, tag := range image.ImageTags {
+				pushedAt[tag] = aws.ToTime(image.ImagePushedAt)
+			}
+		}
+	}
+	return pushedAt, nil
+}
+
+// handleLatestTags copies the newest n tags of the SrcImage repository to
+// the same tags in the DestImage repository. The tags of SrcImage and
+// DestImage themselves are ignored. With a SemverConstraint, only the tags
+// matching it are copied, all of them if n is 0.
+//
+// LatestTagsOrder picks what newest means: pushedAt, the default for ECR
+// sources, or semver, the default otherwise. The result of each tag is
+// recorded in data[TAG_RESULTS]; a failing tag doesn't stop the others.
+func handleLatestTags(ctx context.Context, props map[string]interface{}, n int, data map[string]interface{}) error {
+	srcImage, err := getStrProps(props, SRC_IMAGE)
+	if err != nil {
+		return err
+	}
+	destImage, err := getStrProps(props, DEST_IMAGE)
+	if err != nil {
+		return err
+	}
+	srcRef, err := alltransports.ParseImageName(srcImage)
+	if err != nil {
+		return err
+	}
+	destRef, err := alltransports.ParseImageName(destImage)
+	if err != nil {
+		return err
+	}
+	srcInfo := GetImageRefInfo(srcRef)
+	repo, isECR := GetECRRepository(srcInfo)
+
+	defaultOrder := latestTagsSemver
+	if isECR {
+		defaultOrder = latestTagsPushedAt
+	}
+	order, err := getStrPropsDefault(props, LATEST_TAGS_ORDER, defaultOrder)
+	if err != nil {
+		return err
+	}
+
+	constraintProp, err := getStrPropsDefault(props, SEMVER_CONSTRAINT, "")
+	if err != nil {
+		return err
+	}
+	var constraint *semver.Constraints
+	if constraintProp != "" {
+		if constraint, err = ParseSemverConstraint(constraintProp); err != nil {
+			return fmt.Errorf("%v: %v", SEMVER_CONSTRAINT, err)
+		}
+	}
+	// filter applies the constraint to the tags and returns how many of
+	// them to copy.
+	filter := func(all []string) ([]string, int) {
+		if constraint == nil {
+			return all, n
+		}
+		matching, unversioned := SemverMatchingTags(all, constraint)
+		if len(unversioned) > 0 {
+			log.Printf("Skipping %d tags that aren't versions: %v", len(unversioned), strings.Join(unversioned, ", "))
+		}
+		if n <= 0 {
+			return matching, len(matching)
+		}
+		return matching, n
+	}
+
+	var tags []string
+	switch order {
+	case latestTagsPushedAt:
+		if !isECR {
+			return fmt.Errorf("%v %v requires an ECR source", LATEST_TAGS_ORDER, latestTagsPushedAt)
+		}
+		client, err := NewECRClient(ctx, repo.Region)
+		if err != nil {
+			return err
+		}
+		pushedAt, err := GetECRTagsPushedAt(ctx, client, repo)
+		if err != nil {
+			return err
+		}
+		all := make([]string, 0, len(pushedAt))
+		for tag := range pushedAt {
+			all = append(all, tag)
+		}
+		matching, limit := filter(all)
+		filtered := make(map[string]time.Time, len(matching))
+		for _, tag := range matching {
+			filtered[tag] = pushedAt[tag]
+		}
+		tags = LatestPushedTags(filtered, limit)
+	case latestTagsSemver:
+		registryCreds, err := getStrMapPropsDefault(props, REGISTRY_CREDENTIALS)
+		if err != nil {
+			return err
+		}
+		srcCreds, err := getStrPropsDefault(props, SRC_CREDS, "")
+		if err != nil {
+			return err
+		}
+		srcCreds, err = parseCreds(ResolveRegistryCreds(registryCreds, srcInfo.Registry, srcCreds))
+		if err != nil {
+			return err
+		}
+		srcOpts := NewImageOpts(srcImage)
+		srcOpts.SetCreds(srcCreds)
+		defer srcOpts.Close()
+		srcCtx, err := srcOpts.NewSystemContext()
+		if err != nil {
+			return err
+		}
+		all, _, err := ListTags(ctx, srcCtx, srcRef, 0)
+		if err != nil {
+			return fmt.Errorf("listing source tags failed: %s", err.Error())
+		}
+		tags = LatestSemverTags(filter(all))
+	default:
+		return fmt.Errorf("invalid %v %q, expected %v or %v", LATEST_TAGS_ORDER, order, latestTagsSemver, latestTagsPushedAt)
+	}
+	if constraint != nil {
+		log.Printf("Copying %d tags of %v matching %q by %v: %v", len(tags), srcImage, constraintProp, order, strings.Join(tags, ", "))
+	} else {
+		log.Printf("Copying the latest %d tags of %v by %v: %v", len(tags), srcImage, order, strings.Join(tags, ", "))
+	}
+
+	results := make(map[string]string, len(tags))
+	var failed []string
+	for _, tag := range tags {
+		tagProps, err := latestTagProps(props, srcRef, destRef, tag)
+		if err != nil {
+			return err
+		}
+		tagData := make(map[string]interface{})
+		if err := handleImages(ctx, tagProps, tagData); err != nil {
+			log.Printf("Copying tag %v failed: %v", tag, err)
+			results[tag] = "failed: " + err.Error()
+			failed = append(failed, fmt.Sprintf("%v: %v", tag, err))
+			continue
+		}
+		results[tag] = fmt.Sprint(tagData["Result"])
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	data[TAG_RESULTS] = string(b)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("copy failed for %d of %d tags: %s", len(failed), len(tags), strings.Join(failed, "; "))
+	}
+	data["Result"] = "copied"
+	return nil
+}
+
+// latestTagProps returns the props copying tag of the source repository to
+// tag of the destination repository.
+func latestTagProps(props map[string]interface{}, srcRef, destRef types.ImageReference, tag string) (map[string]interface{}, error) {
+	src, err := WithTag(srcRef, tag)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := WithTag(destRef, tag)
+	if err != nil {
+		return nil, err
+	}
+	tagProps := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		tagProps[k] = v
+	}
+	delete(tagProps, LATEST_N_TAGS)
+	delete(tagProps, SEMVER_CONSTRAINT)
+	tagProps[SRC_IMAGE] = transports.ImageName(src)
+	tagProps[DEST_IMAGE] = transports.ImageName(dest)
+	return tagProps, nil
+}
@@ -0,0 +1,102 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDescribeImagesClient struct {
+	pages [][]ecrtypes.ImageDetail
+}
+
+func (c *fakeDescribeImagesClient) DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	page := 0
+	if params.NextToken != nil {
+		page = 1
+	}
+	out := &ecr.DescribeImagesOutput{ImageDetails: c.pages[page]}
+	if page+1 < len(c.pages) {
+		out.NextToken = aws.String("next")
+	}
+	return out, nil
+}
+
+func TestLatestSemverTags(t *testing.T) {
+	tags := []string{"latest", "1.9.0", "1.10.0-rc.1", "v1.10.0", "1.10", "1.2", "stable", "2"}
+	assert.Equal(t, []string{"2", "1.10", "v1.10.0"}, LatestSemverTags(tags, 3))
+	assert.Equal(t, []string{"2", "1.10", "v1.10.0", "1.10.0-rc.1", "1.9.0", "1.2"}, LatestSemverTags(tags, 10))
+	assert.Empty(t, LatestSemverTags([]string{"latest", "stable"}, 2))
+	assert.Equal(t, []string{"2.0.0", "2.0.0-rc.10", "2.0.0-rc.9"}, LatestSemverTags([]string{"2.0.0-rc.9", "2.0.0", "2.0.0-rc.10"}, 3))
+}
+
+func TestSemverConstraint(t *testing.T) {
+	tags := []string{"latest", "1.19.9", "1.20.0", "v1.20.3", "1.21", "2.0.0-rc.1", "2.0.0", "3.1.0-beta", "stable"}
+	for constraint, want := range map[string][]string{
+		">=1.20.0 <2.0.0":      {"1.20.0", "v1.20.3", "1.21"},
+		">= 1.20, < 2":         {"1.20.0", "v1.20.3", "1.21"},
+		"1.20.3":               {"v1.20.3"},
+		"<1.20 || >=2":         {"1.19.9", "2.0.0"},
+		">=2.0.0-rc.1":         {"2.0.0-rc.1", "2.0.0", "3.1.0-beta"},
+		">1.20.0 !=1.21 <=2.0": {"v1.20.3", "2.0.0"},
+		"^1.20":                {"1.20.0", "v1.20.3", "1.21"},
+		"~1.20.0":              {"1.20.0", "v1.20.3"},
+		">=4":                  nil,
+	} {
+		c, err := ParseSemverConstraint(constraint)
+		require.NoError(t, err, constraint)
+		matching, unversioned := SemverMatchingTags(tags, c)
+		assert.Equal(t, want, matching, constraint)
+		assert.Equal(t, []string{"latest", "stable"}, unversioned, constraint)
+	}
+
+	for _, constraint := range []string{"", ">=", "latest", "1.2 || "} {
+		_, err := ParseSemverConstraint(constraint)
+		assert.Error(t, err, constraint)
+	}
+}
+
+func TestGetECRTagsPushedAt(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	client := &fakeDescribeImagesClient{pages: [][]ecrtypes.ImageDetail{
+		{
+			{ImageTags: []string{"a", "latest"}, ImagePushedAt: aws.Time(now)},
+			{ImageTags: []string{"b"}, ImagePushedAt: aws.Time(now.Add(-time.Hour))},
+		},
+		{
+			{ImagePushedAt: aws.Time(now.Add(time.Hour))},
+			{ImageTags: []string{"c"}, ImagePushedAt: aws.Time(now.Add(-2 * time.Hour))},
+		},
+	}}
+	pushedAt, err := GetECRTagsPushedAt(context.TODO(), client, ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "app"})
+	require.NoError(t, err)
+	assert.Len(t, pushedAt, 4)
+	assert.Equal(t, []string{"a", "latest", "b"}, LatestPushedTags(pushedAt, 3))
+}
+
+func TestLatestTagProps(t *testing.T) {
+	srcRef, err := alltransports.ParseImageName("docker://nginx:latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/nginx:latest")
+	require.NoError(t, err)
+	props := map[string]interface{}{SRC_IMAGE: "docker://nginx:latest", DEST_CREDS: "secret", LATEST_N_TAGS: "3"}
+
+	tagProps, err := latestTagProps(props, srcRef, destRef, "1.25")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		SRC_IMAGE:  "docker://nginx:1.25",
+		DEST_IMAGE: "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/nginx:1.25",
+		DEST_CREDS: "secret",
+	}, tagProps)
+	assert.Equal(t, "docker://nginx:latest", props[SRC_IMAGE])
+}
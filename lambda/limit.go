@@ -0,0 +1,222 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+)
+
+const (
+	EnvMaxConcurrentCopies = "MAX_CONCURRENT_COPIES"
+	EnvMaxInflightBytes    = "MAX_INFLIGHT_BYTES"
+)
+
+// copyLimiter bounds the number of copies running at once in a container.
+// A nil copyLimiter doesn't limit anything.
+type copyLimiter struct {
+	slots chan struct{}
+}
+
+var copyLimit *copyLimiter
+
+func newCopyLimiter(n int) *copyLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &copyLimiter{slots: make(chan struct{}, n)}
+}
+
+func parseMaxConcurrentCopies(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", EnvMaxConcurrentCopies, err)
+	}
+	if n <= 0 {
+		return 0, errors.New(EnvMaxConcurrentCopies + " must be positive")
+	}
+	return n, nil
+}
+
+// Acquire waits for a free slot. The request is rejected if ctx is done
+// before one frees up.
+func (l *copyLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	loggerFrom(ctx).Warnf("%d copies are already running, waiting for one to finish", cap(l.slots))
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		loggerFrom(ctx).Warnf("Rejecting copy, no slot became free: %v", ctx.Err())
+		return fmt.Errorf("rejected, %d copies are already running: %v", cap(l.slots), ctx.Err())
+	}
+}
+
+func (l *copyLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// byteLimiter bounds the total size of the blobs being written at once,
+// across the copies of a container. A nil byteLimiter doesn't limit anything.
+type byteLimiter struct {
+	max int64
+
+	mu   sync.Mutex
+	used int64
+	// released is closed and replaced whenever bytes are released.
+	released chan struct{}
+}
+
+var inflightLimit *byteLimiter
+
+func newByteLimiter(max int64) *byteLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &byteLimiter{max: max, released: make(chan struct{})}
+}
+
+func parseMaxInflightBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", EnvMaxInflightBytes, err)
+	}
+	if n <= 0 {
+		return 0, errors.New(EnvMaxInflightBytes + " must be positive")
+	}
+	return n, nil
+}
+
+// Acquire waits until size bytes are free. A blob larger than the limit
+// could never be written within it, so it is rejected.
+func (l *byteLimiter) Acquire(ctx context.Context, size int64) error {
+	if l == nil {
+		return nil
+	}
+	if size > l.max {
+		return fmt.Errorf("blob of %d bytes is larger than %s %d", size, EnvMaxInflightBytes, l.max)
+	}
+	for {
+		l.mu.Lock()
+		if l.used+size <= l.max {
+			l.used += size
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d bytes of %s: %v", size, EnvMaxInflightBytes, ctx.Err())
+		}
+	}
+}
+
+func (l *byteLimiter) Release(size int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= size
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// Wrap returns ref with blob writes to its destinations bounded by l.
+func (l *byteLimiter) Wrap(ref types.ImageReference) types.ImageReference {
+	if l == nil {
+		return ref
+	}
+	return &byteLimitedReference{ImageReference: ref, limit: l}
+}
+
+type byteLimitedReference struct {
+	types.ImageReference
+	limit *byteLimiter
+}
+
+func (r *byteLimitedReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &byteLimitedDestination{ImageDestination: dest, limit: r.limit}, nil
+}
+
+type byteLimitedDestination struct {
+	types.ImageDestination
+	limit *byteLimiter
+}
+
+// PutBlob holds the bytes of the blob while it is written. Blobs compressed
+// or decompressed on the way have no size yet, they take all of the limit
+// and fail if they turn out to be larger.
+func (d *byteLimitedDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	size := inputInfo.Size
+	if size < 0 {
+		size = d.limit.max
+		stream = &maxSizeReader{r: stream, remaining: size}
+	}
+	if err := d.limit.Acquire(ctx, size); err != nil {
+		return types.BlobInfo{}, err
+	}
+	defer d.limit.Release(size)
+	return d.ImageDestination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+}
+
+// maxSizeReader fails reads past remaining bytes.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, fmt.Errorf("blob is larger than %s", EnvMaxInflightBytes)
+	}
+	return n, err
+}
+
+const (
+	// defaultBlobConcurrency is how many blobs copy.Image copies at once
+	// unless MaxParallelDownloads says otherwise.
+	defaultBlobConcurrency = 6
+	// maxBlobConcurrency bounds BlobConcurrency, beyond it registries throttle
+	// the existence checks rather than answer them faster.
+	maxBlobConcurrency = 32
+)
+
+// checkBlobConcurrency checks the BlobConcurrency n.
+func checkBlobConcurrency(n int) error {
+	if n < 1 || n > maxBlobConcurrency {
+		return fmt.Errorf("%v must be between 1 and %d", BLOB_CONCURRENCY, maxBlobConcurrency)
+	}
+	return nil
+}
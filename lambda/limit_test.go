@@ -0,0 +1,152 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyLimiter(t *testing.T) {
+	var unlimited *copyLimiter
+	assert.NoError(t, unlimited.Acquire(context.Background()))
+	unlimited.Release()
+
+	l := newCopyLimiter(1)
+	assert.NoError(t, l.Acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, l.Acquire(ctx))
+
+	acquired := make(chan error)
+	go func() { acquired <- l.Acquire(context.Background()) }()
+	l.Release()
+	assert.NoError(t, <-acquired)
+	l.Release()
+}
+
+func TestParseMaxConcurrentCopies(t *testing.T) {
+	n, err := parseMaxConcurrentCopies("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = parseMaxConcurrentCopies("2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	_, err = parseMaxConcurrentCopies("0")
+	assert.Error(t, err)
+	_, err = parseMaxConcurrentCopies("many")
+	assert.Error(t, err)
+}
+
+func TestByteLimiter(t *testing.T) {
+	var unlimited *byteLimiter
+	assert.NoError(t, unlimited.Acquire(context.Background(), 1<<40))
+	unlimited.Release(1 << 40)
+
+	l := newByteLimiter(100)
+	var mu sync.Mutex
+	var inflight, peak int64
+	var wg sync.WaitGroup
+	for _, size := range []int64{60, 50, 40, 30, 100} {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			assert.NoError(t, l.Acquire(context.Background(), size))
+			mu.Lock()
+			inflight += size
+			if inflight > peak {
+				peak = inflight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inflight -= size
+			mu.Unlock()
+			l.Release(size)
+		}(size)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, peak, int64(100))
+
+	assert.EqualError(t, l.Acquire(context.Background(), 101), "blob of 101 bytes is larger than MAX_INFLIGHT_BYTES 100")
+	assert.NoError(t, l.Acquire(context.Background(), 80))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, l.Acquire(ctx, 30))
+	l.Release(80)
+	assert.Equal(t, int64(0), l.used)
+}
+
+// concurrentDestination records the most bytes written at once.
+type concurrentDestination struct {
+	types.ImageDestination
+
+	mu             sync.Mutex
+	inflight, peak int64
+}
+
+func (d *concurrentDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	n, err := io.Copy(io.Discard, stream)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	d.mu.Lock()
+	d.inflight += n
+	if d.inflight > d.peak {
+		d.peak = d.inflight
+	}
+	d.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	d.mu.Lock()
+	d.inflight -= n
+	d.mu.Unlock()
+	return types.BlobInfo{Size: n}, nil
+}
+
+func TestByteLimitedDestination(t *testing.T) {
+	recorded := &concurrentDestination{}
+	l := newByteLimiter(100)
+	dest := &byteLimitedDestination{ImageDestination: recorded, limit: l}
+	put := func(n, size int64) error {
+		_, err := dest.PutBlob(context.Background(), bytes.NewReader(make([]byte, n)), types.BlobInfo{Size: size}, nil, false)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, size := range []int64{60, 50, 40, 30, 20, 10} {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			assert.NoError(t, put(size, size))
+		}(size)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, recorded.peak, int64(100))
+	assert.Greater(t, recorded.peak, int64(60))
+
+	assert.EqualError(t, put(200, 200), "blob of 200 bytes is larger than MAX_INFLIGHT_BYTES 100")
+	// Blobs of unknown size are written alone, up to the limit.
+	assert.NoError(t, put(100, -1))
+	assert.EqualError(t, put(101, -1), "blob is larger than MAX_INFLIGHT_BYTES")
+	assert.Equal(t, int64(0), l.used)
+}
+
+func TestParseMaxInflightBytes(t *testing.T) {
+	n, err := parseMaxInflightBytes("")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = parseMaxInflightBytes("268435456")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(268435456), n)
+	_, err = parseMaxInflightBytes("0")
+	assert.Error(t, err)
+}
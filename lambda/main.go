@@ -5,13 +5,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
 	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-lambda-go/cfn"
@@ -20,7 +34,19 @@ import (
 	_ "cdk-ecr-deployment-handler/s3" // Install s3 transport plugin
 )
 
-const EnvLogLevel = "LOG_LEVEL"
+const (
+	EnvLogLevel = "LOG_LEVEL"
+	// EnvDisableCopies is an emergency brake: when true every copy is
+	// skipped and reported as successful.
+	EnvDisableCopies = "DISABLE_COPIES"
+	// EnvPolicyJSON is a containers-policy.json(5) document, or the path of
+	// one, used instead of accepting any image.
+	EnvPolicyJSON = "POLICY_JSON"
+)
+
+// requestStore deduplicates re-delivered CloudFormation events. It is nil
+// when deduplication is disabled.
+var requestStore RequestStore
 
 func init() {
 	s, exists := os.LookupEnv(EnvLogLevel)
@@ -35,101 +61,1372 @@ func init() {
 	}
 }
 
+// requestLogger returns a logger writing like the standard one at level,
+// the LogLevel property of one request, without changing the level of the
+// requests handled at the same time. An empty or invalid level keeps the
+// LOG_LEVEL one.
+func requestLogger(level string) *logrus.Logger {
+	std := logrus.StandardLogger()
+	if level == "" {
+		return std
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		std.Warnf("Ignoring %s: %v", LOG_LEVEL, err)
+		return std
+	}
+	l := logrus.New()
+	l.Out = std.Out
+	l.Formatter = std.Formatter
+	l.Hooks = std.Hooks
+	l.ReportCaller = std.ReportCaller
+	l.SetLevel(lvl)
+	return l
+}
+
+type loggerKey struct{}
+
+// withLogger returns ctx carrying logger for loggerFrom.
+func withLogger(ctx context.Context, logger *logrus.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger of the request ctx belongs to, or the
+// standard one.
+func loggerFrom(ctx context.Context) *logrus.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*logrus.Logger); ok {
+		return logger
+	}
+	return logrus.StandardLogger()
+}
+
 func handler(ctx context.Context, event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
 	physicalResourceID = event.PhysicalResourceID
 	data = make(map[string]interface{})
 
-	log.Printf("Event: %s", Dumps(event))
+	if level, ok := event.ResourceProperties[LOG_LEVEL].(string); ok {
+		ctx = withLogger(ctx, requestLogger(level))
+	}
+
+	// Events can be large, only log them when debugging.
+	loggerFrom(ctx).Debugf("Event: %s", Dumps(event))
 
 	if event.RequestType == cfn.RequestDelete {
 		return physicalResourceID, data, nil
 	}
 	if event.RequestType == cfn.RequestCreate || event.RequestType == cfn.RequestUpdate {
-		srcImage, err := getStrProps(event.ResourceProperties, SRC_IMAGE)
+		if requestStore != nil {
+			seen, err := requestStore.Seen(ctx, event.RequestID)
+			if err != nil {
+				loggerFrom(ctx).Warnf("Checking for duplicate request failed, continuing: %v", err)
+			} else if seen {
+				log.Printf("Request %s was already handled, skipping", event.RequestID)
+				data["Result"] = "skipped: duplicate request"
+				return physicalResourceID, data, nil
+			}
+		}
+
+		props, err := resolveDestImageTemplate(ctx, event)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		destImage, err := getStrProps(event.ResourceProperties, DEST_IMAGE)
+		destImages, err := getStrListPropsDefault(props, DEST_IMAGES)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		srcCreds, err := getStrPropsDefault(event.ResourceProperties, SRC_CREDS, "")
+		latestNTags, err := getIntPropsDefault(props, LATEST_N_TAGS, 0)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		destCreds, err := getStrPropsDefault(event.ResourceProperties, DEST_CREDS, "")
+		semverConstraint, err := getStrPropsDefault(props, SEMVER_CONSTRAINT, "")
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-
-		srcCreds, err = parseCreds(srcCreds)
+		err = recordCopy(ctx, cfnCopyRequest(event), props, data, func(ctx context.Context) error {
+			budgetCtx, cancel := withBudget(ctx, totalBudget)
+			defer cancel()
+			var err error
+			if len(destImages) > 0 && latestNTags > 0 {
+				err = fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGES, LATEST_N_TAGS)
+			} else if len(destImages) > 0 && semverConstraint != "" {
+				err = fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGES, SEMVER_CONSTRAINT)
+			} else if len(destImages) > 0 {
+				err = handleDestImages(budgetCtx, props, destImages, data)
+			} else if latestNTags > 0 || semverConstraint != "" {
+				err = handleLatestTags(budgetCtx, props, latestNTags, data)
+			} else {
+				err = handleImages(budgetCtx, props, data)
+			}
+			return budgetError(budgetCtx, err)
+		})
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		destCreds, err = parseCreds(destCreds)
+
+		// Only requests that copied are recorded; a skipped one, e.g. while
+		// DISABLE_COPIES is set, copies when it's delivered again.
+		if disabled, _ := copiesDisabled(); requestStore != nil && data["Result"] == "copied" && !disabled {
+			if err := requestStore.Record(ctx, event.RequestID); err != nil {
+				loggerFrom(ctx).Warnf("Recording handled request failed: %v", err)
+			}
+		}
+	}
+
+	return physicalResourceID, data, nil
+}
+
+// resolveDestImageTemplate returns the resource properties with DestImage
+// expanded from DestImageTemplate, if one is set.
+func resolveDestImageTemplate(ctx context.Context, event cfn.Event) (map[string]interface{}, error) {
+	props := event.ResourceProperties
+	tmpl, err := getStrPropsDefault(props, DEST_IMAGE_TEMPLATE, "")
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == "" {
+		return props, nil
+	}
+	if _, ok := props[DEST_IMAGE]; ok {
+		return nil, fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGE, DEST_IMAGE_TEMPLATE)
+	}
+	vars := StackTemplateVars(event)
+	if usesStackTags(tmpl) {
+		tagVars, err := lookupStackTagVars(ctx, event.StackID)
 		if err != nil {
-			return physicalResourceID, data, err
+			return nil, err
+		}
+		for k, v := range tagVars {
+			vars[k] = v
+		}
+	}
+	if usesSourcePlaceholders(tmpl) {
+		srcImage, err := getStrProps(props, SRC_IMAGE)
+		if err != nil {
+			return nil, err
+		}
+		srcVars, err := SourceTemplateVars(srcImage)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSourcePlaceholders(tmpl, srcImage, srcVars); err != nil {
+			return nil, err
+		}
+		for k, v := range srcVars {
+			vars[k] = v
+		}
+	}
+	destImage, err := ExpandTemplate(tmpl, vars)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := alltransports.ParseImageName(destImage); err != nil {
+		return nil, fmt.Errorf("invalid %v %q: %v", DEST_IMAGE_TEMPLATE, destImage, err.Error())
+	}
+	log.Printf("Expanded %v to %v", DEST_IMAGE_TEMPLATE, destImage)
+
+	expanded := make(map[string]interface{}, len(props)+1)
+	for k, v := range props {
+		expanded[k] = v
+	}
+	expanded[DEST_IMAGE] = destImage
+	return expanded, nil
+}
+
+// copyJob is the state handleImages passes between the steps of a copy.
+// Steps that change the destination keep destImage and destRef in sync.
+type copyJob struct {
+	props map[string]interface{}
+	data  map[string]interface{}
+
+	srcImage, destImage string
+	srcRef, destRef     types.ImageReference
+	srcInfo, destInfo   ImageRefInfo
+	// srcPinned and destPinned are set when the image names pin both a tag
+	// and a digest.
+	srcPinned, destPinned *TagAndDigest
+	publicAlias           string
+	// archivePath is where an archive destination is staged before it is
+	// uploaded to destArchiveS3Uri.
+	archivePath, destArchiveS3Uri string
+
+	srcCtx, destCtx *types.SystemContext
+	// source is the inspected source, set by checkSource.
+	source *SourceInfo
+}
+
+func (j *copyJob) setDestRef(ref types.ImageReference) {
+	j.destRef = ref
+	j.destImage = transports.ImageName(ref)
+}
+
+// copiesDisabled reports whether DISABLE_COPIES is set.
+func copiesDisabled() (bool, error) {
+	s := os.Getenv(EnvDisableCopies)
+	if s == "" {
+		return false, nil
+	}
+	disabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("error parsing %s: %v", EnvDisableCopies, err)
+	}
+	return disabled, nil
+}
+
+// handleImages copies the image described by the resource properties and
+// records details about the copy in data.
+func handleImages(ctx context.Context, props map[string]interface{}, data map[string]interface{}) error {
+	disabled, err := copiesDisabled()
+	if err != nil {
+		return err
+	}
+	if disabled {
+		loggerFrom(ctx).Warnf("Copies are disabled by %s, NOT copying %v to %v", EnvDisableCopies, props[SRC_IMAGE], props[DEST_IMAGE])
+		data["Result"] = "skipped: copies disabled"
+		return nil
+	}
+
+	j := &copyJob{props: props, data: data}
+	if err := j.resolveImageNames(ctx); err != nil {
+		return err
+	}
+	log.Printf("SrcImage: %v DestImage: %v", j.srcImage, j.destImage)
+	cleanup, err := j.stageDestArchive(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	start := time.Now()
+	j.srcRef, err = alltransports.ParseImageName(j.srcImage)
+	if err != nil {
+		return err
+	}
+	j.destRef, err = alltransports.ParseImageName(j.destImage)
+	if err != nil {
+		return err
+	}
+	logTiming(ctx, "parse", start)
+	if err := checkBudget(ctx, "parse"); err != nil {
+		return err
+	}
+
+	if err := j.resolveDestination(); err != nil {
+		return err
+	}
+	j.srcInfo = GetImageRefInfo(j.srcRef)
+	if j.srcPinned != nil {
+		j.srcInfo.Tag = j.srcPinned.Tag
+	}
+	j.destInfo = GetImageRefInfo(j.destRef)
+	loggerFrom(ctx).WithFields(j.srcInfo.Fields()).Info("Parsed source image reference")
+	loggerFrom(ctx).WithFields(j.destInfo.Fields()).Info("Parsed destination image reference")
+	j.srcInfo.AddTo(data, "Src")
+	j.destInfo.AddTo(data, "Dest")
+
+	srcCreds, err := getStrPropsDefault(props, SRC_CREDS, "")
+	if err != nil {
+		return err
+	}
+	destCreds, err := getStrPropsDefault(props, DEST_CREDS, "")
+	if err != nil {
+		return err
+	}
+	registryCreds, err := getStrMapPropsDefault(props, REGISTRY_CREDENTIALS)
+	if err != nil {
+		return err
+	}
+	srcCreds = ResolveRegistryCreds(registryCreds, j.srcInfo.Registry, srcCreds)
+	destCreds = ResolveRegistryCreds(registryCreds, j.destInfo.Registry, destCreds)
+	srcCreds = dropUnusedCreds(srcCreds, j.srcRef, SRC_CREDS)
+	destCreds = dropUnusedCreds(destCreds, j.destRef, DEST_CREDS)
+	srcCredsRef, destCredsRef := srcCreds, destCreds
+	if err := CheckECRPartition(j.srcInfo, srcCreds, os.Getenv("AWS_REGION"), SRC_CREDS); err != nil {
+		return err
+	}
+	if err := CheckECRPartition(j.destInfo, destCreds, os.Getenv("AWS_REGION"), DEST_CREDS); err != nil {
+		return err
+	}
+
+	start = time.Now()
+	srcCreds, err = parseCreds(srcCreds)
+	if err != nil {
+		return err
+	}
+	destCreds, err = parseCreds(destCreds)
+	if err != nil {
+		return err
+	}
+	logTiming(ctx, "credentials", start)
+	if err := checkBudget(ctx, "credentials"); err != nil {
+		return err
+	}
+
+	start = time.Now()
+	srcOpts := NewImageOpts(j.srcImage)
+	srcOpts.SetCreds(srcCreds)
+	defer srcOpts.Close()
+	j.srcCtx, err = srcOpts.NewSystemContext()
+	if err != nil {
+		return err
+	}
+	destOpts := NewImageOpts(j.destImage)
+	destOpts.SetCreds(destCreds)
+	if j.publicAlias != "" {
+		destOpts.SetECRPublicLogin()
+	}
+	defer destOpts.Close()
+	j.destCtx, err = destOpts.NewSystemContext()
+	if err != nil {
+		return err
+	}
+	for _, side := range []struct {
+		prop string
+		ref  types.ImageReference
+		sys  *types.SystemContext
+	}{{SRC_USE_PLAIN_HTTP, j.srcRef, j.srcCtx}, {DEST_USE_PLAIN_HTTP, j.destRef, j.destCtx}} {
+		if err := usePlainHTTP(ctx, props, side.prop, side.ref, side.sys); err != nil {
+			return err
 		}
+	}
+	if err := useDockerDaemonHost(props, j.srcRef, j.srcCtx); err != nil {
+		return err
+	}
+	logTiming(ctx, "auth", start)
+	if err := checkBudget(ctx, "auth"); err != nil {
+		return err
+	}
 
-		log.Printf("SrcImage: %v DestImage: %v", srcImage, destImage)
+	if err := j.ensurePublicRepository(ctx); err != nil {
+		return err
+	}
+
+	if err := copyLimit.Acquire(ctx); err != nil {
+		return err
+	}
+	defer copyLimit.Release()
 
-		srcRef, err := alltransports.ParseImageName(srcImage)
+	ctx, cancel := newTimeoutContext(ctx)
+	defer cancel()
+
+	if err := j.checkSource(ctx); err != nil {
+		return err
+	}
+	if err := j.tagFromDigest(); err != nil {
+		return err
+	}
+
+	alsoTagWithDigest, err := getBoolPropsDefault(props, ALSO_TAG_WITH_DIGEST, false)
+	if err != nil {
+		return err
+	}
+	if alsoTagWithDigest && j.destRef.Transport().Name() != docker.Transport.Name() {
+		return fmt.Errorf("%v requires a docker destination", ALSO_TAG_WITH_DIGEST)
+	}
+	annotations, err := getStrMapPropsDefault(props, MANIFEST_ANNOTATIONS)
+	if err != nil {
+		return err
+	}
+	if _, ok := GetArchivePath(j.destImage); ok && len(annotations) > 0 {
+		// Annotating rewrites the manifest after the copy, which would leave
+		// an archive without its blobs.
+		return fmt.Errorf("%v can't be added to oci-archive or docker-archive destinations", MANIFEST_ANNOTATIONS)
+	}
+
+	if SameImage(j.srcRef, j.destRef) {
+		force, err := getBoolPropsDefault(props, FORCE, false)
 		if err != nil {
-			return physicalResourceID, data, err
+			return err
+		}
+		if !force {
+			return fmt.Errorf("source and destination are the same image %v, set %v to skip the copy instead of failing", j.destImage, FORCE)
 		}
-		destRef, err := alltransports.ParseImageName(destImage)
+		loggerFrom(ctx).Warnf("Skipped: source and destination are the same image %v", j.destImage)
+		data["Result"] = "skipped: source and destination are the same"
+		return nil
+	}
+
+	verifyOnly, err := getBoolPropsDefault(props, VERIFY_ONLY, false)
+	if err != nil {
+		return err
+	}
+	if verifyOnly {
+		compareLayers, err := getBoolPropsDefault(props, VERIFY_ONLY_LAYERS, false)
 		if err != nil {
-			return physicalResourceID, data, err
+			return err
 		}
+		return verifyInSync(ctx, j.destCtx, j.destRef, j.source, compareLayers, data)
+	}
+
+	if skipped, err := j.prepareDestination(ctx); err != nil || skipped {
+		return err
+	}
+	priorDigest, priorKnown := j.priorDestDigest(ctx)
+	forceManifestType, err := j.destManifestType(ctx)
+	if err != nil {
+		return err
+	}
+
+	policyJSON, err := getStrPropsDefault(props, POLICY, os.Getenv(EnvPolicyJSON))
+	if err != nil {
+		return err
+	}
+	policyContext, err := newPolicyContext(policyJSON)
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	compressionFormat, err := getStrPropsDefault(props, COMPRESSION_FORMAT, "")
+	if err != nil {
+		return err
+	}
+	j.destCtx.CompressionFormat, err = ResolveCompression(compressionFormat)
+	if err != nil {
+		return err
+	}
+
+	// Foreign layers, e.g. Windows base layers, are left as URL references
+	// unless asked to push their content to the destination.
+	downloadForeignLayers, err := getBoolPropsDefault(props, DOWNLOAD_FOREIGN_LAYERS, false)
+	if err != nil {
+		return err
+	}
+
+	blobUploadRetries, err := getIntPropsDefault(props, BLOB_UPLOAD_INVALID_RETRIES, defaultBlobUploadInvalidRetries)
+	if err != nil {
+		return err
+	}
+	// Checking whether a blob is already in the destination is part of
+	// copying it, so this also bounds the concurrent existence checks.
+	blobConcurrency, err := getIntPropsDefault(props, BLOB_CONCURRENCY, defaultBlobConcurrency)
+	if err != nil {
+		return err
+	}
+	if err := checkBlobConcurrency(blobConcurrency); err != nil {
+		return err
+	}
 
-		srcOpts := NewImageOpts(srcImage)
-		srcOpts.SetCreds(srcCreds)
-		srcCtx, err := srcOpts.NewSystemContext()
+	reportDestination, err := getStrPropsDefault(props, REPORT_DESTINATION, "")
+	if err != nil {
+		return err
+	}
+	reportWriter, closeReport, err := ReportWriter(ctx, reportDestination)
+	if err != nil {
+		return err
+	}
+	defer closeReport()
+
+	// Errors tagged with the side they came from tell which registry
+	// throttled a failed copy. Each blob holds its bytes of
+	// MAX_INFLIGHT_BYTES while it is written.
+	srcRef := WithSide(j.srcRef, throttledSource)
+	destRef := inflightLimit.Wrap(WithSide(j.destRef, throttledDestination))
+	start = time.Now()
+	var copiedManifest []byte
+	copyFn := func() error {
+		progress := NewCopyProgress(ctx)
+		checks := &BlobChecks{}
+		var err error
+		copiedManifest, err = copy.Image(ctx, policyContext, checks.Wrap(destRef), srcRef, &copy.Options{
+			ReportWriter:          reportWriter,
+			DestinationCtx:        j.destCtx,
+			SourceCtx:             j.srcCtx,
+			ForceManifestMIMEType: forceManifestType,
+			Progress:              progress.Channel(),
+			ProgressInterval:      progressInterval,
+			DownloadForeignLayers: downloadForeignLayers,
+			MaxParallelDownloads:  uint(blobConcurrency),
+		})
+		progress.Close()
+		log.Printf("Copied %d blobs (%d bytes), skipped %d blobs already in destination (%d bytes)",
+			progress.Copied, progress.CopiedBytes, progress.Skipped, progress.SkippedBytes)
+		checked, checkDuration := checks.Counts()
+		log.Printf("Checked whether %d blobs are in destination in %v in total, %d at once", checked, checkDuration, blobConcurrency)
+		data["BlobsCopied"] = progress.Copied
+		data["BlobsSkipped"] = progress.Skipped
+		return err
+	}
+	refresh := func() (bool, error) {
+		srcRefreshed, err := srcOpts.RefreshCreds(j.srcCtx, srcCredsRef, parseCreds)
 		if err != nil {
-			return physicalResourceID, data, err
+			return false, err
+		}
+		destRefreshed, err := destOpts.RefreshCreds(j.destCtx, destCredsRef, parseCreds)
+		return srcRefreshed || destRefreshed, err
+	}
+	err = retryOnBlobUploadInvalid(ctx, func() error {
+		return retryOnUnauthorized(ctx, copyFn, refresh)
+	}, blobUploadRetries, blobUploadRetryDelay)
+	if err != nil {
+		err = newThrottledError(err)
+		// log.Printf("Copy image failed: %v", err.Error())
+		// return nil
+		if rule := findDestPullThroughCacheRule(ctx, j.destInfo); rule != nil {
+			return fmt.Errorf("copy image failed: destination repository %s is managed by the pull through cache rule for %s (prefix %q), "+
+				"which is populated by pulls and can't be pushed to: %s",
+				j.destInfo.Repository, aws.ToString(rule.UpstreamRegistryUrl), aws.ToString(rule.EcrRepositoryPrefix), err.Error())
 		}
-		destOpts := NewImageOpts(destImage)
-		destOpts.SetCreds(destCreds)
-		destCtx, err := destOpts.NewSystemContext()
+		return fmt.Errorf("copy image failed: %w", err)
+	}
+	logTiming(ctx, "copy", start)
+	if err := checkBudget(ctx, "copy"); err != nil {
+		return err
+	}
+	copiedAt := time.Now().UTC().Format(time.RFC3339)
+	log.Printf("Copied at %v", copiedAt)
+	data["CopiedAt"] = copiedAt
+
+	if len(annotations) > 0 {
+		copiedManifest, err = AnnotateManifest(ctx, j.destCtx, j.destRef, copiedManifest, annotations)
 		if err != nil {
-			return physicalResourceID, data, err
+			return fmt.Errorf("annotating %v failed: %s", j.destImage, err.Error())
+		}
+		if dgst, err := manifest.Digest(copiedManifest); err == nil {
+			log.Printf("Destination manifest with annotations is %v", dgst)
+		}
+	}
+	if dgst, err := manifest.Digest(copiedManifest); err == nil {
+		data["DestManifestDigest"] = dgst.String()
+		if priorKnown {
+			data["DestChanged"] = dgst != priorDigest
+			if dgst == priorDigest {
+				log.Printf("Destination was already at %v, nothing changed", dgst)
+			}
+		}
+	}
+
+	if err := j.checkCopy(ctx, copiedManifest, alsoTagWithDigest); err != nil {
+		return err
+	}
+	if err := j.publishCopy(ctx); err != nil {
+		return err
+	}
+	if err := j.maintainDestination(ctx); err != nil {
+		return err
+	}
+
+	data["Result"] = "copied"
+	return nil
+}
+
+// resolveImageNames reads SrcImage and DestImage and resolves them to the
+// names that are copied: qualified, normalized, and with the tag of names
+// pinning a tag and a digest split off.
+func (j *copyJob) resolveImageNames(ctx context.Context) error {
+	srcImage, err := getStrProps(j.props, SRC_IMAGE)
+	if err != nil {
+		return err
+	}
+	destImage, err := getStrProps(j.props, DEST_IMAGE)
+	if err != nil {
+		return err
+	}
+	if qualified, ok, err := QualifyImage(destImage, os.Getenv(EnvDefaultDestRegistry)); err != nil {
+		return err
+	} else if ok {
+		log.Printf("Qualified DestImage %v with %s: %v", destImage, EnvDefaultDestRegistry, qualified)
+		destImage = qualified
+	}
+
+	normalizeDestPath, err := getBoolPropsDefault(j.props, NORMALIZE_DEST_PATH, false)
+	if err != nil {
+		return err
+	}
+	if normalizeDestPath {
+		normalized := NormalizeRepoPath(destImage)
+		if normalized != destImage {
+			loggerFrom(ctx).Warnf("Normalized DestImage %v to %v", destImage, normalized)
+			destImage = normalized
+		}
+	}
+
+	// A source pinning a tag and a digest is pulled by digest; a destination
+	// pinning both is pushed to the tag, and the source must resolve to the
+	// digest.
+	if srcPinned, ok := SplitTagAndDigest(srcImage); ok {
+		log.Printf("SrcImage %v pins a tag and a digest, pulling %v", srcImage, srcPinned.DigestImage)
+		srcImage = srcPinned.DigestImage
+		j.srcPinned = srcPinned
+	}
+	if destPinned, ok := SplitTagAndDigest(destImage); ok {
+		log.Printf("DestImage %v pins a tag and a digest, pushing to %v", destImage, destPinned.TagImage)
+		destImage = destPinned.TagImage
+		j.destPinned = destPinned
+	}
+	j.srcImage, j.destImage = srcImage, destImage
+	return nil
+}
+
+// stageDestArchive points an archive destination uploaded to
+// DestArchiveS3Uri at a staging directory. cleanup removes it.
+func (j *copyJob) stageDestArchive(ctx context.Context) (cleanup func(), err error) {
+	j.destArchiveS3Uri, err = getStrPropsDefault(j.props, DEST_ARCHIVE_S3_URI, "")
+	if err != nil || j.destArchiveS3Uri == "" {
+		return func() {}, err
+	}
+	if _, ok := GetArchivePath(j.destImage); !ok {
+		return nil, fmt.Errorf("%v requires an oci-archive or docker-archive DestImage", DEST_ARCHIVE_S3_URI)
+	}
+	staged, stageDir, err := StageArchive(j.destImage)
+	if err != nil {
+		return nil, err
+	}
+	j.destImage = staged
+	j.archivePath, _ = GetArchivePath(staged)
+	log.Printf("Writing the archive to %v before uploading it", j.archivePath)
+	return func() {
+		if err := os.RemoveAll(stageDir); err != nil {
+			loggerFrom(ctx).Warnf("Removing %v failed: %v", stageDir, err)
 		}
+	}, nil
+}
 
-		ctx, cancel := newTimeoutContext()
-		defer cancel()
-		policyContext, err := newPolicyContext()
+// resolveDestination rewrites the destination reference as the props ask:
+// with the source registry in its path, in an ECR Public registry alias, or
+// with a suffixed tag.
+func (j *copyJob) resolveDestination() error {
+	encodeSourceRegistry, err := getBoolPropsDefault(j.props, ENCODE_SOURCE_REGISTRY_IN_PATH, false)
+	if err != nil {
+		return err
+	}
+	if encodeSourceRegistry {
+		ref, err := WithSourceRegistry(j.srcRef, j.destRef)
 		if err != nil {
-			return physicalResourceID, data, err
+			return fmt.Errorf("%v: %v", ENCODE_SOURCE_REGISTRY_IN_PATH, err)
 		}
-		defer policyContext.Destroy()
+		j.setDestRef(ref)
+		log.Printf("Encoded source registry in DestImage: %v", j.destImage)
+	}
 
-		_, err = copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
-			ReportWriter:   os.Stdout,
-			DestinationCtx: destCtx,
-			SourceCtx:      srcCtx,
-		})
+	j.publicAlias, err = getStrPropsDefault(j.props, PUBLIC_REGISTRY_ALIAS, "")
+	if err != nil {
+		return err
+	}
+	if j.publicAlias != "" {
+		ref, err := WithPublicRegistryAlias(j.destRef, j.publicAlias)
 		if err != nil {
-			// log.Printf("Copy image failed: %v", err.Error())
-			// return physicalResourceID, data, nil
-			return physicalResourceID, data, fmt.Errorf("copy image failed: %s", err.Error())
+			return fmt.Errorf("%v: %v", PUBLIC_REGISTRY_ALIAS, err)
 		}
+		j.setDestRef(ref)
 	}
 
-	return physicalResourceID, data, nil
+	destTagSuffix, err := getStrPropsDefault(j.props, DEST_TAG_SUFFIX, "")
+	if err != nil {
+		return err
+	}
+	if destTagSuffix != "" {
+		tagged, ok := j.destRef.DockerReference().(reference.NamedTagged)
+		if !ok || j.destRef.Transport().Name() != docker.Transport.Name() {
+			return fmt.Errorf("%v requires a tagged docker DestImage", DEST_TAG_SUFFIX)
+		}
+		tag, err := SuffixedTag(tagged.Tag(), destTagSuffix, os.LookupEnv)
+		if err != nil {
+			return fmt.Errorf("%v: %v", DEST_TAG_SUFFIX, err)
+		}
+		ref, err := WithTag(j.destRef, tag)
+		if err != nil {
+			return err
+		}
+		j.setDestRef(ref)
+		log.Printf("Suffixed DestImage tag: %v", j.destImage)
+	}
+	return nil
+}
+
+// ensurePublicRepository creates the ECR Public destination repository
+// with CreatePublicRepository.
+func (j *copyJob) ensurePublicRepository(ctx context.Context) error {
+	createPublicRepo, err := getBoolPropsDefault(j.props, CREATE_PUBLIC_REPOSITORY, false)
+	if err != nil || !createPublicRepo {
+		return err
+	}
+	if j.publicAlias == "" {
+		return fmt.Errorf("%v requires %v", CREATE_PUBLIC_REPOSITORY, PUBLIC_REGISTRY_ALIAS)
+	}
+	catalogProps, err := getStrMapPropsDefault(j.props, PUBLIC_REPOSITORY_CATALOG_DATA)
+	if err != nil {
+		return err
+	}
+	catalog, err := ParsePublicCatalogData(catalogProps)
+	if err != nil {
+		return fmt.Errorf("%v: %v", PUBLIC_REPOSITORY_CATALOG_DATA, err)
+	}
+	client, err := NewECRPublicClient(ctx)
+	if err != nil {
+		return err
+	}
+	name := PublicRepositoryName(j.destInfo, j.publicAlias)
+	created, err := EnsurePublicRepository(ctx, client, name, catalog)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Printf("Created public repository %v", name)
+	}
+	return nil
+}
+
+// checkSource resolves the source before copying, so the digest of a
+// floating tag is recorded and an incompatible source fails before any
+// layers are transferred: by media type, pinned digest, ECR limits, age or
+// scan findings.
+func (j *copyJob) checkSource(ctx context.Context) error {
+	maxConfigSize, err := getIntPropsDefault(j.props, MAX_CONFIG_SIZE, maxConfigSizeLimit)
+	if err != nil {
+		return err
+	}
+	if err := checkMaxConfigSize(maxConfigSize); err != nil {
+		return err
+	}
+	start := time.Now()
+	source, err := InspectSource(ctx, j.srcCtx, j.srcRef, int64(maxConfigSize))
+	if err != nil {
+		suggestTags, propErr := getBoolPropsDefault(j.props, SUGGEST_SOURCE_TAGS, false)
+		if propErr != nil {
+			return propErr
+		}
+		if suggestTags {
+			if tagErr := missingTagError(ctx, j.srcCtx, j.srcRef, j.srcInfo.Tag, err); tagErr != nil {
+				return fmt.Errorf("reading source manifest failed: %s", tagErr.Error())
+			}
+		}
+		if isDockerDaemon(j.srcRef) {
+			return fmt.Errorf("reading source manifest failed, is the Docker daemon at %v running? %s", dockerDaemonHost(j.srcCtx), err.Error())
+		}
+		return fmt.Errorf("reading source manifest failed: %s", err.Error())
+	}
+	j.source = source
+	logTiming(ctx, "manifest", start)
+	if err := checkBudget(ctx, "manifest"); err != nil {
+		return err
+	}
+	log.Printf("Resolved %v to %v", j.srcImage, source.Digest)
+	j.data["SrcResolvedDigest"] = source.Digest.String()
+	allowedMediaTypes, err := getStrListPropsDefault(j.props, ALLOWED_SOURCE_MEDIA_TYPES)
+	if err != nil {
+		return err
+	}
+	if err := CheckSourceMediaType(source.MIMEType, allowedMediaTypes); err != nil {
+		return err
+	}
+	if j.destPinned != nil && source.Digest != j.destPinned.Digest {
+		return fmt.Errorf("DestImage pins digest %v, but the source resolves to %v", j.destPinned.Digest, source.Digest)
+	}
+	if _, ok := GetECRRepository(j.destInfo); ok {
+		limits, err := getECRLimits(j.props)
+		if err != nil {
+			return err
+		}
+		if err := CheckECRLimits(source.Manifest, limits); err != nil {
+			return err
+		}
+	}
+	if source.Image != nil && source.Image.Created != nil && !source.Image.Created.IsZero() {
+		created := source.Image.Created.UTC().Format(time.RFC3339)
+		log.Printf("Source image created at %v", created)
+		j.data["SrcCreated"] = created
+	} else {
+		log.Printf("Source image has no created timestamp")
+	}
+	maxImageAgeDays, err := getIntPropsDefault(j.props, MAX_IMAGE_AGE_DAYS, 0)
+	if err != nil {
+		return err
+	}
+	if maxImageAgeDays > 0 {
+		var created *time.Time
+		if source.Image != nil {
+			created = source.Image.Created
+		}
+		if err := CheckImageAge(created, maxImageAgeDays, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	scanThreshold, err := getStrPropsDefault(j.props, SCAN_SEVERITY_THRESHOLD, "")
+	if err != nil {
+		return err
+	}
+	if scanThreshold != "" {
+		if _, err := ParseScanSeverity(scanThreshold); err != nil {
+			return fmt.Errorf("%v: %v", SCAN_SEVERITY_THRESHOLD, err)
+		}
+		scanArn, err := getStrPropsDefault(j.props, SCAN_LAMBDA_ARN, "")
+		if err != nil {
+			return err
+		}
+		counts, err := ScanSource(ctx, j.srcImage, j.srcInfo, source.Digest, scanArn)
+		if err != nil {
+			return err
+		}
+		if err := CheckScanFindings(counts, scanThreshold); err != nil {
+			return err
+		}
+		log.Printf("Source image scan has no findings at or above %s", strings.ToUpper(scanThreshold))
+	}
+	return nil
+}
+
+// tagFromDigest tags the destination from the source digest with
+// TagFromDigest.
+func (j *copyJob) tagFromDigest() error {
+	tagFromDigest, err := getBoolPropsDefault(j.props, TAG_FROM_DIGEST, false)
+	if err != nil || !tagFromDigest {
+		return err
+	}
+	prefix, err := getStrPropsDefault(j.props, TAG_FROM_DIGEST_PREFIX, defaultDigestTagPrefix)
+	if err != nil {
+		return err
+	}
+	length, err := getIntPropsDefault(j.props, TAG_FROM_DIGEST_LENGTH, defaultDigestTagLength)
+	if err != nil {
+		return err
+	}
+	tag, err := DigestTag(j.source.Digest, prefix, length)
+	if err != nil {
+		return err
+	}
+	ref, err := WithTag(j.destRef, tag)
+	if err != nil {
+		return err
+	}
+	j.setDestRef(ref)
+	j.destInfo = GetImageRefInfo(ref)
+	j.destInfo.AddTo(j.data, "Dest")
+	log.Printf("Tagging destination from source digest: %v", j.destImage)
+	return nil
+}
+
+// prepareDestination waits for the destination repository and checks its
+// tag immutability. skipped is true if the copy isn't needed because the
+// destination tag exists already.
+func (j *copyJob) prepareDestination(ctx context.Context) (skipped bool, err error) {
+	destRepositoryWait, err := getIntPropsDefault(j.props, DEST_REPOSITORY_WAIT_SECONDS, -1)
+	if err != nil {
+		return false, err
+	}
+	if destRepositoryWait >= 0 {
+		repo, ok := GetECRRepository(j.destInfo)
+		if !ok {
+			return false, fmt.Errorf("%v requires an ECR destination", DEST_REPOSITORY_WAIT_SECONDS)
+		}
+		client, err := NewECRClient(ctx, repo.Region)
+		if err != nil {
+			return false, err
+		}
+		if err := WaitForECRRepository(ctx, client, repo, time.Duration(destRepositoryWait)*time.Second, destRepositoryPollInterval); err != nil {
+			return false, err
+		}
+	}
+
+	requireTagImmutability, err := getBoolPropsDefault(j.props, REQUIRE_TAG_IMMUTABILITY, false)
+	if err != nil {
+		return false, err
+	}
+	if requireTagImmutability {
+		if repo, ok := GetECRRepository(j.destInfo); ok {
+			client, err := NewECRClient(ctx, repo.Region)
+			if err != nil {
+				return false, err
+			}
+			if err := CheckTagImmutability(ctx, client, repo); err != nil {
+				return false, err
+			}
+		} else {
+			loggerFrom(ctx).Warnf("%v only applies to ECR destinations, not checking %v", REQUIRE_TAG_IMMUTABILITY, j.destImage)
+		}
+	}
+
+	skipIfTagExists, err := getBoolPropsDefault(j.props, SKIP_IF_TAG_EXISTS, false)
+	if err != nil {
+		return false, err
+	}
+	if skipIfTagExists {
+		existing, exists, err := GetManifestDigest(ctx, j.destCtx, j.destRef)
+		if err != nil {
+			return false, fmt.Errorf("checking destination tag failed: %s", err.Error())
+		}
+		if exists && j.destPinned != nil && existing != j.destPinned.Digest {
+			log.Printf("Destination tag %v exists at %v, not the pinned %v, copying", j.destImage, existing, j.destPinned.Digest)
+		} else if exists {
+			log.Printf("Skipped: destination tag exists: %v", j.destImage)
+			j.data["Result"] = "skipped: destination tag exists"
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// priorDestDigest returns the digest the destination has before the copy,
+// which tells whether the copy changed it. Only registry destinations can
+// be looked up.
+func (j *copyJob) priorDestDigest(ctx context.Context) (digest.Digest, bool) {
+	if j.destRef.Transport().Name() != docker.Transport.Name() {
+		return "", false
+	}
+	dgst, _, err := GetManifestDigest(ctx, j.destCtx, j.destRef)
+	if err != nil {
+		loggerFrom(ctx).Warnf("Looking up the destination digest before the copy failed, not reporting DestChanged: %v", err)
+		return "", false
+	}
+	return dgst, true
+}
+
+// destManifestType returns the manifest type to force the copy to, or ""
+// to keep the type of the source, after checking the destination accepts
+// it.
+func (j *copyJob) destManifestType(ctx context.Context) (string, error) {
+	destManifestType, err := getStrPropsDefault(j.props, DEST_MANIFEST_TYPE, "")
+	if err != nil {
+		return "", err
+	}
+	forceManifestType, err := ParseManifestFormat(destManifestType)
+	if err != nil {
+		return "", err
+	}
+	digestAlgorithm, err := getStrPropsDefault(j.props, DIGEST_ALGORITHM, "")
+	if err != nil {
+		return "", err
+	}
+	if _, err := ParseDigestAlgorithm(digestAlgorithm); err != nil {
+		return "", fmt.Errorf("invalid %v for %s: %v", DIGEST_ALGORITHM, j.destImage, err.Error())
+	}
+	destManifestTypes, err := GetDestinationManifestTypes(ctx, j.destCtx, j.destRef)
+	if err != nil {
+		return "", err
+	}
+
+	if j.destRef.Transport().Name() == docker.Transport.Name() {
+		convertSchema1, err := getBoolPropsDefault(j.props, CONVERT_SCHEMA1, false)
+		if err != nil {
+			return "", err
+		}
+		forced, err := ResolveSchema1Conversion(j.source.InstanceMIMEType, forceManifestType, convertSchema1)
+		if err != nil {
+			return "", err
+		}
+		if forced != forceManifestType {
+			loggerFrom(ctx).Warnf("Converting schema v1 source manifest to %v", forced)
+			forceManifestType = forced
+		}
+	}
+	// Only the instance for the platform of the function is copied out of a
+	// manifest list, the destination has to accept its type.
+	warning, err := CheckManifestCompatibility(j.source.InstanceMIMEType, destManifestTypes, forceManifestType)
+	if err != nil {
+		return "", err
+	}
+	if warning != "" {
+		loggerFrom(ctx).Warn(warning)
+	}
+	return forceManifestType, nil
+}
+
+// checkCopy verifies the copied manifest and records what was pushed: the
+// digest reference, the bytes recompression saved and the layers.
+func (j *copyJob) checkCopy(ctx context.Context, copiedManifest []byte, alsoTagWithDigest bool) error {
+	verifyAfterPush, err := getBoolPropsDefault(j.props, VERIFY_AFTER_PUSH, false)
+	if err != nil {
+		return err
+	}
+	if verifyAfterPush {
+		verifyLayer, err := getBoolPropsDefault(j.props, VERIFY_LAYER_AFTER_PUSH, false)
+		if err != nil {
+			return err
+		}
+		pushed, err := manifest.Digest(copiedManifest)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := VerifyImage(ctx, j.destCtx, j.destRef, pushed, verifyLayer); err != nil {
+			return fmt.Errorf("verifying %v after push failed: %s", j.destImage, err.Error())
+		}
+		logTiming(ctx, "verify", start)
+		if err := checkBudget(ctx, "verify"); err != nil {
+			return err
+		}
+		log.Printf("Verified %v is pullable at %v", j.destImage, pushed)
+		j.data["VerifiedDigest"] = pushed.String()
+	}
+
+	if alsoTagWithDigest {
+		pushed, err := manifest.Digest(copiedManifest)
+		if err != nil {
+			return err
+		}
+		digestRef, err := ResolveDigestReference(ctx, j.destCtx, j.destRef, pushed)
+		if err != nil {
+			return fmt.Errorf("resolving %v by digest failed: %s", j.destImage, err.Error())
+		}
+		log.Printf("Destination is also available as %v", transports.ImageName(digestRef))
+		j.data["DestTagReference"] = j.destImage
+		j.data["DestDigestReference"] = transports.ImageName(digestRef)
+	}
+
+	if j.destCtx.CompressionFormat != nil && j.source.Image != nil {
+		if destSize, err := manifestLayersSize(copiedManifest); err != nil {
+			loggerFrom(ctx).Warnf("Reading copied layer sizes failed: %v", err)
+		} else {
+			saved := layersSize(j.source.Image.LayersData) - destSize
+			log.Printf("Recompressing with %s saved %d bytes", j.destCtx.CompressionFormat.Name(), saved)
+			j.data["CompressionBytesSaved"] = saved
+		}
+	}
+
+	returnLayerInfo, err := getBoolPropsDefault(j.props, RETURN_LAYER_INFO, false)
+	if err != nil {
+		return err
+	}
+	// The copy report lists the layers whether or not they are returned.
+	layers, err := ManifestLayers(copiedManifest)
+	if err != nil {
+		loggerFrom(ctx).Warnf("Reading copied layers failed: %v", err)
+		return nil
+	}
+	addReportLayers(ctx, j.destImage, layers)
+	if returnLayerInfo {
+		b, err := json.Marshal(layers)
+		if err != nil {
+			return err
+		}
+		j.data["LayerInfo"] = string(b)
+	}
+	return nil
+}
+
+// publishCopy uploads a staged archive to DestArchiveS3Uri and records the
+// SBOM attestation of the source.
+func (j *copyJob) publishCopy(ctx context.Context) error {
+	if j.archivePath != "" {
+		if err := UploadFileToS3(ctx, j.archivePath, j.destArchiveS3Uri); err != nil {
+			return err
+		}
+		j.data[DEST_ARCHIVE_S3_URI] = j.destArchiveS3Uri
+	}
+	extractSBOM, err := getBoolPropsDefault(j.props, EXTRACT_SBOM, false)
+	if err != nil {
+		return err
+	}
+	if extractSBOM {
+		sbom, err := FindSBOM(ctx, j.srcCtx, j.srcRef, j.source)
+		if err != nil {
+			loggerFrom(ctx).Warnf("Looking for an SBOM attestation failed: %v", err)
+		} else if sbom == nil {
+			log.Printf("Source image has no SBOM attestation")
+		} else {
+			log.Printf("Source image has a %s SBOM %s in attestation %s", sbom.PredicateType, sbom.Digest, sbom.ManifestDigest)
+			j.data["SBOMDigest"] = sbom.Digest.String()
+			j.data["SBOMManifestDigest"] = sbom.ManifestDigest.String()
+			j.data["SBOMPredicateType"] = sbom.PredicateType
+			if sbom.Location != "" {
+				j.data["SBOMLocation"] = sbom.Location
+			}
+		}
+	}
+	return nil
+}
+
+// maintainDestination runs the steps on the destination repository after
+// the copy: waiting for the scan on push, ensuring replication, pruning old
+// tags and listing the tags.
+func (j *copyJob) maintainDestination(ctx context.Context) error {
+	scanOnPushWait, err := getIntPropsDefault(j.props, SCAN_ON_PUSH_WAIT_SECONDS, -1)
+	if err != nil {
+		return err
+	}
+	if scanOnPushWait >= 0 {
+		repo, ok := GetECRRepository(j.destInfo)
+		if !ok {
+			return fmt.Errorf("%v requires an ECR destination", SCAN_ON_PUSH_WAIT_SECONDS)
+		}
+		client, err := NewECRClient(ctx, repo.Region)
+		if err != nil {
+			return err
+		}
+		if err := WaitForScanOnPush(ctx, client, repo, time.Duration(scanOnPushWait)*time.Second, destRepositoryPollInterval); err != nil {
+			return err
+		}
+	}
+
+	replicationRegions, err := getStrListPropsDefault(j.props, ENSURE_REPLICATION_REGIONS)
+	if err != nil {
+		return err
+	}
+	if len(replicationRegions) > 0 {
+		repo, ok := GetECRRepository(j.destInfo)
+		if !ok {
+			return fmt.Errorf("%v requires an ECR destination", ENSURE_REPLICATION_REGIONS)
+		}
+		client, err := NewECRClient(ctx, repo.Region)
+		if err != nil {
+			return err
+		}
+		added, err := EnsureReplication(ctx, client, repo, replicationRegions)
+		if err != nil {
+			return err
+		}
+		if len(added) > 0 {
+			log.Printf("Added replication of %v to %v", repo.Name, strings.Join(added, ", "))
+		}
+	}
+
+	pruneOlderThan, err := getStrPropsDefault(j.props, PRUNE_OLDER_THAN, "")
+	if err != nil {
+		return err
+	}
+	if pruneOlderThan != "" {
+		age, err := parsePruneOlderThan(pruneOlderThan)
+		if err != nil {
+			return err
+		}
+		repo, ok := GetECRRepository(j.destInfo)
+		if !ok {
+			return fmt.Errorf("%v requires an ECR destination", PRUNE_OLDER_THAN)
+		}
+		client, err := NewECRClient(ctx, repo.Region)
+		if err != nil {
+			return err
+		}
+		pruned, err := PruneTags(ctx, client, repo, j.destInfo.Tag, time.Now().Add(-age))
+		if err != nil {
+			return err
+		}
+		log.Printf("Pruned %d tags of %v pushed more than %v ago: %v", len(pruned), repo.Name, age, strings.Join(pruned, ", "))
+		b, err := json.Marshal(append([]string{}, pruned...))
+		if err != nil {
+			return err
+		}
+		j.data["PrunedTags"] = string(b)
+	}
+
+	returnDestTags, err := getBoolPropsDefault(j.props, RETURN_DEST_TAGS, false)
+	if err != nil {
+		return err
+	}
+	if returnDestTags {
+		// Custom resource responses are limited to 4KB, keep the list short.
+		limit, err := getIntPropsDefault(j.props, RETURN_DEST_TAGS_LIMIT, defaultReturnDestTagsLimit)
+		if err != nil {
+			return err
+		}
+		tags, truncated, err := ListTags(ctx, j.destCtx, j.destRef, limit)
+		if err != nil {
+			return fmt.Errorf("listing destination tags failed: %s", err.Error())
+		}
+		if truncated {
+			loggerFrom(ctx).Warnf("Destination has more than %d tags, returning the first %d", limit, limit)
+		}
+		j.data["DestRepositoryTags"] = strings.Join(tags, ",")
+		j.data["DestRepositoryTagsTruncated"] = truncated
+	}
+	return nil
+}
+
+// findDestPullThroughCacheRule looks up the pull through cache rule covering
+// an ECR destination. It is only called after a failed push, and lookup
+// errors are ignored so they don't hide the original error.
+func findDestPullThroughCacheRule(ctx context.Context, destInfo ImageRefInfo) *ecrtypes.PullThroughCacheRule {
+	repo, ok := GetECRRepository(destInfo)
+	if !ok {
+		return nil
+	}
+	client, err := NewECRClient(ctx, repo.Region)
+	if err != nil {
+		return nil
+	}
+	rule, err := FindPullThroughCacheRule(ctx, client, repo)
+	if err != nil {
+		loggerFrom(ctx).Debugf("Looking up pull through cache rules failed: %v", err)
+		return nil
+	}
+	return rule
 }
 
 func main() {
-	lambda.Start(cfn.LambdaWrap(handler))
+	ttl, err := parseDedupTTL(os.Getenv(EnvDedupTTL))
+	if err != nil {
+		log.Fatal(err)
+	}
+	requestStore, err = NewRequestStore(os.Getenv(EnvDedupStore), ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxCopies, err := parseMaxConcurrentCopies(os.Getenv(EnvMaxConcurrentCopies))
+	if err != nil {
+		log.Fatal(err)
+	}
+	copyLimit = newCopyLimiter(maxCopies)
+	maxInflight, err := parseMaxInflightBytes(os.Getenv(EnvMaxInflightBytes))
+	if err != nil {
+		log.Fatal(err)
+	}
+	inflightLimit = newByteLimiter(maxInflight)
+	totalBudget, err = parseTotalBudget(os.Getenv(EnvTotalBudget))
+	if err != nil {
+		log.Fatal(err)
+	}
+	lambda.Start(dispatch)
+}
+
+// dropUnusedCreds returns creds, or nothing if ref isn't a registry image and
+// would never use them, so an unused secret isn't fetched.
+func dropUnusedCreds(creds string, ref types.ImageReference, prop string) string {
+	if creds == "" || ref.Transport().Name() == docker.Transport.Name() {
+		return creds
+	}
+	log.Printf("Ignoring %v, %v isn't a registry image", prop, transports.ImageName(ref))
+	return ""
 }
 
-func newTimeoutContext() (context.Context, context.CancelFunc) {
-	ctx := context.Background()
+// getECRLimits returns the ECR limits to check the source against, with the
+// defaults overridden by the ECRMax* props.
+func getECRLimits(props map[string]interface{}) (ECRLimits, error) {
+	limits := defaultECRLimits
+	maxLayers, err := getIntPropsDefault(props, ECR_MAX_LAYERS, limits.MaxLayers)
+	if err != nil {
+		return limits, err
+	}
+	maxLayerSize, err := getIntPropsDefault(props, ECR_MAX_LAYER_SIZE, int(limits.MaxLayerSize))
+	if err != nil {
+		return limits, err
+	}
+	maxManifestSize, err := getIntPropsDefault(props, ECR_MAX_MANIFEST_SIZE, int(limits.MaxManifestBytes))
+	if err != nil {
+		return limits, err
+	}
+	limits.MaxLayers, limits.MaxLayerSize, limits.MaxManifestBytes = maxLayers, int64(maxLayerSize), int64(maxManifestSize)
+	return limits, nil
+}
+
+// detachedContext has the values of its parent, e.g. the logger of the
+// request, but neither its deadline nor its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+func newTimeoutContext(parent context.Context) (context.Context, context.CancelFunc) {
+	var ctx context.Context = detachedContext{parent: parent}
 	var cancel context.CancelFunc = func() {}
+	if deadline, ok := budgetDeadline(parent); ok {
+		ctx, cancel = withBudgetDeadline(ctx, deadline)
+	}
 	return ctx, cancel
 }
 
-func newPolicyContext() (*signature.PolicyContext, error) {
-	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+// usePlainHTTP lets sys, the system context of ref, talk plain HTTP to its
+// registry if the prop flag is set. containers/image only falls back to HTTP
+// when TLS verification is off, so this also skips verification for
+// registries that do answer HTTPS.
+func usePlainHTTP(ctx context.Context, props map[string]interface{}, prop string, ref types.ImageReference, sys *types.SystemContext) error {
+	plainHTTP, err := getBoolPropsDefault(props, prop, false)
+	if err != nil || !plainHTTP {
+		return err
+	}
+	if ref.Transport().Name() != docker.Transport.Name() {
+		return fmt.Errorf("%v requires a docker image", prop)
+	}
+	loggerFrom(ctx).Warnf("%v is set: talking to %v over plain HTTP without TLS, credentials and images are sent unencrypted",
+		prop, reference.Domain(ref.DockerReference()))
+	sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	return nil
+}
+
+func parsePruneOlderThan(s string) (time.Duration, error) {
+	age, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %v: %v", PRUNE_OLDER_THAN, err)
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("%v must be positive", PRUNE_OLDER_THAN)
+	}
+	return age, nil
+}
+
+// verifyInSync records in data whether the image destRef points to is source,
+// without copying anything. A missing destination isn't in sync.
+func verifyInSync(ctx context.Context, destCtx *types.SystemContext, destRef types.ImageReference, source *SourceInfo, compareLayers bool, data map[string]interface{}) error {
+	var differences []string
+	dest, err := InspectSource(ctx, destCtx, destRef, 0)
+	if err != nil {
+		if !isNotFoundError(err) && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("reading destination manifest failed: %s", err.Error())
+		}
+		differences = []string{"destination does not exist"}
+	} else {
+		data["DestManifestDigest"] = dest.Digest.String()
+		differences = CompareImages(source, dest, compareLayers)
+	}
+	b, err := json.Marshal(append([]string{}, differences...))
+	if err != nil {
+		return err
+	}
+	data["InSync"] = len(differences) == 0
+	data["Differences"] = string(b)
+	if len(differences) > 0 {
+		loggerFrom(ctx).Warnf("Destination %v is not in sync with the source: %s", transports.ImageName(destRef), strings.Join(differences, "; "))
+		data["Result"] = "verified: not in sync"
+	} else {
+		log.Printf("Destination %v is in sync with the source", transports.ImageName(destRef))
+		data["Result"] = "verified: in sync"
+	}
+	return nil
+}
+
+// useDockerDaemonHost points a docker-daemon source at the daemon of the
+// SrcDockerDaemonHost prop, e.g. unix:///var/run/docker.sock or
+// tcp://127.0.0.1:2375. Without it, DOCKER_HOST or the default socket is used.
+func useDockerDaemonHost(props map[string]interface{}, ref types.ImageReference, sys *types.SystemContext) error {
+	host, err := getStrPropsDefault(props, SRC_DOCKER_DAEMON_HOST, "")
+	if err != nil || host == "" {
+		return err
+	}
+	if !isDockerDaemon(ref) {
+		return fmt.Errorf("%v requires a docker-daemon SrcImage", SRC_DOCKER_DAEMON_HOST)
+	}
+	sys.DockerDaemonHost = host
+	return nil
+}
+
+// defaultDockerDaemonHost is the daemon the docker client library uses when
+// neither SrcDockerDaemonHost nor DOCKER_HOST is set.
+const defaultDockerDaemonHost = "unix:///var/run/docker.sock"
+
+func isDockerDaemon(ref types.ImageReference) bool {
+	return ref.Transport().Name() == daemon.Transport.Name()
+}
+
+// dockerDaemonHost returns the daemon a docker-daemon reference is read from.
+func dockerDaemonHost(sys *types.SystemContext) string {
+	if sys.DockerDaemonHost != "" {
+		return sys.DockerDaemonHost
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	return defaultDockerDaemonHost
+}
+
+// newPolicyContext returns a policy context for policyJSON, which is either a
+// policy document or the path of one. An empty policyJSON accepts any image.
+func newPolicyContext(policyJSON string) (*signature.PolicyContext, error) {
+	var policy *signature.Policy
+	var err error
+	switch {
+	case policyJSON == "":
+		policy = &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	case strings.HasPrefix(strings.TrimSpace(policyJSON), "{"):
+		policy, err = signature.NewPolicyFromBytes([]byte(policyJSON))
+	default:
+		policy, err = signature.NewPolicyFromFile(policyJSON)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err.Error())
+	}
 	return signature.NewPolicyContext(policy)
 }
 
@@ -154,6 +1451,99 @@ func getStrPropsDefault(m map[string]interface{}, k string, d string) (string, e
 	return "", fmt.Errorf("can't get %v", k)
 }
 
+// getStrMapPropsDefault returns a property holding a string to string map,
+// given either as an object or as its JSON encoding.
+func getStrMapPropsDefault(m map[string]interface{}, k string) (map[string]string, error) {
+	switch v := m[k].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		var val map[string]string
+		if err := json.Unmarshal([]byte(v), &val); err != nil {
+			return nil, fmt.Errorf("can't parse %v: %v", k, err.Error())
+		}
+		return val, nil
+	case map[string]interface{}:
+		val := make(map[string]string, len(v))
+		for mk, mv := range v {
+			str, ok := mv.(string)
+			if !ok {
+				return nil, fmt.Errorf("can't get %v: value of %v is not a string", k, mk)
+			}
+			val[mk] = str
+		}
+		return val, nil
+	}
+	return nil, fmt.Errorf("can't get %v", k)
+}
+
+// getStrListPropsDefault returns the list property k, given either as a
+// list or as a JSON encoded array.
+func getStrListPropsDefault(m map[string]interface{}, k string) ([]string, error) {
+	switch v := m[k].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		var val []string
+		if err := json.Unmarshal([]byte(v), &val); err != nil {
+			return nil, fmt.Errorf("can't parse %v: %v", k, err.Error())
+		}
+		return val, nil
+	case []interface{}:
+		val := make([]string, 0, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("can't get %v: item %d is not a string", k, i)
+			}
+			val = append(val, str)
+		}
+		return val, nil
+	}
+	return nil, fmt.Errorf("can't get %v", k)
+}
+
+func getBoolPropsDefault(m map[string]interface{}, k string, d bool) (bool, error) {
+	switch v := m[k].(type) {
+	case nil:
+		return d, nil
+	case bool:
+		return v, nil
+	case string:
+		// CloudFormation passes all custom resource properties as strings
+		val, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("can't parse %v: %v", k, err.Error())
+		}
+		return val, nil
+	}
+	return false, fmt.Errorf("can't get %v", k)
+}
+
+func getIntPropsDefault(m map[string]interface{}, k string, d int) (int, error) {
+	switch v := m[k].(type) {
+	case nil:
+		return d, nil
+	case float64:
+		return int(v), nil
+	case int:
+		return v, nil
+	case string:
+		val, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("can't parse %v: %v", k, err.Error())
+		}
+		return val, nil
+	}
+	return 0, fmt.Errorf("can't get %v", k)
+}
+
 func parseCreds(creds string) (string, error) {
 	credsType := GetCredsType(creds)
 	if creds == "" {
@@ -162,6 +1552,19 @@ func parseCreds(creds string) (string, error) {
 		secret, err := GetSecret(creds)
 		return secret, err
 	} else if credsType == SECRET_TEXT {
+		if strings.HasPrefix(strings.TrimSpace(creds), "{") {
+			c, err := ParseCreds(creds)
+			if err != nil {
+				return "", err
+			}
+			if c.VaultPath != "" {
+				secret, err := ReadVaultSecret(c.VaultPath)
+				if err != nil {
+					return "", err
+				}
+				return mergeVaultCreds(c, secret)
+			}
+		}
 		return creds, nil
 	}
 	return "", fmt.Errorf("unkown creds type")
@@ -4,13 +4,37 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	_ "cdk-ecr-deployment-handler/s3"
 )
@@ -40,9 +64,9 @@ func TestMain(t *testing.T) {
 	destCtx, err := destOpts.NewSystemContext()
 	assert.NoError(t, err)
 
-	ctx, cancel := newTimeoutContext()
+	ctx, cancel := newTimeoutContext(context.Background())
 	defer cancel()
-	policyContext, err := newPolicyContext()
+	policyContext, err := newPolicyContext("")
 	assert.NoError(t, err)
 	defer policyContext.Destroy()
 
@@ -53,3 +77,1248 @@ func TestMain(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestGetBoolPropsDefault(t *testing.T) {
+	props := map[string]interface{}{
+		"StrTrue":  "true",
+		"StrFalse": "false",
+		"Bool":     true,
+		"Invalid":  "maybe",
+		"Number":   1,
+	}
+
+	v, err := getBoolPropsDefault(props, "StrTrue", false)
+	assert.NoError(t, err)
+	assert.True(t, v)
+	v, err = getBoolPropsDefault(props, "StrFalse", true)
+	assert.NoError(t, err)
+	assert.False(t, v)
+	v, err = getBoolPropsDefault(props, "Bool", false)
+	assert.NoError(t, err)
+	assert.True(t, v)
+	v, err = getBoolPropsDefault(props, "Missing", true)
+	assert.NoError(t, err)
+	assert.True(t, v)
+
+	_, err = getBoolPropsDefault(props, "Invalid", false)
+	assert.Error(t, err)
+	_, err = getBoolPropsDefault(props, "Number", false)
+	assert.Error(t, err)
+}
+
+func TestGetECRLimits(t *testing.T) {
+	limits, err := getECRLimits(map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultECRLimits, limits)
+
+	limits, err = getECRLimits(map[string]interface{}{ECR_MAX_LAYERS: "200", ECR_MAX_MANIFEST_SIZE: "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, ECRLimits{MaxLayers: 200, MaxLayerSize: defaultECRLimits.MaxLayerSize}, limits)
+
+	_, err = getECRLimits(map[string]interface{}{ECR_MAX_LAYER_SIZE: "big"})
+	assert.Error(t, err)
+}
+
+func TestResolveDestImageTemplate(t *testing.T) {
+	event := cfn.Event{
+		StackID: "arn:aws:cloudformation:us-east-1:123456789012:stack/my-stack/guid",
+		ResourceProperties: map[string]interface{}{
+			SRC_IMAGE:           "docker://nginx:latest",
+			DEST_IMAGE_TEMPLATE: "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/{stackName}:latest",
+		},
+	}
+	props, err := resolveDestImageTemplate(context.Background(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/my-stack:latest", props[DEST_IMAGE])
+	_, ok := event.ResourceProperties[DEST_IMAGE]
+	assert.False(t, ok, "event properties must not be modified")
+
+	event.ResourceProperties[DEST_IMAGE_TEMPLATE] = "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/{stackName}:{unknown}"
+	_, err = resolveDestImageTemplate(context.Background(), event)
+	assert.Error(t, err)
+
+	event.ResourceProperties[DEST_IMAGE_TEMPLATE] = "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/{stackName}::"
+	_, err = resolveDestImageTemplate(context.Background(), event)
+	assert.Error(t, err)
+
+	event.ResourceProperties[SRC_IMAGE] = "docker://nginx:1.25"
+	event.ResourceProperties[DEST_IMAGE_TEMPLATE] = "docker://{destRegistry}/mirror/{srcPath}:{srcTag}"
+	props, err = resolveDestImageTemplate(context.Background(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/mirror/library/nginx:1.25", props[DEST_IMAGE])
+
+	event.ResourceProperties[DEST_IMAGE] = "docker://nginx:latest"
+	_, err = resolveDestImageTemplate(context.Background(), event)
+	assert.Error(t, err)
+}
+
+// writeDirImage writes a single-layer v2s2 image in the dir: transport layout
+// and returns the path and the manifest digest.
+func writeDirImage(t *testing.T, config map[string]interface{}) (string, digest.Digest) {
+	return writeDirImageLayers(t, config, 1)
+}
+
+// writeDirImageLayers writes an image with n layers of a file each.
+func writeDirImageLayers(t *testing.T, config map[string]interface{}, n int) (string, digest.Digest) {
+	path := filepath.Join(t.TempDir(), "image")
+	require.NoError(t, os.MkdirAll(path, 0755))
+	writeBlob := func(b []byte) digest.Digest {
+		d := digest.FromBytes(b)
+		require.NoError(t, os.WriteFile(filepath.Join(path, d.Encoded()), b, 0644))
+		return d
+	}
+
+	var diffIDs []string
+	var layers []map[string]interface{}
+	for i := 0; i < n; i++ {
+		var layerTar bytes.Buffer
+		tw := tar.NewWriter(&layerTar)
+		content := []byte("hello")
+		if i > 0 {
+			content = []byte(fmt.Sprintf("hello %d", i))
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		var layer bytes.Buffer
+		gw := gzip.NewWriter(&layer)
+		_, err = gw.Write(layerTar.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+		diffIDs = append(diffIDs, digest.FromBytes(layerTar.Bytes()).String())
+		layers = append(layers, map[string]interface{}{
+			"mediaType": manifest.DockerV2Schema2LayerMediaType,
+			"size":      layer.Len(),
+			"digest":    writeBlob(layer.Bytes()),
+		})
+	}
+
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	config["architecture"] = "amd64"
+	config["os"] = "linux"
+	config["rootfs"] = map[string]interface{}{
+		"type":     "layers",
+		"diff_ids": diffIDs,
+	}
+	configBytes, err := json.Marshal(config)
+	require.NoError(t, err)
+	configDigest := writeBlob(configBytes)
+
+	m, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifest.DockerV2Schema2MediaType,
+		"config": map[string]interface{}{
+			"mediaType": manifest.DockerV2Schema2ConfigMediaType,
+			"size":      len(configBytes),
+			"digest":    configDigest,
+		},
+		"layers": layers,
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "manifest.json"), m, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "version"), []byte("Directory Transport Version: 1.1\n"), 0644))
+	return path, digest.FromBytes(m)
+}
+
+func TestHandleImagesResolvedDigest(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	destPath := filepath.Join(t.TempDir(), "dest")
+
+	data := make(map[string]interface{})
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + destPath,
+	}, data)
+	require.NoError(t, err)
+	assert.Equal(t, srcDigest.String(), data["SrcResolvedDigest"])
+	assert.Equal(t, "copied", data["Result"])
+	assert.FileExists(t, filepath.Join(destPath, "manifest.json"))
+}
+
+func TestHandleImagesSameImage(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	props := map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + srcPath,
+	}
+
+	err := handleImages(context.Background(), props, make(map[string]interface{}))
+	assert.Error(t, err)
+
+	props[FORCE] = "true"
+	data := make(map[string]interface{})
+	err = handleImages(context.Background(), props, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "skipped: source and destination are the same", data["Result"])
+}
+
+func TestHandleImagesCreated(t *testing.T) {
+	srcPath, _ := writeDirImage(t, map[string]interface{}{"created": "2023-01-02T03:04:05Z"})
+	data := make(map[string]interface{})
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, data)
+	require.NoError(t, err)
+	assert.Equal(t, "2023-01-02T03:04:05Z", data["SrcCreated"])
+	assert.NotEmpty(t, data["CopiedAt"])
+
+	srcPath, _ = writeDirImage(t, nil)
+	data = make(map[string]interface{})
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, data)
+	require.NoError(t, err)
+	assert.NotContains(t, data, "SrcCreated")
+}
+
+func TestHandleImagesDisabled(t *testing.T) {
+	t.Setenv(EnvDisableCopies, "true")
+	data := make(map[string]interface{})
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "docker://nginx:latest",
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "skipped: copies disabled", data["Result"])
+
+	t.Setenv(EnvDisableCopies, "yes please")
+	err = handleImages(context.Background(), map[string]interface{}{}, data)
+	assert.Error(t, err)
+}
+
+func TestGetStrMapPropsDefault(t *testing.T) {
+	props := map[string]interface{}{
+		"Object":  map[string]interface{}{"docker.io": "secret"},
+		"JSON":    `{"docker.io": "secret"}`,
+		"Invalid": map[string]interface{}{"docker.io": 1},
+	}
+
+	v, err := getStrMapPropsDefault(props, "Object")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"docker.io": "secret"}, v)
+	v, err = getStrMapPropsDefault(props, "JSON")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"docker.io": "secret"}, v)
+	v, err = getStrMapPropsDefault(props, "Missing")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	_, err = getStrMapPropsDefault(props, "Invalid")
+	assert.Error(t, err)
+}
+
+func TestGetStrListPropsDefault(t *testing.T) {
+	props := map[string]interface{}{
+		"List":    []interface{}{"a", "b"},
+		"JSON":    `["a", "b"]`,
+		"Invalid": []interface{}{"a", 1},
+	}
+
+	v, err := getStrListPropsDefault(props, "List")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, v)
+	v, err = getStrListPropsDefault(props, "JSON")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, v)
+	v, err = getStrListPropsDefault(props, "Missing")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	_, err = getStrListPropsDefault(props, "Invalid")
+	assert.Error(t, err)
+}
+
+func TestNewPolicyContext(t *testing.T) {
+	pc, err := newPolicyContext("")
+	require.NoError(t, err)
+	assert.NoError(t, pc.Destroy())
+
+	pc, err = newPolicyContext(`{"default": [{"type": "reject"}]}`)
+	require.NoError(t, err)
+	assert.NoError(t, pc.Destroy())
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"default": [{"type": "insecureAcceptAnything"}]}`), 0644))
+	pc, err = newPolicyContext(path)
+	require.NoError(t, err)
+	assert.NoError(t, pc.Destroy())
+
+	_, err = newPolicyContext(`{"default": [{"type": "trustEveryone"}]}`)
+	assert.Error(t, err)
+	_, err = newPolicyContext(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestHandleImagesPolicy(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+		POLICY:     `{"default": [{"type": "reject"}]}`,
+	}, make(map[string]interface{}))
+	assert.Error(t, err)
+}
+
+func TestHandleImagesSkipsExistingBlobs(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	destPath := filepath.Join(t.TempDir(), "dest")
+	props := map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "oci:" + destPath + ":latest",
+	}
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), props, data))
+	assert.Equal(t, 0, data["BlobsSkipped"])
+
+	data = make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), props, data))
+	assert.Equal(t, 1, data["BlobsSkipped"])
+}
+
+func TestHandleImagesForeignLayers(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	// Turn the layer into a Windows-style foreign layer.
+	b, err := os.ReadFile(filepath.Join(srcPath, "manifest.json"))
+	require.NoError(t, err)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	layer := m["layers"].([]interface{})[0].(map[string]interface{})
+	layer["mediaType"] = manifest.DockerV2Schema2ForeignLayerMediaType
+	layer["urls"] = []string{"https://mcr.microsoft.com/v2/windows/servercore/blobs/" + layer["digest"].(string)}
+	b, err = json.Marshal(m)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "manifest.json"), b, 0644))
+	layerBlob := strings.TrimPrefix(layer["digest"].(string), "sha256:")
+
+	for _, download := range []bool{false, true} {
+		destPath := filepath.Join(t.TempDir(), "dest")
+		props := map[string]interface{}{
+			SRC_IMAGE:               "dir:" + srcPath,
+			DEST_IMAGE:              "oci:" + destPath + ":latest",
+			DOWNLOAD_FOREIGN_LAYERS: strconv.FormatBool(download),
+		}
+		require.NoError(t, handleImages(context.Background(), props, make(map[string]interface{})))
+		_, err := os.Stat(filepath.Join(destPath, "blobs", "sha256", layerBlob))
+		if download {
+			assert.NoError(t, err, "foreign layer should be pushed")
+		} else {
+			assert.True(t, os.IsNotExist(err), "foreign layer should be left as a reference")
+		}
+	}
+}
+
+func TestHandleImagesCompression(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	destPath := filepath.Join(t.TempDir(), "dest")
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          "dir:" + srcPath,
+		DEST_IMAGE:         "oci:" + destPath + ":latest",
+		COMPRESSION_FORMAT: "zstd",
+	}, data))
+	assert.Contains(t, data, "CompressionBytesSaved")
+
+	ref, err := alltransports.ParseImageName("oci:" + destPath + ":latest")
+	require.NoError(t, err)
+	dest, err := InspectSource(context.Background(), nil, ref, 0)
+	require.NoError(t, err)
+	assert.Contains(t, string(dest.Manifest), "tar+zstd")
+}
+
+func TestHandleImagesMaxImageAge(t *testing.T) {
+	srcPath, _ := writeDirImage(t, map[string]interface{}{"created": "2023-01-02T03:04:05Z"})
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          "dir:" + srcPath,
+		DEST_IMAGE:         "dir:" + filepath.Join(t.TempDir(), "dest"),
+		MAX_IMAGE_AGE_DAYS: "30",
+	}, make(map[string]interface{}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds max of 30")
+
+	srcPath, _ = writeDirImage(t, nil)
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          "dir:" + srcPath,
+		DEST_IMAGE:         "dir:" + filepath.Join(t.TempDir(), "dest"),
+		MAX_IMAGE_AGE_DAYS: "30",
+	}, make(map[string]interface{}))
+	assert.NoError(t, err)
+}
+
+func TestHandleImagesAllowedSourceMediaTypes(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	for allowed, ok := range map[string]bool{`["v2s2"]`: true, `["oci"]`: false} {
+		err := handleImages(context.Background(), map[string]interface{}{
+			SRC_IMAGE:                  "dir:" + srcPath,
+			DEST_IMAGE:                 "dir:" + filepath.Join(t.TempDir(), "dest"),
+			ALLOWED_SOURCE_MEDIA_TYPES: allowed,
+		}, make(map[string]interface{}))
+		if ok {
+			assert.NoError(t, err, allowed)
+		} else {
+			assert.EqualError(t, err, "unsupported source media type "+manifest.DockerV2Schema2MediaType, allowed)
+		}
+	}
+}
+
+func TestHandleImagesVerifyAfterPush(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:               "dir:" + srcPath,
+		DEST_IMAGE:              "dir:" + filepath.Join(t.TempDir(), "dest"),
+		VERIFY_AFTER_PUSH:       "true",
+		VERIFY_LAYER_AFTER_PUSH: "true",
+	}, data))
+	assert.Equal(t, srcDigest.String(), data["VerifiedDigest"])
+}
+
+func TestHandleImagesReturnLayerInfo(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:         "dir:" + srcPath,
+		DEST_IMAGE:        "dir:" + filepath.Join(t.TempDir(), "dest"),
+		RETURN_LAYER_INFO: "true",
+	}, data))
+	var layers []LayerInfo
+	require.NoError(t, json.Unmarshal([]byte(data["LayerInfo"].(string)), &layers))
+	require.Len(t, layers, 1)
+	assert.NotEmpty(t, layers[0].Digest)
+	assert.Greater(t, layers[0].Size, int64(0))
+	assert.NotEmpty(t, layers[0].MediaType)
+
+	data = make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, data))
+	assert.NotContains(t, data, "LayerInfo")
+}
+
+func TestHandleImagesManifestAnnotations(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	annotations := `{"org.opencontainers.image.source": "https://github.com/example/app", "org.opencontainers.image.created": "2023-01-02T03:04:05Z"}`
+
+	destPath := filepath.Join(t.TempDir(), "dest")
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:            "dir:" + srcPath,
+		DEST_IMAGE:           "oci:" + destPath + ":latest",
+		MANIFEST_ANNOTATIONS: annotations,
+		VERIFY_AFTER_PUSH:    "true",
+	}, data))
+	ref, err := alltransports.ParseImageName("oci:" + destPath + ":latest")
+	require.NoError(t, err)
+	dest, err := InspectSource(context.Background(), nil, ref, 0)
+	require.NoError(t, err)
+	var m struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	require.NoError(t, json.Unmarshal(dest.Manifest, &m))
+	assert.Equal(t, "https://github.com/example/app", m.Annotations["org.opencontainers.image.source"])
+	assert.Equal(t, "2023-01-02T03:04:05Z", m.Annotations["org.opencontainers.image.created"])
+	assert.Equal(t, dest.Digest.String(), data["DestManifestDigest"])
+	assert.Equal(t, dest.Digest.String(), data["VerifiedDigest"])
+
+	// v2s2 destinations are left as they are.
+	destPath = filepath.Join(t.TempDir(), "dest")
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:            "dir:" + srcPath,
+		DEST_IMAGE:           "dir:" + destPath,
+		MANIFEST_ANNOTATIONS: annotations,
+	}, make(map[string]interface{})))
+	b, err := os.ReadFile(filepath.Join(destPath, "manifest.json"))
+	require.NoError(t, err)
+	assert.Equal(t, srcDigest, digest.FromBytes(b))
+
+	archivePath := filepath.Join(t.TempDir(), "dest.tar")
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:            "dir:" + srcPath,
+		DEST_IMAGE:           "oci-archive:" + archivePath,
+		MANIFEST_ANNOTATIONS: annotations,
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, "ManifestAnnotations can't be added to oci-archive or docker-archive destinations")
+	assert.NoFileExists(t, archivePath)
+}
+
+// writeDirLayerless writes a manifest without layers in dir: transport
+// layout, like a FROM scratch image with only metadata or a config-only OCI
+// artifact.
+func writeDirLayerless(t *testing.T, mediaType, configMediaType string, config []byte) string {
+	path := filepath.Join(t.TempDir(), "image")
+	require.NoError(t, os.MkdirAll(path, 0755))
+	configDigest := digest.FromBytes(config)
+	require.NoError(t, os.WriteFile(filepath.Join(path, configDigest.Encoded()), config, 0644))
+	m, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaType,
+		"config": map[string]interface{}{
+			"mediaType": configMediaType,
+			"size":      len(config),
+			"digest":    configDigest,
+		},
+		"layers": []interface{}{},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "manifest.json"), m, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "version"), []byte("Directory Transport Version: 1.1\n"), 0644))
+	return path
+}
+
+func TestHandleImagesMinimalImages(t *testing.T) {
+	scratchPath, _ := writeDirImage(t, nil)
+	images := map[string]string{
+		"single layer scratch": scratchPath,
+		"no layers": writeDirLayerless(t, manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema2ConfigMediaType,
+			[]byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)),
+		"config-only artifact": writeDirLayerless(t, "application/vnd.oci.image.manifest.v1+json", "application/vnd.example.config.v1+json",
+			[]byte(`{"name":"example"}`)),
+	}
+	for name, srcPath := range images {
+		for _, dest := range []string{
+			"dir:" + filepath.Join(t.TempDir(), "dest"),
+			"oci:" + filepath.Join(t.TempDir(), "dest") + ":latest",
+		} {
+			data := make(map[string]interface{})
+			err := handleImages(context.Background(), map[string]interface{}{
+				SRC_IMAGE:               "dir:" + srcPath,
+				DEST_IMAGE:              dest,
+				VERIFY_AFTER_PUSH:       "true",
+				VERIFY_LAYER_AFTER_PUSH: "true",
+				COMPRESSION_FORMAT:      "zstd",
+				MAX_IMAGE_AGE_DAYS:      "30",
+			}, data)
+			assert.NoError(t, err, "%s to %s", name, dest)
+			assert.Equal(t, "copied", data["Result"], "%s to %s", name, dest)
+		}
+	}
+}
+
+func TestHandlerDeduplicates(t *testing.T) {
+	t.Cleanup(func() { requestStore = nil })
+	requestStore = NewMemoryRequestStore(time.Hour)
+	srcPath, _ := writeDirImage(t, nil)
+	event := cfn.Event{
+		RequestType: cfn.RequestCreate,
+		RequestID:   "request-1",
+		ResourceProperties: map[string]interface{}{
+			SRC_IMAGE:  "dir:" + srcPath,
+			DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+		},
+	}
+
+	// A skipped copy isn't recorded, so it copies when delivered again.
+	t.Setenv(EnvDisableCopies, "true")
+	_, data, err := handler(context.Background(), event)
+	require.NoError(t, err)
+	assert.Equal(t, "skipped: copies disabled", data["Result"])
+
+	t.Setenv(EnvDisableCopies, "false")
+	_, data, err = handler(context.Background(), event)
+	require.NoError(t, err)
+	assert.Equal(t, "copied", data["Result"])
+
+	_, data, err = handler(context.Background(), event)
+	require.NoError(t, err)
+	assert.Equal(t, "skipped: duplicate request", data["Result"])
+}
+
+func TestHandlerLogsEventAtDebug(t *testing.T) {
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+
+	event := cfn.Event{RequestType: cfn.RequestDelete, ResourceProperties: map[string]interface{}{}}
+	_, _, err := handler(context.Background(), event)
+	assert.NoError(t, err)
+	assert.NotContains(t, out.String(), "Event:")
+
+	event.ResourceProperties[LOG_LEVEL] = "debug"
+	_, _, err = handler(context.Background(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(out.String(), "Event:"))
+}
+
+func TestRequestLogger(t *testing.T) {
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.InfoLevel)
+
+	debug := requestLogger("debug")
+	assert.Equal(t, logrus.DebugLevel, debug.GetLevel())
+	warn := requestLogger("warn")
+	// The level of one request doesn't change the others'.
+	assert.Equal(t, logrus.InfoLevel, logrus.GetLevel())
+	debug.Debug("debug request")
+	warn.Info("warn request")
+	logrus.Debug("standard logger")
+	assert.Contains(t, out.String(), "debug request")
+	assert.NotContains(t, out.String(), "warn request")
+	assert.NotContains(t, out.String(), "standard logger")
+
+	assert.Same(t, logrus.StandardLogger(), requestLogger("loud"))
+	assert.Same(t, logrus.StandardLogger(), requestLogger(""))
+
+	assert.Same(t, logrus.StandardLogger(), loggerFrom(context.Background()))
+	assert.Same(t, debug, loggerFrom(withLogger(context.Background(), debug)))
+	// The copy keeps the logger of its request.
+	ctx, cancel := newTimeoutContext(withLogger(context.Background(), debug))
+	defer cancel()
+	assert.Same(t, debug, loggerFrom(ctx))
+}
+
+// newPushRegistry starts a registry that accepts pushes to any repository,
+// keeping manifests by tag and by digest.
+func newPushRegistry(t *testing.T) *httptest.Server {
+	server := httptest.NewTLSServer(pushRegistryHandler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func pushRegistryHandler() http.Handler {
+	var mu sync.Mutex
+	blobs := make(map[string][]byte)
+	uploads := make(map[string][]byte)
+	manifests := make(map[string][]byte)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := r.URL.Path
+		switch {
+		case path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPost:
+			id := strconv.Itoa(len(uploads))
+			uploads[id] = nil
+			w.Header().Set("Location", path+id)
+			w.WriteHeader(http.StatusAccepted)
+		case strings.Contains(path, "/blobs/uploads/"):
+			id := path[strings.LastIndex(path, "/")+1:]
+			body, _ := io.ReadAll(r.Body)
+			uploads[id] = append(uploads[id], body...)
+			if r.Method == http.MethodPatch {
+				w.Header().Set("Location", path)
+				w.Header().Set("Range", fmt.Sprintf("0-%d", len(uploads[id])-1))
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			d := r.URL.Query().Get("digest")
+			blobs[d] = uploads[id]
+			w.Header().Set("Docker-Content-Digest", d)
+			w.WriteHeader(http.StatusCreated)
+		case strings.Contains(path, "/blobs/"):
+			b, ok := blobs[path[strings.LastIndex(path, "/")+1:]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.Write(b)
+		case strings.Contains(path, "/manifests/"):
+			ref := path[strings.LastIndex(path, "/")+1:]
+			repo := path[:strings.LastIndex(path, "/manifests/")]
+			if r.Method == http.MethodPut {
+				m, _ := io.ReadAll(r.Body)
+				d := digest.FromBytes(m)
+				manifests[repo+"/"+ref] = m
+				manifests[repo+"/"+d.String()] = m
+				w.Header().Set("Docker-Content-Digest", d.String())
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			m, ok := manifests[repo+"/"+ref]
+			if !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`))
+				return
+			}
+			w.Header().Set("Content-Type", manifest.GuessMIMEType(m))
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(m).String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(m)))
+			w.Write(m)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestHandleImagesAlsoTagWithDigest(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	server := newPushRegistry(t)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(map[string]string{"username": "user", "password": "pass", "caBundle": ca})
+	require.NoError(t, err)
+	destImage := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:v1"
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:            "dir:" + srcPath,
+		DEST_IMAGE:           destImage,
+		DEST_CREDS:           string(creds),
+		ALSO_TAG_WITH_DIGEST: "true",
+	}, data))
+	assert.Equal(t, destImage, data["DestTagReference"])
+	digestImage := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test@" + srcDigest.String()
+	assert.Equal(t, digestImage, data["DestDigestReference"])
+
+	opts := NewImageOpts(destImage)
+	opts.SetCreds(string(creds))
+	defer opts.Close()
+	sys, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	for _, image := range []string{destImage, digestImage} {
+		ref, err := alltransports.ParseImageName(image)
+		require.NoError(t, err)
+		dgst, exists, err := GetManifestDigest(context.Background(), sys, ref)
+		require.NoError(t, err)
+		assert.True(t, exists, image)
+		assert.Equal(t, srcDigest, dgst)
+	}
+
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:            "dir:" + srcPath,
+		DEST_IMAGE:           "dir:" + filepath.Join(t.TempDir(), "dest"),
+		ALSO_TAG_WITH_DIGEST: "true",
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, "AlsoTagWithDigest requires a docker destination")
+}
+
+func TestHandleImagesUsePlainHTTP(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	server := httptest.NewServer(pushRegistryHandler())
+	defer server.Close()
+	image := "docker://" + strings.TrimPrefix(server.URL, "http://") + "/test:v1"
+
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: image,
+	}, make(map[string]interface{}))
+	assert.Error(t, err)
+
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:           "dir:" + srcPath,
+		DEST_IMAGE:          image,
+		DEST_USE_PLAIN_HTTP: "true",
+	}, make(map[string]interface{})))
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          image,
+		DEST_IMAGE:         "dir:" + filepath.Join(t.TempDir(), "dest"),
+		SRC_USE_PLAIN_HTTP: "true",
+	}, data))
+	assert.Equal(t, srcDigest.String(), data["SrcResolvedDigest"])
+
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          "dir:" + srcPath,
+		DEST_IMAGE:         "dir:" + filepath.Join(t.TempDir(), "dest"),
+		SRC_USE_PLAIN_HTTP: "true",
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, "SrcUsePlainHTTP requires a docker image")
+}
+
+func TestHandleImagesDestinationThrottled(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	var uploads int32
+	registry := pushRegistryHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/uploads/") && r.Method == http.MethodPost {
+			atomic.AddInt32(&uploads, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors": [{"code": "TOOMANYREQUESTS", "message": "Rate exceeded"}]}`))
+			return
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:           "dir:" + srcPath,
+		DEST_IMAGE:          "docker://" + strings.TrimPrefix(server.URL, "http://") + "/test:v1",
+		DEST_USE_PLAIN_HTTP: "true",
+	}, make(map[string]interface{}))
+	require.Error(t, err)
+	var throttled *ThrottledError
+	assert.True(t, errors.As(err, &throttled))
+	assert.Equal(t, "destination", throttled.Side)
+	assert.Contains(t, err.Error(), "copy image failed: destination persistently throttled after 5 attempts, reduce the number of concurrent copies")
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&uploads), int32(registryThrottleAttempts))
+}
+
+func TestHandleImagesSourceThrottled(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	m, err := os.ReadFile(filepath.Join(srcPath, "manifest.json"))
+	require.NoError(t, err)
+	var parsed struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	require.NoError(t, json.Unmarshal(m, &parsed))
+	var throttle int32
+	registry := pushRegistryHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A 429 without an error body, for the layer only so the source can
+		// still be inspected.
+		if atomic.LoadInt32(&throttle) == 1 && r.Method == http.MethodGet && r.URL.Path == "/v2/src/blobs/"+parsed.Layers[0].Digest {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:           "dir:" + srcPath,
+		DEST_IMAGE:          "docker://" + host + "/src:v1",
+		DEST_USE_PLAIN_HTTP: "true",
+	}, make(map[string]interface{})))
+	atomic.StoreInt32(&throttle, 1)
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          "docker://" + host + "/src:v1",
+		SRC_USE_PLAIN_HTTP: "true",
+		DEST_IMAGE:         "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, make(map[string]interface{}))
+	require.Error(t, err)
+	var throttled *ThrottledError
+	require.True(t, errors.As(err, &throttled))
+	assert.Equal(t, "source", throttled.Side)
+	assert.Contains(t, err.Error(), "copy image failed: source persistently throttled after 5 attempts")
+	assert.NotContains(t, err.Error(), EnvMaxConcurrentCopies)
+}
+
+func TestHandleImagesTagAndDigest(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	server := newPushRegistry(t)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(map[string]string{"username": "user", "password": "pass", "caBundle": ca})
+	require.NoError(t, err)
+	repo := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test"
+
+	// A destination pinning both is pushed to the tag.
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: repo + ":v1@" + srcDigest.String(),
+		DEST_CREDS: string(creds),
+	}, data))
+	assert.Equal(t, "v1", data["DestTag"])
+
+	// The source must resolve to the pinned digest.
+	other := digest.FromString("other")
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: repo + ":v2@" + other.String(),
+		DEST_CREDS: string(creds),
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, fmt.Sprintf("DestImage pins digest %v, but the source resolves to %v", other, srcDigest))
+
+	// A source pinning both is pulled by digest and keeps its tag.
+	data = make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  repo + ":v1@" + srcDigest.String(),
+		SRC_CREDS:  string(creds),
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, data))
+	assert.Equal(t, "v1", data["SrcTag"])
+	assert.Equal(t, srcDigest.String(), data["SrcDigest"])
+	assert.Equal(t, srcDigest.String(), data["SrcResolvedDigest"])
+}
+
+func TestHandleImagesUnusedCreds(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	// The secrets don't exist, fetching them would fail.
+	data := make(map[string]interface{})
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		SRC_CREDS:  "arn:aws:secretsmanager:us-east-1:123456789012:secret:missing-src",
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+		DEST_CREDS: "arn:aws:secretsmanager:us-east-1:123456789012:secret:missing-dest",
+	}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "copied", data["Result"])
+}
+
+func TestHandleImagesMaxConfigSize(t *testing.T) {
+	// The default limit is the most containers/image reads.
+	srcPath, _ := writeDirImage(t, map[string]interface{}{
+		"config": map[string]interface{}{"Env": []string{"HUGE=" + strings.Repeat("x", maxConfigSizeLimit)}},
+	})
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, make(map[string]interface{}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds the max config size of 4194304 bytes")
+
+	srcPath, _ = writeDirImage(t, nil)
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:       "dir:" + srcPath,
+		DEST_IMAGE:      "dir:" + filepath.Join(t.TempDir(), "dest"),
+		MAX_CONFIG_SIZE: "16",
+	}, make(map[string]interface{}))
+	require.Error(t, err)
+	assert.Regexp(t, `source config is \d+ bytes, exceeds the max config size of 16 bytes`, err.Error())
+
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:       "dir:" + srcPath,
+		DEST_IMAGE:      "dir:" + filepath.Join(t.TempDir(), "dest"),
+		MAX_CONFIG_SIZE: "8388608",
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, "MaxConfigSize must be between 1 and 4194304 bytes")
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:       "dir:" + srcPath,
+		DEST_IMAGE:      "dir:" + filepath.Join(t.TempDir(), "dest"),
+		MAX_CONFIG_SIZE: "65536",
+	}, data))
+	assert.Equal(t, "copied", data["Result"])
+}
+
+func TestHandleImagesDestChanged(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	otherPath, otherDigest := writeDirImage(t, map[string]interface{}{"config": map[string]interface{}{"User": "nobody"}})
+	server := newPushRegistry(t)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(map[string]string{"username": "user", "password": "pass", "caBundle": ca})
+	require.NoError(t, err)
+	destImage := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:v1"
+
+	for _, tc := range []struct {
+		src     string
+		digest  digest.Digest
+		changed bool
+	}{
+		{srcPath, srcDigest, true},
+		{srcPath, srcDigest, false},
+		{otherPath, otherDigest, true},
+	} {
+		data := make(map[string]interface{})
+		require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+			SRC_IMAGE:  "dir:" + tc.src,
+			DEST_IMAGE: destImage,
+			DEST_CREDS: string(creds),
+		}, data))
+		assert.Equal(t, tc.digest.String(), data["DestManifestDigest"])
+		assert.Equal(t, tc.changed, data["DestChanged"])
+	}
+
+	// Destinations that can't be looked up don't report it.
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, data))
+	assert.Equal(t, srcDigest.String(), data["DestManifestDigest"])
+	assert.NotContains(t, data, "DestChanged")
+}
+
+func TestHandleImagesBlobConcurrency(t *testing.T) {
+	srcPath, _ := writeDirImageLayers(t, nil, 6)
+	var mu sync.Mutex
+	var checking, peak int
+	registry := pushRegistryHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/test/blobs/") {
+			mu.Lock()
+			checking++
+			if checking > peak {
+				peak = checking
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			defer func() {
+				mu.Lock()
+				checking--
+				mu.Unlock()
+			}()
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Blobs of dir: images are read one at a time, copy from a registry.
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:           "dir:" + srcPath,
+		DEST_IMAGE:          "docker://" + host + "/src:v1",
+		DEST_USE_PLAIN_HTTP: "true",
+	}, make(map[string]interface{})))
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:           "docker://" + host + "/src:v1",
+		SRC_USE_PLAIN_HTTP:  "true",
+		DEST_IMAGE:          "docker://" + host + "/test:v1",
+		DEST_USE_PLAIN_HTTP: "true",
+		BLOB_CONCURRENCY:    "2",
+	}, data))
+	assert.Equal(t, "copied", data["Result"])
+	assert.Equal(t, 2, peak)
+
+	for _, n := range []string{"-2", "0", "33"} {
+		err := handleImages(context.Background(), map[string]interface{}{
+			SRC_IMAGE:        "dir:" + srcPath,
+			DEST_IMAGE:       "dir:" + filepath.Join(t.TempDir(), "dest"),
+			BLOB_CONCURRENCY: n,
+		}, make(map[string]interface{}))
+		assert.EqualError(t, err, "BlobConcurrency must be between 1 and 32", n)
+	}
+}
+
+func TestHandleImagesDockerDaemon(t *testing.T) {
+	require.NotNil(t, transports.Get("docker-daemon"), "docker-daemon transport is not registered")
+
+	// Nothing listens on the socket, the error names the daemon tried.
+	socket := "unix://" + filepath.Join(t.TempDir(), "docker.sock")
+	err := handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:              "docker-daemon:nginx:latest",
+		SRC_DOCKER_DAEMON_HOST: socket,
+		DEST_IMAGE:             "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, make(map[string]interface{}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is the Docker daemon at "+socket+" running?")
+
+	srcPath, _ := writeDirImage(t, nil)
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:              "dir:" + srcPath,
+		SRC_DOCKER_DAEMON_HOST: socket,
+		DEST_IMAGE:             "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, "SrcDockerDaemonHost requires a docker-daemon SrcImage")
+}
+
+func TestHandleImagesMaxInflightBytes(t *testing.T) {
+	t.Cleanup(func() { inflightLimit = nil })
+	inflightLimit = newByteLimiter(1024)
+	srcPath, _ := writeDirImage(t, nil)
+	props := map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}
+	data := make(map[string]interface{})
+	err := handleImages(context.Background(), props, data)
+	require.NoError(t, err)
+	assert.Equal(t, "copied", data["Result"])
+	assert.Equal(t, int64(0), inflightLimit.used)
+
+	// Another copy holding most of the limit keeps the blobs waiting.
+	require.NoError(t, inflightLimit.Acquire(context.Background(), 1000))
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		inflightLimit.Release(1000)
+	}()
+	require.NoError(t, handleImages(context.Background(), props, make(map[string]interface{})))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, int64(0), inflightLimit.used)
+
+	// A blob larger than the limit fails the copy.
+	inflightLimit = newByteLimiter(16)
+	err = handleImages(context.Background(), props, make(map[string]interface{}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is larger than MAX_INFLIGHT_BYTES 16")
+}
+
+func TestHandleImagesVerifyOnly(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	destPath := filepath.Join(t.TempDir(), "dest")
+	verify := func(destPath string, compareLayers bool) map[string]interface{} {
+		data := make(map[string]interface{})
+		err := handleImages(context.Background(), map[string]interface{}{
+			SRC_IMAGE:          "dir:" + srcPath,
+			DEST_IMAGE:         "dir:" + destPath,
+			VERIFY_ONLY:        "true",
+			VERIFY_ONLY_LAYERS: strconv.FormatBool(compareLayers),
+		}, data)
+		require.NoError(t, err)
+		return data
+	}
+
+	data := verify(destPath, false)
+	assert.Equal(t, false, data["InSync"])
+	assert.Equal(t, `["destination does not exist"]`, data["Differences"])
+	_, err := os.Stat(destPath)
+	assert.True(t, os.IsNotExist(err), "verifying must not copy")
+
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + destPath,
+	}, make(map[string]interface{})))
+	data = verify(destPath, false)
+	assert.Equal(t, true, data["InSync"])
+	assert.Equal(t, `[]`, data["Differences"])
+	assert.Equal(t, srcDigest.String(), data["DestManifestDigest"])
+	assert.Equal(t, "verified: in sync", data["Result"])
+
+	// Same layer, other config.
+	driftedPath, driftedDigest := writeDirImage(t, map[string]interface{}{"config": map[string]interface{}{"User": "nobody"}})
+	data = verify(driftedPath, false)
+	assert.Equal(t, false, data["InSync"])
+	assert.Equal(t, fmt.Sprintf(`["manifest digest %s differs from the source %s"]`, driftedDigest, srcDigest), data["Differences"])
+	assert.Equal(t, "verified: not in sync", data["Result"])
+	data = verify(driftedPath, true)
+	assert.Equal(t, true, data["InSync"])
+}
+
+func TestHandleImagesDestTagSuffix(t *testing.T) {
+	t.Setenv("CODEBUILD_BUILD_NUMBER", "42")
+	srcPath, srcDigest := writeDirImage(t, nil)
+	server := newPushRegistry(t)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(map[string]string{"caBundle": ca})
+	require.NoError(t, err)
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:       "dir:" + srcPath,
+		DEST_IMAGE:      "docker://" + host + "/test:1.0",
+		DEST_CREDS:      string(creds),
+		DEST_TAG_SUFFIX: "-build-${CODEBUILD_BUILD_NUMBER}",
+	}, data))
+	assert.Equal(t, "1.0-build-42", data["DestTag"])
+
+	opts := NewImageOpts("docker://" + host + "/test:1.0-build-42")
+	opts.SetCreds(string(creds))
+	defer opts.Close()
+	sys, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	ref, err := alltransports.ParseImageName("docker://" + host + "/test:1.0-build-42")
+	require.NoError(t, err)
+	dgst, exists, err := GetManifestDigest(context.Background(), sys, ref)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, srcDigest, dgst)
+
+	err = handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:       "dir:" + srcPath,
+		DEST_IMAGE:      "docker://" + host + "/test:1.0",
+		DEST_CREDS:      string(creds),
+		DEST_TAG_SUFFIX: "-${BUILD_ID_NOT_SET}",
+	}, make(map[string]interface{}))
+	assert.EqualError(t, err, `DestTagSuffix: environment variable BUILD_ID_NOT_SET in tag suffix "-${BUILD_ID_NOT_SET}" is not set`)
+}
+
+func TestHandleImagesMixedTransports(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	server := newPushRegistry(t)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(map[string]string{"caBundle": ca})
+	require.NoError(t, err)
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	// Each transport gets a path or repository per copy, the local ones under
+	// a directory named like an ECR host to check nothing logs in to ECR.
+	ecrLikeDir := func() string {
+		dir := filepath.Join(t.TempDir(), "123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		return dir
+	}
+	images := map[string]func(name string) string{
+		"dir": func(name string) string {
+			return "dir:" + filepath.Join(ecrLikeDir(), name)
+		},
+		"oci": func(name string) string {
+			return "oci:" + filepath.Join(ecrLikeDir(), name) + ":latest"
+		},
+		"oci-archive": func(name string) string {
+			return "oci-archive:" + filepath.Join(t.TempDir(), name+".tar")
+		},
+		"docker-archive": func(name string) string {
+			return "docker-archive:" + filepath.Join(t.TempDir(), name+".tar")
+		},
+		"docker": func(name string) string {
+			return "docker://" + host + "/" + name + ":latest"
+		},
+	}
+	transportCreds := func(image string) string {
+		if strings.HasPrefix(image, "docker://") {
+			return string(creds)
+		}
+		return ""
+	}
+	var names []string
+	for transport := range images {
+		names = append(names, transport)
+	}
+	sort.Strings(names)
+
+	for _, src := range names {
+		srcImage := images[src]("src-" + src)
+		if strings.HasPrefix(srcImage, "dir:") {
+			srcImage = "dir:" + srcPath
+		} else {
+			require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+				SRC_IMAGE:  "dir:" + srcPath,
+				DEST_IMAGE: srcImage,
+				DEST_CREDS: transportCreds(srcImage),
+			}, make(map[string]interface{})), src)
+		}
+		for _, dest := range names {
+			destImage := images[dest]("dest-" + src + "-" + dest)
+			data := make(map[string]interface{})
+			err := handleImages(context.Background(), map[string]interface{}{
+				SRC_IMAGE:  srcImage,
+				SRC_CREDS:  transportCreds(srcImage),
+				DEST_IMAGE: destImage,
+				DEST_CREDS: transportCreds(destImage),
+			}, data)
+			require.NoError(t, err, "%v to %v", src, dest)
+			assert.Equal(t, "copied", data["Result"], "%v to %v", src, dest)
+
+			ref, err := alltransports.ParseImageName(destImage)
+			require.NoError(t, err)
+			opts := NewImageOpts(destImage)
+			opts.SetCreds(transportCreds(destImage))
+			sys, err := opts.NewSystemContext()
+			require.NoError(t, err)
+			copied, err := InspectSource(context.Background(), sys, ref, 0)
+			require.NoError(t, err, "%v to %v", src, dest)
+			assert.NotNil(t, copied.Image, "%v to %v", src, dest)
+			opts.Close()
+		}
+	}
+}
+
+func TestHandleImagesDefaultDestRegistry(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	server := newPushRegistry(t)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(map[string]string{"caBundle": ca})
+	require.NoError(t, err)
+	host := strings.TrimPrefix(server.URL, "https://")
+	t.Setenv(EnvDefaultDestRegistry, host)
+
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "test:latest",
+		DEST_CREDS: string(creds),
+	}, data))
+	assert.Equal(t, host, data["DestRegistry"])
+	assert.Equal(t, "test", data["DestRepository"])
+	assert.Equal(t, srcDigest.String(), data["DestManifestDigest"])
+
+	// Images with a transport are left alone.
+	destPath := filepath.Join(t.TempDir(), "dest")
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + destPath,
+	}, make(map[string]interface{})))
+	assert.FileExists(t, filepath.Join(destPath, "manifest.json"))
+}
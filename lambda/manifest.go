@@ -0,0 +1,454 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// manifestFormats maps the DestManifestType values, which follow skopeo's
+// --format flag, to manifest MIME types.
+var manifestFormats = map[string]string{
+	"oci":  imgspecv1.MediaTypeImageManifest,
+	"v2s1": manifest.DockerV2Schema1SignedMediaType,
+	"v2s2": manifest.DockerV2Schema2MediaType,
+}
+
+func ParseManifestFormat(format string) (string, error) {
+	if format == "" {
+		return "", nil
+	}
+	mimeType, ok := manifestFormats[strings.ToLower(format)]
+	if !ok {
+		return "", fmt.Errorf("unknown manifest type %q, expected one of oci, v2s1, v2s2", format)
+	}
+	return mimeType, nil
+}
+
+// CheckSourceMediaType fails unless mimeType, the normalized source
+// manifest type, is in allowed. allowed holds MIME types or the
+// DestManifestType names; an empty allowed accepts any type.
+func CheckSourceMediaType(mimeType string, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, a := range allowed {
+		if t, ok := manifestFormats[strings.ToLower(a)]; ok {
+			a = t
+		}
+		if manifest.NormalizedMIMEType(a) == mimeType {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported source media type %s", mimeType)
+}
+
+// supportedDigestAlgorithms are the DigestAlgorithm values copy.Image can
+// produce. containers/image computes every digest it writes with
+// digest.Canonical, so anything else would be silently ignored.
+var supportedDigestAlgorithms = []digest.Algorithm{digest.SHA256}
+
+func ParseDigestAlgorithm(name string) (digest.Algorithm, error) {
+	if name == "" {
+		return digest.Canonical, nil
+	}
+	alg := digest.Algorithm(strings.ToLower(name))
+	if !alg.Available() {
+		return "", fmt.Errorf("unknown digest algorithm %q, expected one of sha256, sha384, sha512", name)
+	}
+	for _, a := range supportedDigestAlgorithms {
+		if a == alg {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("digest algorithm %s is not supported for copies, only sha256 digests can be written to the destination", alg)
+}
+
+// SourceInfo describes the source image as resolved before copying.
+type SourceInfo struct {
+	Manifest []byte
+	MIMEType string
+	Digest   digest.Digest
+	// InstanceMIMEType is the manifest type of the image that is copied:
+	// MIMEType, or for a manifest list the type of the instance for the
+	// platform of the system.
+	InstanceMIMEType string
+	// Image is the inspected image for the platform being copied, or nil if
+	// it couldn't be inspected.
+	Image *types.ImageInspectInfo
+}
+
+// isArtifact reports whether source is an OCI manifest of something other
+// than a container image, e.g. a config-only artifact, which can't be
+// inspected as an image.
+func isArtifact(source *SourceInfo) bool {
+	if source.MIMEType != imgspecv1.MediaTypeImageManifest {
+		return false
+	}
+	m, err := manifest.OCI1FromManifest(source.Manifest)
+	if err != nil {
+		return false
+	}
+	return m.ArtifactType != "" || m.Config.MediaType != imgspecv1.MediaTypeImageConfig
+}
+
+// CheckImageAge fails if the image created at created is more than maxDays
+// days old at now. Images without a created timestamp only get a warning.
+func CheckImageAge(created *time.Time, maxDays int, now time.Time) error {
+	if created == nil || created.IsZero() {
+		logrus.Warnf("Source image has no created timestamp, can't enforce a max age of %d days", maxDays)
+		return nil
+	}
+	days := int(now.Sub(*created).Hours() / 24)
+	if days > maxDays {
+		return fmt.Errorf("source image is %d days old, exceeds max of %d", days, maxDays)
+	}
+	return nil
+}
+
+// maxConfigSizeLimit is the largest config containers/image reads, a
+// MaxConfigSize above it can't be copied anyway.
+const maxConfigSizeLimit = iolimits.MaxConfigBodySize
+
+// checkMaxConfigSize checks the MaxConfigSize n, in bytes.
+func checkMaxConfigSize(n int) error {
+	if n <= 0 || n > maxConfigSizeLimit {
+		return fmt.Errorf("%v must be between 1 and %d bytes", MAX_CONFIG_SIZE, maxConfigSizeLimit)
+	}
+	return nil
+}
+
+// CheckConfigSize fails if the config of the image manifest m is larger
+// than maxSize, before anything reads it. Manifest lists aren't checked,
+// the config of the instance being copied isn't known from them.
+func CheckConfigSize(m []byte, maxSize int64) error {
+	mimeType := manifest.GuessMIMEType(m)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil
+	}
+	parsed, err := manifest.FromBlob(m, mimeType)
+	if err != nil {
+		return err
+	}
+	if size := parsed.ConfigInfo().Size; size > maxSize {
+		return fmt.Errorf("source config is %d bytes, exceeds the max config size of %d bytes", size, maxSize)
+	}
+	return nil
+}
+
+// InspectSource fetches the top-level manifest of ref and inspects the image
+// that will be copied. Inspection failures are logged rather than returned,
+// the copy itself reports them if they matter. A config larger than
+// maxConfigSize fails before it's read; 0 doesn't limit it.
+func InspectSource(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, maxConfigSize int64) (*SourceInfo, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	m, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mimeType == "" {
+		mimeType = manifest.GuessMIMEType(m)
+	}
+	dgst, err := manifest.Digest(m)
+	if err != nil {
+		return nil, err
+	}
+	info := &SourceInfo{Manifest: m, MIMEType: manifest.NormalizedMIMEType(mimeType), Digest: dgst}
+	info.InstanceMIMEType = info.MIMEType
+	if manifest.MIMETypeIsMultiImage(info.MIMEType) {
+		instanceType, err := instanceMIMEType(ctx, sys, src, m, info.MIMEType)
+		if err != nil {
+			loggerFrom(ctx).Warnf("Choosing the source image for this platform failed: %v", err)
+		} else {
+			info.InstanceMIMEType = instanceType
+		}
+	}
+	if maxConfigSize > 0 {
+		if err := CheckConfigSize(m, maxConfigSize); err != nil {
+			return nil, err
+		}
+	}
+	if isArtifact(info) {
+		loggerFrom(ctx).Infof("Source is an OCI artifact, not inspecting it as an image")
+		return info, nil
+	}
+
+	img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+	if err != nil {
+		loggerFrom(ctx).Warnf("Inspecting source image failed: %v", err)
+		return info, nil
+	}
+	info.Image, err = img.Inspect(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warnf("Inspecting source image failed: %v", err)
+	}
+	return info, nil
+}
+
+// instanceMIMEType returns the manifest type of the instance of the manifest
+// list m that a copy chooses for the platform of sys.
+func instanceMIMEType(ctx context.Context, sys *types.SystemContext, src types.ImageSource, m []byte, mimeType string) (string, error) {
+	list, err := manifest.ListFromBlob(m, mimeType)
+	if err != nil {
+		return "", err
+	}
+	instance, err := list.ChooseInstance(sys)
+	if err != nil {
+		return "", err
+	}
+	im, imType, err := src.GetManifest(ctx, &instance)
+	if err != nil {
+		return "", err
+	}
+	if imType == "" {
+		imType = manifest.GuessMIMEType(im)
+	}
+	return manifest.NormalizedMIMEType(imType), nil
+}
+
+// GetDestinationManifestTypes returns the manifest MIME types ref accepts, or
+// nil if it accepts any. Only registry destinations are checked: opening a
+// local destination already creates the directory or archive file.
+func GetDestinationManifestTypes(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) ([]string, error) {
+	if ref.Transport().Name() != docker.Transport.Name() {
+		return nil, nil
+	}
+	dest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	return dest.SupportedManifestMIMETypes(), nil
+}
+
+// CheckManifestCompatibility reports whether a manifest of srcType can be
+// written to a destination accepting supported, either as-is or converted to
+// forced when set. A non-empty warning means the image will be converted.
+func CheckManifestCompatibility(srcType string, supported []string, forced string) (warning string, err error) {
+	accepts := func(t string) bool {
+		if len(supported) == 0 {
+			return true
+		}
+		for _, s := range supported {
+			if s == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	if forced != "" {
+		if !accepts(forced) {
+			return "", fmt.Errorf("destination doesn't support manifest type %s, it accepts %s", forced, strings.Join(supported, ", "))
+		}
+		if forced != srcType {
+			return fmt.Sprintf("source manifest %s will be converted to %s", srcType, forced), nil
+		}
+		return "", nil
+	}
+	if accepts(srcType) {
+		return "", nil
+	}
+	if manifest.MIMETypeIsMultiImage(srcType) {
+		for _, s := range supported {
+			if manifest.MIMETypeIsMultiImage(s) {
+				return fmt.Sprintf("source manifest list %s will be converted to %s", srcType, s), nil
+			}
+		}
+		return "", fmt.Errorf("source is a manifest list (%s) but the destination only accepts single images (%s); copy a single platform instead", srcType, strings.Join(supported, ", "))
+	}
+	for _, s := range supported {
+		if !manifest.MIMETypeIsMultiImage(s) {
+			return fmt.Sprintf("source manifest %s isn't supported by the destination and will be converted to one of %s", srcType, strings.Join(supported, ", ")), nil
+		}
+	}
+	return "", fmt.Errorf("destination doesn't support source manifest type %s and accepts only %s; set %s to convert it", srcType, strings.Join(supported, ", "), DEST_MANIFEST_TYPE)
+}
+
+func isSchema1(mimeType string) bool {
+	return mimeType == manifest.DockerV2Schema1MediaType || mimeType == manifest.DockerV2Schema1SignedMediaType
+}
+
+// ResolveSchema1Conversion returns the manifest type to force for a registry
+// destination. Registries like ECR reject schema v1 manifests, so a schema v1
+// source is converted to v2s2 when convert is set and rejected otherwise.
+func ResolveSchema1Conversion(srcType string, forced string, convert bool) (string, error) {
+	if !isSchema1(srcType) || (forced != "" && !isSchema1(forced)) {
+		return forced, nil
+	}
+	if !convert {
+		return "", fmt.Errorf("source uses deprecated schema v1 manifest %s; conversion required, set %s to convert it to v2s2", srcType, CONVERT_SCHEMA1)
+	}
+	return manifest.DockerV2Schema2MediaType, nil
+}
+
+// VerifyImage reads the manifest ref points to back and checks it is the one
+// with digest expected. With checkLayer the smallest layer is pulled too and
+// its content checked against its digest.
+func VerifyImage(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, expected digest.Digest, checkLayer bool) error {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	m, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("pulling manifest failed: %v", err)
+	}
+	dgst, err := manifest.Digest(m)
+	if err != nil {
+		return err
+	}
+	if dgst != expected {
+		return fmt.Errorf("manifest digest %s does not match the pushed %s", dgst, expected)
+	}
+	if !checkLayer {
+		return nil
+	}
+
+	parsed, err := manifest.FromBlob(m, manifest.GuessMIMEType(m))
+	if err != nil {
+		return err
+	}
+	layers := parsed.LayerInfos()
+	if len(layers) == 0 {
+		return nil
+	}
+	layer := layers[0].BlobInfo
+	for _, l := range layers[1:] {
+		if l.Size >= 0 && l.Size < layer.Size {
+			layer = l.BlobInfo
+		}
+	}
+	blob, _, err := src.GetBlob(ctx, layer, none.NoCache)
+	if err != nil {
+		return fmt.Errorf("pulling layer %s failed: %v", layer.Digest, err)
+	}
+	defer blob.Close()
+	verifier := layer.Digest.Verifier()
+	if _, err := io.Copy(verifier, blob); err != nil {
+		return fmt.Errorf("pulling layer %s failed: %v", layer.Digest, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("layer %s content does not match its digest", layer.Digest)
+	}
+	return nil
+}
+
+// CompareImages returns how dest differs from src, nothing if they are the
+// same image. With compareLayers, only the layer digests of image manifests
+// are compared, so a destination converted to another manifest type without
+// recompressing its layers is still the same.
+func CompareImages(src, dest *SourceInfo, compareLayers bool) []string {
+	if src.Digest == dest.Digest {
+		return nil
+	}
+	manifestDiff := fmt.Sprintf("manifest digest %s differs from the source %s", dest.Digest, src.Digest)
+	if !compareLayers {
+		return []string{manifestDiff}
+	}
+	srcManifest, srcErr := manifest.FromBlob(src.Manifest, src.MIMEType)
+	destManifest, destErr := manifest.FromBlob(dest.Manifest, dest.MIMEType)
+	if srcErr != nil || destErr != nil {
+		// Manifest lists only have the digests of their instances to compare.
+		return []string{manifestDiff}
+	}
+	srcLayers, destLayers := srcManifest.LayerInfos(), destManifest.LayerInfos()
+	if len(srcLayers) != len(destLayers) {
+		return []string{fmt.Sprintf("destination has %d layers, the source %d", len(destLayers), len(srcLayers))}
+	}
+	var differences []string
+	for i := range srcLayers {
+		if srcLayers[i].Digest != destLayers[i].Digest {
+			differences = append(differences, fmt.Sprintf("layer %d digest %s differs from the source %s", i, destLayers[i].Digest, srcLayers[i].Digest))
+		}
+	}
+	return differences
+}
+
+// AnnotateManifest adds annotations to m, the image manifest just pushed to
+// ref, and pushes the result in its place, returning the new manifest. This
+// changes the image digest. Only OCI manifests have annotations; others are
+// returned unchanged. ref must not be an archive, which would be rewritten
+// with only the manifest.
+func AnnotateManifest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, m []byte, annotations map[string]string) ([]byte, error) {
+	if mimeType := manifest.GuessMIMEType(m); mimeType != imgspecv1.MediaTypeImageManifest {
+		loggerFrom(ctx).Warnf("Destination manifest is %s, which has no annotations; not adding %d annotations", mimeType, len(annotations))
+		return m, nil
+	}
+	var parsed imgspecv1.Manifest
+	if err := json.Unmarshal(m, &parsed); err != nil {
+		return nil, err
+	}
+	if parsed.Annotations == nil {
+		parsed.Annotations = make(map[string]string, len(annotations))
+	}
+	for k, v := range annotations {
+		parsed.Annotations[k] = v
+	}
+	annotated, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	dest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	if err := dest.PutManifest(ctx, annotated, nil); err != nil {
+		return nil, err
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return nil, err
+	}
+	return annotated, nil
+}
+
+// LayerInfo is the entry of one layer in the ReturnLayerInfo output and in
+// copy reports.
+type LayerInfo struct {
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	MediaType string        `json:"mediaType"`
+}
+
+// ManifestLayers returns the layers of the image manifest m, in order.
+// Sizes are as stored, i.e. compressed.
+func ManifestLayers(m []byte) ([]LayerInfo, error) {
+	mimeType := manifest.GuessMIMEType(m)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil, fmt.Errorf("%s is a manifest list, which has no layers", mimeType)
+	}
+	parsed, err := manifest.FromBlob(m, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	infos := parsed.LayerInfos()
+	layers := make([]LayerInfo, 0, len(infos))
+	for _, l := range infos {
+		layers = append(layers, LayerInfo{Digest: l.Digest, Size: l.Size, MediaType: l.MediaType})
+	}
+	return layers, nil
+}
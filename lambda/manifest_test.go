@@ -0,0 +1,218 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseManifestFormat(t *testing.T) {
+	mimeType, err := ParseManifestFormat("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", mimeType)
+	mimeType, err = ParseManifestFormat("OCI")
+	assert.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mimeType)
+	mimeType, err = ParseManifestFormat("v2s2")
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, mimeType)
+	_, err = ParseManifestFormat("v3")
+	assert.Error(t, err)
+}
+
+func TestCheckManifestCompatibility(t *testing.T) {
+	dockerOnly := []string{manifest.DockerV2Schema2MediaType, manifest.DockerV2Schema1SignedMediaType}
+
+	warning, err := CheckManifestCompatibility(imgspecv1.MediaTypeImageManifest, nil, "")
+	assert.NoError(t, err)
+	assert.Empty(t, warning)
+
+	warning, err = CheckManifestCompatibility(manifest.DockerV2Schema2MediaType, dockerOnly, "")
+	assert.NoError(t, err)
+	assert.Empty(t, warning)
+
+	warning, err = CheckManifestCompatibility(imgspecv1.MediaTypeImageManifest, dockerOnly, "")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, warning)
+
+	warning, err = CheckManifestCompatibility(imgspecv1.MediaTypeImageManifest, dockerOnly, manifest.DockerV2Schema2MediaType)
+	assert.NoError(t, err)
+	assert.Contains(t, warning, manifest.DockerV2Schema2MediaType)
+
+	_, err = CheckManifestCompatibility(manifest.DockerV2Schema2MediaType, dockerOnly, imgspecv1.MediaTypeImageManifest)
+	assert.Error(t, err)
+
+	_, err = CheckManifestCompatibility(imgspecv1.MediaTypeImageIndex, dockerOnly, "")
+	assert.Error(t, err)
+
+	warning, err = CheckManifestCompatibility(imgspecv1.MediaTypeImageIndex, append(dockerOnly, manifest.DockerV2ListMediaType), "")
+	assert.NoError(t, err)
+	assert.Contains(t, warning, manifest.DockerV2ListMediaType)
+
+	_, err = CheckManifestCompatibility(manifest.DockerV2Schema2MediaType, []string{manifest.DockerV2ListMediaType}, "")
+	assert.Error(t, err)
+}
+
+func TestInspectSourceInstanceMIMEType(t *testing.T) {
+	// An OCI index of a v2s2 image, which is what a copy writes.
+	srcPath, srcDigest := writeDirImage(t, nil)
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, os.MkdirAll(path, 0755))
+	entries, err := os.ReadDir(srcPath)
+	require.NoError(t, err)
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(srcPath, e.Name()))
+		require.NoError(t, err)
+		name := e.Name()
+		if name == "manifest.json" {
+			name = srcDigest.Encoded() + ".manifest.json"
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(path, name), b, 0644))
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     imgspecv1.MediaTypeImageIndex,
+		"manifests": []map[string]interface{}{{
+			"mediaType": manifest.DockerV2Schema2MediaType,
+			"digest":    srcDigest,
+			"size":      1,
+			"platform":  map[string]string{"architecture": "amd64", "os": "linux"},
+		}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "manifest.json"), index, 0644))
+
+	sys := &types.SystemContext{ArchitectureChoice: "amd64", OSChoice: "linux"}
+	ref, err := alltransports.ParseImageName("dir:" + path)
+	require.NoError(t, err)
+	source, err := InspectSource(context.Background(), sys, ref, 0)
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, source.MIMEType)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, source.InstanceMIMEType)
+	// A destination accepting only single images takes the instance as is.
+	warning, err := CheckManifestCompatibility(source.InstanceMIMEType, []string{manifest.DockerV2Schema2MediaType}, "")
+	assert.NoError(t, err)
+	assert.Empty(t, warning)
+
+	// Without an instance for the platform the list type is kept.
+	source, err = InspectSource(context.Background(), &types.SystemContext{ArchitectureChoice: "s390x", OSChoice: "linux"}, ref, 0)
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, source.InstanceMIMEType)
+
+	srcRef, err := alltransports.ParseImageName("dir:" + srcPath)
+	require.NoError(t, err)
+	source, err = InspectSource(context.Background(), sys, srcRef, 0)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, source.InstanceMIMEType)
+}
+
+func TestResolveSchema1Conversion(t *testing.T) {
+	forced, err := ResolveSchema1Conversion(manifest.DockerV2Schema2MediaType, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", forced)
+
+	_, err = ResolveSchema1Conversion(manifest.DockerV2Schema1SignedMediaType, "", false)
+	assert.EqualError(t, err, "source uses deprecated schema v1 manifest "+manifest.DockerV2Schema1SignedMediaType+"; conversion required, set ConvertSchema1 to convert it to v2s2")
+
+	forced, err = ResolveSchema1Conversion(manifest.DockerV2Schema1MediaType, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, forced)
+
+	forced, err = ResolveSchema1Conversion(manifest.DockerV2Schema1SignedMediaType, imgspecv1.MediaTypeImageManifest, false)
+	assert.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, forced)
+}
+
+func TestParseDigestAlgorithm(t *testing.T) {
+	alg, err := ParseDigestAlgorithm("")
+	assert.NoError(t, err)
+	assert.Equal(t, digest.SHA256, alg)
+	alg, err = ParseDigestAlgorithm("SHA256")
+	assert.NoError(t, err)
+	assert.Equal(t, digest.SHA256, alg)
+	_, err = ParseDigestAlgorithm("sha512")
+	assert.EqualError(t, err, "digest algorithm sha512 is not supported for copies, only sha256 digests can be written to the destination")
+	_, err = ParseDigestAlgorithm("md5")
+	assert.Error(t, err)
+}
+
+func TestCheckImageAge(t *testing.T) {
+	now := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	created := now.Add(-10 * 24 * time.Hour)
+	assert.NoError(t, CheckImageAge(&created, 10, now))
+	assert.EqualError(t, CheckImageAge(&created, 9, now), "source image is 10 days old, exceeds max of 9")
+	assert.NoError(t, CheckImageAge(nil, 1, now))
+	assert.NoError(t, CheckImageAge(&time.Time{}, 1, now))
+}
+
+func TestCheckSourceMediaType(t *testing.T) {
+	allowed := []string{"oci", manifest.DockerV2Schema2MediaType}
+	assert.NoError(t, CheckSourceMediaType(imgspecv1.MediaTypeImageManifest, allowed))
+	assert.NoError(t, CheckSourceMediaType(manifest.DockerV2Schema2MediaType, allowed))
+	assert.EqualError(t, CheckSourceMediaType(manifest.DockerV2ListMediaType, allowed),
+		"unsupported source media type "+manifest.DockerV2ListMediaType)
+	assert.NoError(t, CheckSourceMediaType(manifest.DockerV2ListMediaType, nil))
+}
+
+func TestVerifyImage(t *testing.T) {
+	path, dgst := writeDirImage(t, nil)
+	ref, err := alltransports.ParseImageName("dir:" + path)
+	require.NoError(t, err)
+
+	assert.NoError(t, VerifyImage(context.Background(), nil, ref, dgst, true))
+	assert.Error(t, VerifyImage(context.Background(), nil, ref, digest.FromString("other"), false))
+
+	// Corrupt the layer.
+	m, err := os.ReadFile(filepath.Join(path, "manifest.json"))
+	require.NoError(t, err)
+	parsed, err := manifest.FromBlob(m, manifest.DockerV2Schema2MediaType)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, parsed.LayerInfos()[0].Digest.Encoded()), []byte("corrupt"), 0644))
+	assert.NoError(t, VerifyImage(context.Background(), nil, ref, dgst, false))
+	err = VerifyImage(context.Background(), nil, ref, dgst, true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match its digest")
+}
+
+func TestCompareImages(t *testing.T) {
+	image := func(layers ...string) *SourceInfo {
+		var descriptors []map[string]interface{}
+		for _, l := range layers {
+			descriptors = append(descriptors, map[string]interface{}{
+				"mediaType": manifest.DockerV2Schema2LayerMediaType,
+				"digest":    digest.FromString(l).String(),
+				"size":      len(l),
+			})
+		}
+		m, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     manifest.DockerV2Schema2MediaType,
+			"config":        map[string]interface{}{"mediaType": manifest.DockerV2Schema2ConfigMediaType, "digest": digest.FromString(strings.Join(layers, "")).String(), "size": 2},
+			"layers":        descriptors,
+		})
+		require.NoError(t, err)
+		return &SourceInfo{Manifest: m, MIMEType: manifest.DockerV2Schema2MediaType, Digest: digest.FromBytes(m)}
+	}
+	src := image("a", "b")
+	assert.Empty(t, CompareImages(src, image("a", "b"), false))
+	assert.Len(t, CompareImages(src, image("a", "c"), false), 1)
+	assert.Equal(t, []string{fmt.Sprintf("layer 1 digest %s differs from the source %s", digest.FromString("c"), digest.FromString("b"))},
+		CompareImages(src, image("a", "c"), true))
+	assert.Equal(t, []string{"destination has 1 layers, the source 2"}, CompareImages(src, image("a"), true))
+}
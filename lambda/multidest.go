@@ -0,0 +1,142 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// stagedPolicy accepts the staged copy of the source, which was already
+// checked against the configured policy when it was pulled.
+const stagedPolicy = `{"default":[{"type":"insecureAcceptAnything"}]}`
+
+// sourceProps are the props about reading the source. They apply to the
+// pull into the staging directory, and are dropped from the pushes, whose
+// source is the staged copy.
+var sourceProps = []string{
+	SRC_CREDS,
+	SRC_USE_PLAIN_HTTP,
+	SRC_DOCKER_DAEMON_HOST,
+	SUGGEST_SOURCE_TAGS,
+	MAX_CONFIG_SIZE,
+	ALLOWED_SOURCE_MEDIA_TYPES,
+	MAX_IMAGE_AGE_DAYS,
+	SCAN_SEVERITY_THRESHOLD,
+	SCAN_LAMBDA_ARN,
+	EXTRACT_SBOM,
+}
+
+// handleDestImages copies the source to every image in destImages. The
+// source is pulled once into a local directory and pushed from there, so
+// each destination, e.g. the same ECR repository in several regions, only
+// costs an upload. Registry auth is resolved per destination as usual, and
+// DestImagesCreds can give a destination creds other than DestCreds.
+//
+// The result of each destination is recorded in data[DEST_RESULTS], and
+// the manifest digest it was pushed at in data[DEST_DIGESTS]. A
+// failing destination doesn't stop the others; the error lists all of them.
+func handleDestImages(ctx context.Context, props map[string]interface{}, destImages []string, data map[string]interface{}) error {
+	if _, ok := props[DEST_IMAGE]; ok {
+		return fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGE, DEST_IMAGES)
+	}
+
+	stageDir, err := os.MkdirTemp("", "stage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	stageProps := map[string]interface{}{DEST_IMAGE: "dir:" + stageDir}
+	for _, k := range append([]string{SRC_IMAGE, REGISTRY_CREDENTIALS, POLICY}, sourceProps...) {
+		if v, ok := props[k]; ok {
+			stageProps[k] = v
+		}
+	}
+	stageData := make(map[string]interface{})
+	log.Printf("Pulling %v once for %d destinations", props[SRC_IMAGE], len(destImages))
+	// The staged copy isn't one of the destinations the report lists.
+	if err := handleImages(withoutReportLayers(ctx), stageProps, stageData); err != nil {
+		return err
+	}
+	for k, v := range stageData {
+		if strings.HasPrefix(k, "Src") || strings.HasPrefix(k, "SBOM") {
+			data[k] = v
+		}
+	}
+	if stageData["Result"] != "copied" {
+		data["Result"] = stageData["Result"]
+		return nil
+	}
+
+	destImagesCreds, err := getStrMapPropsDefault(props, DEST_IMAGES_CREDS)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]string, len(destImages))
+	digests := make(map[string]string, len(destImages))
+	var failed []string
+	for _, destImage := range destImages {
+		destProps := destImageProps(props, "dir:"+stageDir, destImage, destImagesCreds)
+
+		destData := make(map[string]interface{})
+		if err := handleImages(ctx, destProps, destData); err != nil {
+			log.Printf("Copying to %v failed: %v", destImage, err)
+			results[destImage] = "failed: " + err.Error()
+			failed = append(failed, fmt.Sprintf("%v: %v", destImage, err))
+			continue
+		}
+		log.Printf("Copying to %v: %v", destImage, destData["Result"])
+		results[destImage] = fmt.Sprint(destData["Result"])
+		if dgst, ok := destData["DestManifestDigest"].(string); ok {
+			digests[destImage] = dgst
+		}
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	data[DEST_RESULTS] = string(b)
+	b, err = json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	data[DEST_DIGESTS] = string(b)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("copy failed for %d of %d destinations: %s", len(failed), len(destImages), strings.Join(failed, "; "))
+	}
+	data["Result"] = "copied"
+	return nil
+}
+
+// destImageProps returns the props pushing the staged source to destImage.
+// destImagesCreds, keyed by DestImages entry, overrides DestCreds for the
+// destinations it has an entry for.
+func destImageProps(props map[string]interface{}, stagedImage string, destImage string, destImagesCreds map[string]string) map[string]interface{} {
+	destProps := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		destProps[k] = v
+	}
+	delete(destProps, DEST_IMAGES)
+	delete(destProps, DEST_IMAGES_CREDS)
+	for _, k := range sourceProps {
+		delete(destProps, k)
+	}
+	destProps[SRC_IMAGE] = stagedImage
+	destProps[POLICY] = stagedPolicy
+	destProps[DEST_IMAGE] = destImage
+	if creds, ok := destImagesCreds[destImage]; ok {
+		// RegistryCredentials would win over DestCreds for the registry.
+		// The staged source doesn't need it, so drop it.
+		delete(destProps, REGISTRY_CREDENTIALS)
+		destProps[DEST_CREDS] = creds
+	}
+	return destProps
+}
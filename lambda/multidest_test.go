@@ -0,0 +1,124 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleDestImages(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	dir := t.TempDir()
+	notADir := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(notADir, nil, 0644))
+
+	props := map[string]interface{}{SRC_IMAGE: "dir:" + srcPath}
+	destImages := []string{
+		"oci:" + filepath.Join(dir, "a") + ":latest",
+		"oci:" + filepath.Join(dir, "b") + ":latest",
+	}
+	data := make(map[string]interface{})
+	require.NoError(t, handleDestImages(context.Background(), props, destImages, data))
+	assert.Equal(t, "copied", data["Result"])
+	assert.Equal(t, srcDigest.String(), data["SrcResolvedDigest"])
+	var results map[string]string
+	require.NoError(t, json.Unmarshal([]byte(data[DEST_RESULTS].(string)), &results))
+	assert.Equal(t, map[string]string{destImages[0]: "copied", destImages[1]: "copied"}, results)
+	// oci: destinations convert the manifest, the digest is the pushed one.
+	destRef, err := alltransports.ParseImageName(destImages[0])
+	require.NoError(t, err)
+	dest, err := InspectSource(context.Background(), nil, destRef, 0)
+	require.NoError(t, err)
+	pushed := dest.Digest.String()
+	var digests map[string]string
+	require.NoError(t, json.Unmarshal([]byte(data[DEST_DIGESTS].(string)), &digests))
+	assert.Equal(t, map[string]string{destImages[0]: pushed, destImages[1]: pushed}, digests)
+
+	data = make(map[string]interface{})
+	err = handleDestImages(context.Background(), props, []string{destImages[0], "dir:" + notADir}, data)
+	assert.Error(t, err)
+	require.NoError(t, json.Unmarshal([]byte(data[DEST_RESULTS].(string)), &results))
+	assert.Equal(t, "copied", results[destImages[0]])
+	assert.Contains(t, results["dir:"+notADir], "failed: ")
+	// Only the destinations that were pushed to have a digest.
+	digests = nil
+	require.NoError(t, json.Unmarshal([]byte(data[DEST_DIGESTS].(string)), &digests))
+	assert.Equal(t, map[string]string{destImages[0]: pushed}, digests)
+
+	props[DEST_IMAGE] = destImages[0]
+	assert.Error(t, handleDestImages(context.Background(), props, destImages, data))
+}
+
+func TestHandleDestImagesSourceProps(t *testing.T) {
+	srcPath, srcDigest := writeDirImage(t, nil)
+	server := httptest.NewServer(pushRegistryHandler())
+	defer server.Close()
+	image := "docker://" + strings.TrimPrefix(server.URL, "http://") + "/test:v1"
+	require.NoError(t, handleImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:           "dir:" + srcPath,
+		DEST_IMAGE:          image,
+		DEST_USE_PLAIN_HTTP: "true",
+	}, make(map[string]interface{})))
+
+	dir := t.TempDir()
+	destImages := []string{
+		"oci:" + filepath.Join(dir, "a") + ":latest",
+		"oci:" + filepath.Join(dir, "b") + ":latest",
+	}
+	data := make(map[string]interface{})
+	require.NoError(t, handleDestImages(context.Background(), map[string]interface{}{
+		SRC_IMAGE:          image,
+		SRC_USE_PLAIN_HTTP: "true",
+	}, destImages, data))
+	assert.Equal(t, "copied", data["Result"])
+	assert.Equal(t, srcDigest.String(), data["SrcResolvedDigest"])
+}
+
+func TestDestImageProps(t *testing.T) {
+	props := map[string]interface{}{
+		SRC_IMAGE:         "docker://nginx:1.25",
+		SRC_CREDS:         "src-secret",
+		DEST_CREDS:        "dest-secret",
+		DEST_IMAGES:       []interface{}{"docker://a.example.com/app:1", "docker://b.example.com/app:1"},
+		DEST_IMAGES_CREDS: `{"docker://b.example.com/app:1": "tenant-b-secret"}`,
+	}
+	destImagesCreds, err := getStrMapPropsDefault(props, DEST_IMAGES_CREDS)
+	require.NoError(t, err)
+
+	a := destImageProps(props, "dir:/tmp/stage", "docker://a.example.com/app:1", destImagesCreds)
+	assert.Equal(t, map[string]interface{}{
+		SRC_IMAGE:  "dir:/tmp/stage",
+		POLICY:     stagedPolicy,
+		DEST_IMAGE: "docker://a.example.com/app:1",
+		DEST_CREDS: "dest-secret",
+	}, a)
+
+	props[SRC_USE_PLAIN_HTTP] = "true"
+	props[SCAN_SEVERITY_THRESHOLD] = "critical"
+	a = destImageProps(props, "dir:/tmp/stage", "docker://a.example.com/app:1", destImagesCreds)
+	assert.NotContains(t, a, SRC_USE_PLAIN_HTTP)
+	assert.NotContains(t, a, SCAN_SEVERITY_THRESHOLD)
+
+	b := destImageProps(props, "dir:/tmp/stage", "docker://b.example.com/app:1", destImagesCreds)
+	assert.Equal(t, "docker://b.example.com/app:1", b[DEST_IMAGE])
+	assert.Equal(t, "tenant-b-secret", b[DEST_CREDS])
+
+	props[REGISTRY_CREDENTIALS] = `{"b.example.com": "registry-secret"}`
+	a = destImageProps(props, "dir:/tmp/stage", "docker://a.example.com/app:1", destImagesCreds)
+	assert.Equal(t, props[REGISTRY_CREDENTIALS], a[REGISTRY_CREDENTIALS])
+	b = destImageProps(props, "dir:/tmp/stage", "docker://b.example.com/app:1", destImagesCreds)
+	assert.NotContains(t, b, REGISTRY_CREDENTIALS)
+	assert.Equal(t, "tenant-b-secret", b[DEST_CREDS])
+	assert.Equal(t, "dest-secret", props[DEST_CREDS])
+}
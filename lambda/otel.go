@@ -0,0 +1,297 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	// EnvOTLPEndpoint is the base URL of the OTLP/HTTP collector spans are
+	// exported to, e.g. http://collector:4318. No spans are recorded when
+	// neither it nor EnvOTLPTracesEndpoint is set.
+	EnvOTLPEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	// EnvOTLPTracesEndpoint is the URL spans are posted to, used as is
+	// instead of EnvOTLPEndpoint with /v1/traces appended.
+	EnvOTLPTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	// EnvOTLPHeaders are extra headers of the export requests, e.g. for
+	// authentication, as comma separated key=value pairs.
+	EnvOTLPHeaders = "OTEL_EXPORTER_OTLP_HEADERS"
+	// EnvOTelServiceName is the service.name of the spans. Defaults to the
+	// name of the function.
+	EnvOTelServiceName = "OTEL_SERVICE_NAME"
+	// EnvOTelResourceAttributes are extra resource attributes of the spans,
+	// as comma separated key=value pairs.
+	EnvOTelResourceAttributes = "OTEL_RESOURCE_ATTRIBUTES"
+)
+
+const (
+	otelScope = "cdk-ecr-deployment-handler"
+	// Span kinds and status codes of the OTLP protocol.
+	otelSpanKindInternal = 1
+	otelSpanKindServer   = 2
+	otelStatusOK         = 1
+	otelStatusError      = 2
+)
+
+var otlpClient = &http.Client{Timeout: 5 * time.Second}
+
+type otelAttribute struct {
+	Key   string         `json:"key"`
+	Value otelAttrString `json:"value"`
+}
+
+type otelAttrString struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otelStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otelSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otelAttribute `json:"attributes,omitempty"`
+	Status            *otelStatus     `json:"status,omitempty"`
+}
+
+type traceKey struct{}
+
+// copyTrace records the spans of one copy request: a root span for the
+// request and a span per stage of its copies, see logTiming. A nil
+// copyTrace records nothing.
+type copyTrace struct {
+	endpoint string
+	headers  map[string]string
+	traceID  string
+	rootID   string
+	start    time.Time
+
+	mu    sync.Mutex
+	spans []otelSpan
+}
+
+// startTrace returns ctx recording the spans of a request started at start
+// into the returned copyTrace, or ctx and nil if no OTLP endpoint is set.
+func startTrace(ctx context.Context, start time.Time) (context.Context, *copyTrace) {
+	endpoint := otlpTracesEndpoint()
+	if endpoint == "" {
+		return ctx, nil
+	}
+	t := &copyTrace{
+		endpoint: endpoint,
+		headers:  parseOTelPairs(os.Getenv(EnvOTLPHeaders)),
+		traceID:  randomHex(16),
+		rootID:   randomHex(8),
+		start:    start,
+	}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+// otlpTracesEndpoint returns the URL spans are posted to, or "" if spans
+// aren't exported.
+func otlpTracesEndpoint() string {
+	if endpoint := os.Getenv(EnvOTLPTracesEndpoint); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv(EnvOTLPEndpoint); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// recordSpan records a span named name from start until now as a child of
+// the request ctx belongs to.
+func recordSpan(ctx context.Context, name string, start time.Time) {
+	t, _ := ctx.Value(traceKey{}).(*copyTrace)
+	if t == nil {
+		return
+	}
+	t.add(otelSpan{
+		TraceID:           t.traceID,
+		SpanID:            randomHex(8),
+		ParentSpanID:      t.rootID,
+		Name:              name,
+		Kind:              otelSpanKindInternal,
+		StartTimeUnixNano: unixNano(start),
+		EndTimeUnixNano:   unixNano(time.Now()),
+	})
+}
+
+func (t *copyTrace) add(span otelSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, span)
+}
+
+// end records the root span of the request from report and exports the
+// spans. It returns once they are exported, so none are lost when the
+// function is frozen after the request. Failures are logged.
+func (t *copyTrace) end(ctx context.Context, report CopyReport) {
+	if t == nil {
+		return
+	}
+	root := otelSpan{
+		TraceID:           t.traceID,
+		SpanID:            t.rootID,
+		Name:              "copy request",
+		Kind:              otelSpanKindServer,
+		StartTimeUnixNano: unixNano(t.start),
+		EndTimeUnixNano:   unixNano(time.Now()),
+		Attributes: otelAttributes(map[string]string{
+			"faas.invocation_id":           report.InvocationID,
+			"ecr_deployment.request_id":    report.RequestID,
+			"ecr_deployment.src_image":     fmt.Sprint(report.SrcImage),
+			"ecr_deployment.dest_image":    fmt.Sprint(report.DestImage),
+			"ecr_deployment.result":        report.Result,
+			"cloudformation.stack_id":      report.StackID,
+			"cloudformation.logical_id":    report.LogicalResourceID,
+			"ecr_deployment.src_digest":    fmt.Sprint(report.Data["SrcResolvedDigest"]),
+			"ecr_deployment.dest_digest":   fmt.Sprint(report.Data["DestManifestDigest"]),
+			"ecr_deployment.blobs_copied":  fmt.Sprint(report.Data["BlobsCopied"]),
+			"ecr_deployment.blobs_skipped": fmt.Sprint(report.Data["BlobsSkipped"]),
+		}),
+		Status: &otelStatus{Code: otelStatusOK},
+	}
+	if report.Error != "" {
+		root.Status = &otelStatus{Code: otelStatusError, Message: report.Error}
+	}
+	t.add(root)
+	if err := t.export(ctx); err != nil {
+		loggerFrom(ctx).Warnf("Exporting trace failed: %v", err)
+	}
+}
+
+// export posts the spans to the collector as OTLP/HTTP JSON.
+func (t *copyTrace) export(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.spans
+	t.mu.Unlock()
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otelAttributes(otelResource())},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": otelScope},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	// The request may have run out of time, the export gets its own.
+	req, err := http.NewRequestWithContext(detachedContext{parent: ctx}, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", t.endpoint, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// otelResource returns the resource attributes of the spans: the standard
+// ones of a Lambda function, overridden by OTEL_RESOURCE_ATTRIBUTES and
+// OTEL_SERVICE_NAME.
+func otelResource() map[string]string {
+	attrs := map[string]string{
+		"service.name":   otelScope,
+		"cloud.provider": "aws",
+		"cloud.platform": "aws_lambda",
+		"cloud.region":   os.Getenv("AWS_REGION"),
+		"faas.name":      lambdacontext.FunctionName,
+		"faas.version":   lambdacontext.FunctionVersion,
+	}
+	if lambdacontext.FunctionName != "" {
+		attrs["service.name"] = lambdacontext.FunctionName
+	}
+	for k, v := range parseOTelPairs(os.Getenv(EnvOTelResourceAttributes)) {
+		attrs[k] = v
+	}
+	if name := os.Getenv(EnvOTelServiceName); name != "" {
+		attrs["service.name"] = name
+	}
+	return attrs
+}
+
+// parseOTelPairs parses the comma separated, URL encoded key=value pairs of
+// the OTEL_* variables. Malformed pairs are skipped.
+func parseOTelPairs(s string) map[string]string {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, errK := url.QueryUnescape(strings.TrimSpace(kv[0]))
+		v, errV := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if errK != nil || errV != nil || k == "" {
+			continue
+		}
+		pairs[k] = v
+	}
+	return pairs
+}
+
+// otelAttributes returns attrs in the OTLP encoding, sorted by key, leaving
+// out the empty ones and the values of missing data.
+func otelAttributes(attrs map[string]string) []otelAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		if v != "" && v != "<nil>" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	encoded := make([]otelAttribute, 0, len(keys))
+	for _, k := range keys {
+		encoded = append(encoded, otelAttribute{Key: k, Value: otelAttrString{StringValue: attrs[k]}})
+	}
+	return encoded
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otelAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otelSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestRecordCopyTrace(t *testing.T) {
+	var requests []otlpRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		auth = r.Header.Get("Authorization")
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var req otlpRequest
+		require.NoError(t, json.Unmarshal(body, &req))
+		requests = append(requests, req)
+	}))
+	defer srv.Close()
+	t.Setenv(EnvOTLPEndpoint, srv.URL+"/")
+	t.Setenv(EnvOTLPHeaders, "Authorization=Bearer%20token,malformed")
+	t.Setenv(EnvOTelServiceName, "mirror")
+	t.Setenv(EnvOTelResourceAttributes, "deployment.environment=test")
+
+	srcPath, _ := writeDirImage(t, nil)
+	props := map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: "dir:" + filepath.Join(t.TempDir(), "dest"),
+	}
+	data := make(map[string]interface{})
+	require.NoError(t, recordCopy(context.Background(), copyRequest{RequestID: "c0ffee"}, props, data, func(ctx context.Context) error {
+		return handleImages(ctx, props, data)
+	}))
+	// The spans are exported by the time the request returns.
+	require.Len(t, requests, 1)
+	assert.Equal(t, "Bearer token", auth)
+	resource := map[string]string{}
+	for _, a := range requests[0].ResourceSpans[0].Resource.Attributes {
+		resource[a.Key] = a.Value.StringValue
+	}
+	assert.Equal(t, "mirror", resource["service.name"])
+	assert.Equal(t, "aws_lambda", resource["cloud.platform"])
+	assert.Equal(t, "test", resource["deployment.environment"])
+
+	spans := requests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	root := spans[len(spans)-1]
+	assert.Equal(t, "copy request", root.Name)
+	assert.Equal(t, otelStatusOK, root.Status.Code)
+	assert.Contains(t, root.Attributes, otelAttribute{Key: "ecr_deployment.request_id", Value: otelAttrString{StringValue: "c0ffee"}})
+	var names []string
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, root.TraceID, span.TraceID)
+		assert.Equal(t, root.SpanID, span.ParentSpanID)
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"parse", "credentials", "auth", "manifest", "copy"}, names)
+
+	err := recordCopy(context.Background(), copyRequest{RequestID: "f00d"}, props, make(map[string]interface{}), func(ctx context.Context) error {
+		return errors.New("copy image failed")
+	})
+	assert.Error(t, err)
+	require.Len(t, requests, 2)
+	spans = requests[1].ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, &otelStatus{Code: otelStatusError, Message: "copy image failed"}, spans[0].Status)
+}
+
+func TestStartTraceDisabled(t *testing.T) {
+	t.Setenv(EnvOTLPEndpoint, "")
+	t.Setenv(EnvOTLPTracesEndpoint, "")
+	ctx, trace := startTrace(context.Background(), time.Now())
+	assert.Nil(t, trace)
+	// Nothing is recorded or exported without an endpoint.
+	recordSpan(ctx, "copy", time.Now())
+	trace.end(ctx, CopyReport{})
+
+	t.Setenv(EnvOTLPEndpoint, "http://collector:4318")
+	assert.Equal(t, "http://collector:4318/v1/traces", otlpTracesEndpoint())
+	t.Setenv(EnvOTLPTracesEndpoint, "http://collector:4318/traces")
+	assert.Equal(t, "http://collector:4318/traces", otlpTracesEndpoint())
+}
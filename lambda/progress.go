@@ -0,0 +1,165 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// progressInterval is how often copy.Image reports read progress. Only the
+// per-blob events are used, so it is kept long.
+const progressInterval = time.Minute
+
+// CopyProgress counts the blobs a copy uploaded and the ones it skipped
+// because the destination already had them.
+type CopyProgress struct {
+	ch     chan types.ProgressProperties
+	done   chan struct{}
+	logger *logrus.Logger
+
+	Copied       int
+	CopiedBytes  uint64
+	Skipped      int
+	SkippedBytes uint64
+}
+
+// NewCopyProgress starts consuming progress events. Pass Channel() to
+// copy.Options.Progress and call Close once the copy has returned.
+func NewCopyProgress(ctx context.Context) *CopyProgress {
+	p := &CopyProgress{
+		ch:     make(chan types.ProgressProperties),
+		done:   make(chan struct{}),
+		logger: loggerFrom(ctx),
+	}
+	go func() {
+		defer close(p.done)
+		for e := range p.ch {
+			p.handle(e)
+		}
+	}()
+	return p
+}
+
+func (p *CopyProgress) Channel() chan types.ProgressProperties {
+	return p.ch
+}
+
+func (p *CopyProgress) handle(e types.ProgressProperties) {
+	switch e.Event {
+	case types.ProgressEventSkipped:
+		p.Skipped++
+		if e.Artifact.Size > 0 {
+			p.SkippedBytes += uint64(e.Artifact.Size)
+		}
+		p.logger.Infof("Blob %s already exists in destination, skipped", e.Artifact.Digest)
+	case types.ProgressEventDone:
+		p.Copied++
+		p.CopiedBytes += e.Offset
+	}
+}
+
+// Close waits for all events to be counted. The counters are only valid
+// after Close returns.
+func (p *CopyProgress) Close() {
+	close(p.ch)
+	<-p.done
+}
+
+// BlobChecks times the checks of a copy for whether the destination has a
+// blob already, before it is uploaded.
+type BlobChecks struct {
+	mu       sync.Mutex
+	checked  int
+	duration time.Duration
+}
+
+// Wrap returns ref with the checks of its destinations timed by c.
+func (c *BlobChecks) Wrap(ref types.ImageReference) types.ImageReference {
+	return &blobCheckReference{ImageReference: ref, checks: c}
+}
+
+// Counts returns how many blobs were checked for so far and the time spent
+// in the checks, added up across the ones made at once.
+func (c *BlobChecks) Counts() (checked int, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checked, c.duration
+}
+
+type blobCheckReference struct {
+	types.ImageReference
+	checks *BlobChecks
+}
+
+func (r *blobCheckReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &blobCheckDestination{ImageDestination: dest, checks: r.checks}, nil
+}
+
+type blobCheckDestination struct {
+	types.ImageDestination
+	checks *BlobChecks
+}
+
+// TryReusingBlob is the check, copy.Image calls it for every blob before
+// uploading it.
+func (d *blobCheckDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	start := time.Now()
+	reused, blob, err := d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+	d.checks.mu.Lock()
+	d.checks.checked++
+	d.checks.duration += time.Since(start)
+	d.checks.mu.Unlock()
+	return reused, blob, err
+}
+
+// ReportWriter returns the writer for the copy report, i.e. the "Copying
+// blob" lines, that dest selects: "stdout" (the default), "stderr", or
+// "log:<level>" to log each line at that level with the logger of the
+// request ctx belongs to. Call done once
+// the copy returned; it returns after the last line was logged.
+func ReportWriter(ctx context.Context, dest string) (w io.Writer, done func(), err error) {
+	switch dest {
+	case "", "stdout":
+		return os.Stdout, func() {}, nil
+	case "stderr":
+		return os.Stderr, func() {}, nil
+	}
+	if strings.HasPrefix(dest, "log:") {
+		l, err := logrus.ParseLevel(strings.TrimPrefix(dest, "log:"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid report destination %q: %v", dest, err)
+		}
+		logger := loggerFrom(ctx)
+		pr, pw := io.Pipe()
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			scanner := bufio.NewScanner(pr)
+			for scanner.Scan() {
+				logger.Log(l, scanner.Text())
+			}
+			// Keep reading past a line too long to scan, so writes don't block.
+			io.Copy(io.Discard, pr)
+		}()
+		return pw, func() {
+			pw.Close()
+			<-drained
+		}, nil
+	}
+	return nil, nil, fmt.Errorf("invalid report destination %q, expected stdout, stderr or log:<level>", dest)
+}
@@ -0,0 +1,80 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyProgress(t *testing.T) {
+	p := NewCopyProgress(context.Background())
+	p.Channel() <- types.ProgressProperties{Event: types.ProgressEventNewArtifact, Artifact: types.BlobInfo{Size: 100}}
+	p.Channel() <- types.ProgressProperties{Event: types.ProgressEventRead, Offset: 50, OffsetUpdate: 50}
+	p.Channel() <- types.ProgressProperties{Event: types.ProgressEventDone, Offset: 100}
+	p.Channel() <- types.ProgressProperties{Event: types.ProgressEventSkipped, Artifact: types.BlobInfo{Size: 200}}
+	p.Channel() <- types.ProgressProperties{Event: types.ProgressEventSkipped, Artifact: types.BlobInfo{Size: -1}}
+	p.Close()
+
+	assert.Equal(t, 1, p.Copied)
+	assert.Equal(t, uint64(100), p.CopiedBytes)
+	assert.Equal(t, 2, p.Skipped)
+	assert.Equal(t, uint64(200), p.SkippedBytes)
+}
+
+func TestBlobChecks(t *testing.T) {
+	ref, err := alltransports.ParseImageName("dir:" + t.TempDir())
+	require.NoError(t, err)
+	checks := &BlobChecks{}
+	dest, err := checks.Wrap(ref).NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+
+	for _, d := range []digest.Digest{digest.FromString("a"), digest.FromString("b")} {
+		reused, _, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: d, Size: -1}, nil, false)
+		require.NoError(t, err)
+		assert.False(t, reused)
+	}
+	checked, duration := checks.Counts()
+	assert.Equal(t, 2, checked)
+	assert.Greater(t, int64(duration), int64(0))
+}
+
+func TestReportWriter(t *testing.T) {
+	w, done, err := ReportWriter(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, os.Stdout, w)
+	done()
+	w, done, err = ReportWriter(context.Background(), "stderr")
+	require.NoError(t, err)
+	assert.Equal(t, os.Stderr, w)
+	done()
+
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	w, done, err = ReportWriter(context.Background(), "log:warn")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "Copying blob sha256:abc\nWriting manifest to image destination")
+	require.NoError(t, err)
+	done()
+	// done waits for every line, including the last one without a newline.
+	assert.Contains(t, out.String(), `level=warning msg="Copying blob sha256:abc"`)
+	assert.Contains(t, out.String(), `level=warning msg="Writing manifest to image destination"`)
+
+	for _, dest := range []string{"log:loud", "file:/tmp/report", "STDOUT"} {
+		_, _, err := ReportWriter(context.Background(), dest)
+		assert.Error(t, err, dest)
+	}
+}
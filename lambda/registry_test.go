@@ -0,0 +1,457 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsNotFoundError(t *testing.T) {
+	assert.True(t, isNotFoundError(v2.ErrorCodeManifestUnknown.WithMessage("manifest unknown")))
+	assert.True(t, isNotFoundError(fmt.Errorf("reading manifest latest: %w", v2.ErrorCodeNameUnknown.WithMessage("repository does not exist"))))
+	assert.False(t, isNotFoundError(errcode.ErrorCodeUnauthorized.WithMessage("not authorized")))
+	assert.False(t, isNotFoundError(errors.New("connection refused")))
+}
+
+func TestQualifyImage(t *testing.T) {
+	const registry = "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+	digestStr := "sha256:" + strings.Repeat("0", 64)
+	for image, want := range map[string]string{
+		"my-app:1.0":                      "docker://" + registry + "/my-app:1.0",
+		"team/my-app":                     "docker://" + registry + "/team/my-app",
+		"docker://my-app:1.0":             "docker://my-app:1.0",
+		"dir:/tmp/my-app":                 "dir:/tmp/my-app",
+		"registry.example.com/my-app:1.0": "registry.example.com/my-app:1.0",
+		"localhost:5000/my-app:1.0":       "localhost:5000/my-app:1.0",
+		"localhost/my-app":                "localhost/my-app",
+		"my-app:1.0@" + digestStr:         "docker://" + registry + "/my-app:1.0@" + digestStr,
+	} {
+		qualified, ok, err := QualifyImage(image, registry)
+		require.NoError(t, err, image)
+		assert.Equal(t, want, qualified, image)
+		assert.Equal(t, want != image, ok, image)
+	}
+
+	qualified, ok, err := QualifyImage("my-app:1.0", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "my-app:1.0", qualified)
+
+	_, _, err = QualifyImage("My-App:1.0", registry)
+	assert.Error(t, err)
+}
+
+func TestSuffixedTag(t *testing.T) {
+	env := map[string]string{"CODEBUILD_BUILD_NUMBER": "42", "BRANCH": "feature/x"}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	tag, err := SuffixedTag("1.0", "-build-${CODEBUILD_BUILD_NUMBER}", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0-build-42", tag)
+	tag, err = SuffixedTag("1.0", ".$CODEBUILD_BUILD_NUMBER", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.42", tag)
+
+	_, err = SuffixedTag("1.0", "-${MISSING}", lookup)
+	assert.EqualError(t, err, `environment variable MISSING in tag suffix "-${MISSING}" is not set`)
+	_, err = SuffixedTag("1.0", "-${BRANCH}", lookup)
+	assert.EqualError(t, err, `invalid tag "1.0-feature/x"`)
+}
+
+func TestDigestTag(t *testing.T) {
+	d := digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	tag, err := DigestTag(d, defaultDigestTagPrefix, defaultDigestTagLength)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha-0123456789ab", tag)
+
+	tag, err = DigestTag(d, "", 64)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", tag)
+
+	_, err = DigestTag(d, "sha-", 65)
+	assert.Error(t, err)
+	_, err = DigestTag(d, "sha-", 3)
+	assert.Error(t, err)
+	_, err = DigestTag(d, "-bad", 12)
+	assert.Error(t, err)
+}
+
+func TestWithTag(t *testing.T) {
+	ref, err := alltransports.ParseImageName("docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/test:latest")
+	assert.NoError(t, err)
+	tagged, err := WithTag(ref, "sha-0123456789ab")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/test:sha-0123456789ab", transports.ImageName(tagged))
+
+	ref, err = alltransports.ParseImageName("docker://nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	tagged, err = WithTag(ref, "v1")
+	assert.NoError(t, err)
+	assert.Equal(t, "docker://nginx:v1", transports.ImageName(tagged))
+
+	ref, err = alltransports.ParseImageName("dir:/tmp/nginx")
+	assert.NoError(t, err)
+	_, err = WithTag(ref, "v1")
+	assert.Error(t, err)
+}
+
+func TestSameImage(t *testing.T) {
+	parse := func(s string) types.ImageReference {
+		ref, err := alltransports.ParseImageName(s)
+		assert.NoError(t, err)
+		return ref
+	}
+
+	assert.True(t, SameImage(parse("docker://nginx"), parse("docker://docker.io/library/nginx:latest")))
+	assert.False(t, SameImage(parse("docker://nginx:latest"), parse("docker://nginx:stable")))
+	assert.False(t, SameImage(parse("docker://nginx:latest"), parse("docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/nginx:latest")))
+	assert.True(t, SameImage(parse("dir:/tmp/nginx"), parse("dir:/tmp/nginx")))
+	assert.False(t, SameImage(parse("dir:/tmp/nginx"), parse("oci:/tmp/nginx")))
+}
+
+func TestListTags(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/v2/test/tags/list" && r.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/test/tags/list?last=b>; rel="next"`)
+			w.Write([]byte(`{"name":"test","tags":["b","a"]}`))
+		case r.URL.Path == "/v2/test/tags/list":
+			w.Write([]byte(`{"name":"test","tags":["c"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latest")
+	require.NoError(t, err)
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+
+	tags, truncated, err := ListTags(context.Background(), sys, ref, 0)
+	assert.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, []string{"a", "b", "c"}, tags)
+
+	tags, truncated, err = ListTags(context.Background(), sys, ref, 2)
+	assert.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, []string{"a", "b"}, tags)
+
+	dirRef, err := alltransports.ParseImageName("dir:/tmp/image")
+	require.NoError(t, err)
+	_, _, err = ListTags(context.Background(), sys, dirRef, 0)
+	assert.Error(t, err)
+}
+
+// The docker transport retries 429 responses itself, waiting for as long as
+// Retry-After asks, so registry calls don't need a backoff of their own.
+func TestListTagsRetryAfter(t *testing.T) {
+	var throttled time.Time
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/v2/test/tags/list" && throttled.IsZero():
+			throttled = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/v2/test/tags/list":
+			assert.GreaterOrEqual(t, time.Since(throttled), time.Second)
+			w.Write([]byte(`{"name":"test","tags":["a"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latest")
+	require.NoError(t, err)
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+
+	tags, _, err := ListTags(context.Background(), sys, ref, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, tags)
+	assert.False(t, throttled.IsZero())
+}
+
+func TestSuggestTags(t *testing.T) {
+	tags := []string{"latest", "1.25", "1.25.3", "1.24", "stable", "mainline"}
+	assert.Equal(t, []string{"latest"}, SuggestTags("latests", tags))
+	assert.Equal(t, []string{"1.24", "1.25"}, SuggestTags("1.26", tags))
+	assert.Empty(t, SuggestTags("nightly", tags))
+	assert.Empty(t, SuggestTags("latest", []string{"latest"}))
+}
+
+func TestMissingTagError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/test/tags/list":
+			w.Write([]byte(`{"name":"test","tags":["latest","1.0"]}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latests")
+	require.NoError(t, err)
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	_, err = InspectSource(context.Background(), sys, ref, 0)
+	require.Error(t, err)
+
+	tagErr := missingTagError(context.Background(), sys, ref, "latests", err)
+	assert.EqualError(t, tagErr, "tag 'latests' not found; did you mean 'latest'?")
+	assert.NoError(t, missingTagError(context.Background(), sys, ref, "nightly", err))
+	assert.NoError(t, missingTagError(context.Background(), sys, ref, "latests", errors.New("connection refused")))
+}
+
+func TestWithSourceRegistry(t *testing.T) {
+	dest, err := alltransports.ParseImageName("docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/nginx:1.25")
+	require.NoError(t, err)
+
+	for src, expected := range map[string]string{
+		"docker://nginx:1.25":                      "docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/docker.io/nginx:1.25",
+		"docker://quay.io/team/nginx:1.25":         "docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/quay.io/nginx:1.25",
+		"docker://Registry.Example.com:5000/nginx": "docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/registry.example.com-5000/nginx:1.25",
+	} {
+		srcRef, err := alltransports.ParseImageName(src)
+		require.NoError(t, err)
+		ref, err := WithSourceRegistry(srcRef, dest)
+		require.NoError(t, err, src)
+		assert.Equal(t, expected, transports.ImageName(ref))
+	}
+
+	digested, err := alltransports.ParseImageName("docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/nginx@sha256:" + strings.Repeat("a", 64))
+	require.NoError(t, err)
+	srcRef, err := alltransports.ParseImageName("docker://nginx")
+	require.NoError(t, err)
+	ref, err := WithSourceRegistry(srcRef, digested)
+	require.NoError(t, err)
+	assert.Equal(t, "docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/docker.io/nginx@sha256:"+strings.Repeat("a", 64), transports.ImageName(ref))
+
+	dirRef, err := alltransports.ParseImageName("dir:/tmp/image")
+	require.NoError(t, err)
+	_, err = WithSourceRegistry(dirRef, dest)
+	assert.Error(t, err)
+}
+
+func TestRetryOnUnauthorized(t *testing.T) {
+	expired := docker.ErrUnauthorizedForCredentials{Err: errors.New("authentication required")}
+
+	// The first attempt hits an expired token, the retry uses the new one.
+	token := "expired"
+	attempts := 0
+	err := retryOnUnauthorized(context.Background(), func() error {
+		attempts++
+		if token == "expired" {
+			return fmt.Errorf("writing blob: %w", expired)
+		}
+		return nil
+	}, func() (bool, error) {
+		token = "fresh"
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// Nothing to refresh.
+	attempts = 0
+	err = retryOnUnauthorized(context.Background(), func() error {
+		attempts++
+		return expired
+	}, func() (bool, error) { return false, nil })
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// Other errors aren't retried.
+	attempts = 0
+	err = retryOnUnauthorized(context.Background(), func() error {
+		attempts++
+		return errors.New("connection reset")
+	}, func() (bool, error) { t.Fatal("unexpected refresh"); return false, nil })
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestSplitTagAndDigest(t *testing.T) {
+	const dgst = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	pinned, ok := SplitTagAndDigest("docker://localhost:5000/team/app:1.0@" + dgst)
+	require.True(t, ok)
+	assert.Equal(t, "docker://localhost:5000/team/app:1.0", pinned.TagImage)
+	assert.Equal(t, "docker://localhost:5000/team/app@"+dgst, pinned.DigestImage)
+	assert.Equal(t, "1.0", pinned.Tag)
+	assert.Equal(t, digest.Digest(dgst), pinned.Digest)
+
+	pinned, ok = SplitTagAndDigest("docker://nginx:1.25@" + dgst)
+	require.True(t, ok)
+	assert.Equal(t, "docker://nginx@"+dgst, pinned.DigestImage)
+
+	for _, image := range []string{"docker://nginx:1.25", "docker://nginx@" + dgst, "dir:/tmp/app:1.0@" + dgst, "docker://Invalid:1@" + dgst} {
+		_, ok := SplitTagAndDigest(image)
+		assert.False(t, ok, image)
+	}
+}
+
+func TestIsThrottledError(t *testing.T) {
+	assert.True(t, isThrottledError(fmt.Errorf("reading manifest: %w", docker.ErrTooManyRequests)))
+	assert.True(t, isThrottledError(fmt.Errorf("writing blob: %w", errcode.ErrorCodeTooManyRequests.WithMessage("Rate exceeded"))))
+	assert.True(t, isThrottledError(bareStatusError(t, http.StatusTooManyRequests)))
+	assert.False(t, isThrottledError(bareStatusError(t, http.StatusInternalServerError)))
+	assert.False(t, isThrottledError(errors.New(`writing blob: StatusCode: 429, ""`)))
+	assert.False(t, isThrottledError(errcode.ErrorCodeDenied.WithMessage("denied")))
+}
+
+// bareStatusError returns the error containers/image returns for a
+// registry answering status without an error body.
+func bareStatusError(t *testing.T, status int) error {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latest")
+	require.NoError(t, err)
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	_, _, err = ListTags(context.Background(), sys, ref, 0)
+	require.Error(t, err)
+	return err
+}
+
+func TestNewThrottledError(t *testing.T) {
+	tooMany := errcode.ErrorCodeTooManyRequests.WithMessage("Rate exceeded")
+	for _, tc := range []struct {
+		err  error
+		side string
+	}{
+		{fmt.Errorf("writing blob: %w", withSide(throttledDestination, tooMany)), "destination"},
+		{fmt.Errorf("writing manifest: %w", withSide(throttledDestination, tooMany)), "destination"},
+		{fmt.Errorf("copying layer: %w", withSide(throttledSource, docker.ErrTooManyRequests)), "source"},
+		// Reading the source failed while the destination wrote the blob.
+		{withSide(throttledDestination, fmt.Errorf("happened during read: %w", withSide(throttledSource, docker.ErrTooManyRequests))), "source"},
+		{tooMany, "source"},
+	} {
+		err := newThrottledError(tc.err)
+		var throttled *ThrottledError
+		if assert.True(t, errors.As(err, &throttled), tc.err.Error()) {
+			assert.Equal(t, tc.side, throttled.Side, tc.err.Error())
+			assert.Equal(t, registryThrottleAttempts, throttled.Attempts)
+			assert.True(t, errors.Is(err, tc.err))
+		}
+	}
+	err := errors.New("writing blob: denied")
+	assert.Equal(t, err, newThrottledError(err))
+}
+
+func TestThrottledErrorError(t *testing.T) {
+	err := &ThrottledError{Side: throttledDestination, Attempts: 5, Err: errors.New("too many requests")}
+	assert.EqualError(t, err, "destination persistently throttled after 5 attempts, reduce the number of concurrent copies, e.g. with MAX_CONCURRENT_COPIES: too many requests")
+	err = &ThrottledError{Side: throttledSource, Attempts: 5, Err: errors.New("too many requests")}
+	assert.EqualError(t, err, "source persistently throttled after 5 attempts, retry later or use creds with a higher rate limit: too many requests")
+}
+
+func TestWithSide(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	ref, err := alltransports.ParseImageName("dir:" + srcPath)
+	require.NoError(t, err)
+
+	src, err := WithSide(ref, throttledSource).NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	assert.Equal(t, ref, src.Reference())
+	_, _, err = src.GetBlob(context.Background(), types.BlobInfo{Digest: digest.FromString("missing")}, nil)
+	require.Error(t, err)
+	assert.Equal(t, throttledSource, errorSide(err))
+
+	destRef, err := alltransports.ParseImageName("dir:" + filepath.Join(t.TempDir(), "dest"))
+	require.NoError(t, err)
+	dest, err := WithSide(destRef, throttledDestination).NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	_, _, err = dest.TryReusingBlob(context.Background(), types.BlobInfo{}, nil, false)
+	require.Error(t, err)
+	assert.Equal(t, throttledDestination, errorSide(err))
+}
+
+func TestRetryOnBlobUploadInvalid(t *testing.T) {
+	invalid := fmt.Errorf("writing blob: %w", v2.ErrorCodeBlobUploadInvalid.WithMessage("blob upload invalid"))
+
+	// The first upload is rejected, the retry goes through.
+	attempts := 0
+	err := retryOnBlobUploadInvalid(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return invalid
+		}
+		return nil
+	}, 2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// Retries give up after the configured count.
+	attempts = 0
+	err = retryOnBlobUploadInvalid(context.Background(), func() error {
+		attempts++
+		return invalid
+	}, 2, 0)
+	assert.True(t, isBlobUploadInvalidError(err))
+	assert.Equal(t, 3, attempts)
+
+	// Other errors, or no retries, aren't retried.
+	attempts = 0
+	err = retryOnBlobUploadInvalid(context.Background(), func() error {
+		attempts++
+		return errors.New("connection reset")
+	}, 2, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	attempts = 0
+	assert.Error(t, retryOnBlobUploadInvalid(context.Background(), func() error {
+		attempts++
+		return invalid
+	}, 0, 0))
+	assert.Equal(t, 1, attempts)
+
+	// A done context stops waiting for the retry.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	err = retryOnBlobUploadInvalid(ctx, func() error {
+		attempts++
+		return invalid
+	}, 2, time.Hour)
+	assert.True(t, isBlobUploadInvalidError(err))
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,209 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cdk-ecr-deployment-handler/internal/tarfile"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// EnvCopyReportS3 is the s3://bucket/prefix copy reports are written under.
+const EnvCopyReportS3 = "COPY_REPORT_S3"
+
+// CopyReport is the audit record of one request. Data holds what the
+// request returned, e.g. the resolved digests, and Layers the layers of the
+// images it copied, by destination, whether or not ReturnLayerInfo is set.
+type CopyReport struct {
+	RequestID         string                 `json:"requestId"`
+	InvocationID      string                 `json:"invocationId,omitempty"`
+	StackID           string                 `json:"stackId"`
+	LogicalResourceID string                 `json:"logicalResourceId"`
+	SrcImage          interface{}            `json:"srcImage,omitempty"`
+	DestImage         interface{}            `json:"destImage,omitempty"`
+	Result            string                 `json:"result"`
+	Error             string                 `json:"error,omitempty"`
+	StartedAt         time.Time              `json:"startedAt"`
+	DurationMs        int64                  `json:"durationMs"`
+	Data              map[string]interface{} `json:"data"`
+	Layers            map[string][]LayerInfo `json:"layers,omitempty"`
+}
+
+type reportLayersKey struct{}
+
+// reportLayers collects the layers of the images a request copied for its
+// copy report. A nil reportLayers collects nothing.
+type reportLayers struct {
+	mu     sync.Mutex
+	layers map[string][]LayerInfo
+}
+
+// withReportLayers returns ctx collecting the layers of the copies made
+// with it into the returned reportLayers.
+func withReportLayers(ctx context.Context) (context.Context, *reportLayers) {
+	r := &reportLayers{layers: make(map[string][]LayerInfo)}
+	return context.WithValue(ctx, reportLayersKey{}, r), r
+}
+
+// withoutReportLayers returns ctx for a copy that isn't to a destination of
+// the request, e.g. staging the source, which the report leaves out.
+func withoutReportLayers(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reportLayersKey{}, (*reportLayers)(nil))
+}
+
+// addReportLayers records layers as copied to destImage for the report of
+// the request ctx belongs to.
+func addReportLayers(ctx context.Context, destImage string, layers []LayerInfo) {
+	r, _ := ctx.Value(reportLayersKey{}).(*reportLayers)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.layers[destImage] = layers
+}
+
+// get returns the layers collected so far, or nil if there are none.
+func (r *reportLayers) get() map[string][]LayerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.layers) == 0 {
+		return nil
+	}
+	layers := make(map[string][]LayerInfo, len(r.layers))
+	for k, v := range r.layers {
+		layers[k] = v
+	}
+	return layers
+}
+
+// copyRequest identifies what a copy was made for in its report: a
+// CloudFormation request, or an EventBridge event, which has no stack.
+type copyRequest struct {
+	RequestID         string
+	StackID           string
+	LogicalResourceID string
+}
+
+// cfnCopyRequest returns the copyRequest of a CloudFormation request.
+func cfnCopyRequest(event cfn.Event) copyRequest {
+	return copyRequest{RequestID: event.RequestID, StackID: event.StackID, LogicalResourceID: event.LogicalResourceID}
+}
+
+// NewCopyReport returns the report of req, whose resolved properties are
+// props, handled from start with result data and err.
+func NewCopyReport(ctx context.Context, req copyRequest, props map[string]interface{}, start time.Time, data map[string]interface{}, err error) CopyReport {
+	report := CopyReport{
+		RequestID:         req.RequestID,
+		StackID:           req.StackID,
+		LogicalResourceID: req.LogicalResourceID,
+		SrcImage:          props[SRC_IMAGE],
+		DestImage:         props[DEST_IMAGE],
+		Result:            fmt.Sprint(data["Result"]),
+		StartedAt:         start.UTC(),
+		DurationMs:        time.Since(start).Milliseconds(),
+		Data:              data,
+	}
+	if destImages, ok := props[DEST_IMAGES]; ok {
+		report.DestImage = destImages
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		report.InvocationID = lc.AwsRequestID
+	}
+	if err != nil {
+		report.Result = "failed"
+		report.Error = err.Error()
+	}
+	return report
+}
+
+type s3PutObjectAPIClient interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// CopyReportKey returns where report is written under prefix, a new key
+// for every request so earlier reports are never overwritten.
+func CopyReportKey(prefix string, report CopyReport) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return fmt.Sprintf("%s%s/%s-%s.json", prefix, report.StartedAt.Format("2006/01/02"), report.StartedAt.Format("150405.000"), report.RequestID)
+}
+
+// WriteCopyReport writes report as JSON under uri, an s3://bucket/prefix.
+func WriteCopyReport(ctx context.Context, client s3PutObjectAPIClient, uri string, report CopyReport) error {
+	s3uri, err := tarfile.ParseS3Uri(uri)
+	if err != nil {
+		return err
+	}
+	if s3uri.Bucket == "" {
+		return fmt.Errorf("s3 uri must include a bucket: %v", uri)
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	key := CopyReportKey(s3uri.Key, report)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s3uri.Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(b),
+		ContentLength: int64(len(b)),
+		ContentType:   aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing copy report to s3://%s/%s: %v", s3uri.Bucket, key, err.Error())
+	}
+	log.Printf("Wrote copy report to s3://%s/%s", s3uri.Bucket, key)
+	return nil
+}
+
+// writeCopyReport writes the report of a request to uri. It is best effort:
+// failures are logged and don't fail the request.
+func writeCopyReport(ctx context.Context, uri string, report CopyReport) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warnf("Writing copy report failed: api client configuration error: %v", err)
+		return
+	}
+	if err := WriteCopyReport(ctx, s3.NewFromConfig(cfg), uri, report); err != nil {
+		loggerFrom(ctx).Warnf("Writing copy report failed: %v", err)
+	}
+}
+
+// recordCopy runs copyFn, the copy of req with props, and writes its copy
+// report and audit event if COPY_REPORT_S3 or AUDIT_LOG_GROUP are set, and
+// its trace if an OTLP endpoint is. Every copy, whatever invoked it, goes
+// through here. copyFn has to copy with the
+// ctx it is passed for the report to list the copied layers.
+func recordCopy(ctx context.Context, req copyRequest, props map[string]interface{}, data map[string]interface{}, copyFn func(ctx context.Context) error) error {
+	start := time.Now()
+	ctx, layers := withReportLayers(ctx)
+	ctx, trace := startTrace(ctx, start)
+	err := copyFn(ctx)
+	report := NewCopyReport(ctx, req, props, start, data, err)
+	report.Layers = layers.get()
+	trace.end(ctx, report)
+	if uri := os.Getenv(EnvCopyReportS3); uri != "" {
+		writeCopyReport(ctx, uri, report)
+	}
+	if group := os.Getenv(EnvAuditLogGroup); group != "" {
+		writeAuditEvent(ctx, group, report)
+	}
+	return err
+}
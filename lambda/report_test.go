@@ -0,0 +1,95 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/containers/image/v5/manifest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeS3Client struct {
+	bucket, key string
+	body        []byte
+}
+
+func (c *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	c.bucket, c.key = aws.ToString(params.Bucket), aws.ToString(params.Key)
+	body, err := io.ReadAll(params.Body)
+	c.body = body
+	return &s3.PutObjectOutput{}, err
+}
+
+func TestCopyReport(t *testing.T) {
+	event := cfn.Event{
+		RequestID:         "c0ffee",
+		StackID:           "arn:aws:cloudformation:us-west-2:123456789012:stack/app/guid",
+		LogicalResourceID: "Deploy",
+	}
+	props := map[string]interface{}{SRC_IMAGE: "docker://nginx:1.25", DEST_IMAGE: "docker://registry.example.com/nginx:1.25"}
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "invocation-1"})
+
+	report := NewCopyReport(ctx, cfnCopyRequest(event), props, start, map[string]interface{}{"Result": "copied", "SrcResolvedDigest": "sha256:abc"}, nil)
+	assert.Equal(t, "copied", report.Result)
+	assert.Equal(t, "invocation-1", report.InvocationID)
+	assert.Equal(t, "docker://nginx:1.25", report.SrcImage)
+
+	failed := NewCopyReport(ctx, cfnCopyRequest(event), props, start, map[string]interface{}{}, errors.New("copy image failed"))
+	assert.Equal(t, "failed", failed.Result)
+	assert.Equal(t, "copy image failed", failed.Error)
+
+	client := &fakeS3Client{}
+	require.NoError(t, WriteCopyReport(context.Background(), client, "s3://audit/mirror", report))
+	assert.Equal(t, "audit", client.bucket)
+	assert.Equal(t, "mirror/2023/01/02/030405.000-c0ffee.json", client.key)
+	var written map[string]interface{}
+	require.NoError(t, json.Unmarshal(client.body, &written))
+	assert.Equal(t, "c0ffee", written["requestId"])
+	assert.Equal(t, "sha256:abc", written["data"].(map[string]interface{})["SrcResolvedDigest"])
+
+	assert.Equal(t, "2023/01/02/030405.000-c0ffee.json", CopyReportKey("", report))
+	assert.Error(t, WriteCopyReport(context.Background(), client, "audit/mirror", report))
+}
+
+func TestReportLayers(t *testing.T) {
+	srcPath, _ := writeDirImage(t, nil)
+	destImage := "dir:" + filepath.Join(t.TempDir(), "dest")
+	ctx, layers := withReportLayers(context.Background())
+	data := make(map[string]interface{})
+	require.NoError(t, handleImages(ctx, map[string]interface{}{
+		SRC_IMAGE:  "dir:" + srcPath,
+		DEST_IMAGE: destImage,
+	}, data))
+	// The report has the layers without ReturnLayerInfo, the response doesn't.
+	assert.NotContains(t, data, "LayerInfo")
+	got := layers.get()
+	require.Len(t, got[destImage], 1)
+	assert.Equal(t, manifest.DockerV2Schema2LayerMediaType, got[destImage][0].MediaType)
+
+	// Staging the source for DestImages isn't a destination of the request.
+	ctx, layers = withReportLayers(context.Background())
+	destImages := []string{"dir:" + filepath.Join(t.TempDir(), "a"), "dir:" + filepath.Join(t.TempDir(), "b")}
+	require.NoError(t, handleDestImages(ctx, map[string]interface{}{SRC_IMAGE: "dir:" + srcPath}, destImages, make(map[string]interface{})))
+	got = layers.get()
+	assert.Len(t, got, 2)
+	assert.Contains(t, got, destImages[0])
+	assert.Contains(t, got, destImages[1])
+
+	assert.Nil(t, (&reportLayers{}).get())
+	addReportLayers(context.Background(), destImage, got[destImages[0]])
+	addReportLayers(withoutReportLayers(context.Background()), destImage, got[destImages[0]])
+}
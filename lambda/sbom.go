@@ -0,0 +1,88 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Annotations BuildKit sets on attestation manifests in an image index
+	// and on the in-toto layers of an attestation manifest.
+	attestationReferenceTypeAnnotation = "vnd.docker.reference.type"
+	attestationManifestType            = "attestation-manifest"
+	inTotoPredicateTypeAnnotation      = "in-toto.io/predicate-type"
+)
+
+// SBOMInfo locates an SBOM attestation of the source image.
+type SBOMInfo struct {
+	// ManifestDigest is the attestation manifest in the source index.
+	ManifestDigest digest.Digest
+	// Digest is the SBOM layer of the attestation manifest.
+	Digest        digest.Digest
+	PredicateType string
+	// Location is a reference to the attestation manifest, when the source
+	// is a docker reference.
+	Location string
+}
+
+// isSBOMPredicate reports whether an in-toto predicate type is an SBOM, e.g.
+// https://spdx.dev/Document or https://cyclonedx.org/bom.
+func isSBOMPredicate(predicateType string) bool {
+	return strings.HasPrefix(predicateType, "https://spdx.dev/") || strings.HasPrefix(predicateType, "https://cyclonedx.org/")
+}
+
+// FindSBOM returns the SBOM attested in the source image index, as pushed
+// by BuildKit, or nil if there is none.
+func FindSBOM(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, source *SourceInfo) (*SBOMInfo, error) {
+	if source.MIMEType != imgspecv1.MediaTypeImageIndex {
+		return nil, nil
+	}
+	index, err := manifest.OCI1IndexFromManifest(source.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	for _, d := range index.Manifests {
+		if d.Annotations[attestationReferenceTypeAnnotation] != attestationManifestType {
+			continue
+		}
+		dgst := d.Digest
+		m, _, err := src.GetManifest(ctx, &dgst)
+		if err != nil {
+			return nil, err
+		}
+		attestation, err := manifest.OCI1FromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range attestation.Layers {
+			predicateType := l.Annotations[inTotoPredicateTypeAnnotation]
+			if !isSBOMPredicate(predicateType) {
+				continue
+			}
+			info := &SBOMInfo{ManifestDigest: dgst, Digest: l.Digest, PredicateType: predicateType}
+			if ref.Transport().Name() == docker.Transport.Name() {
+				if named, err := reference.WithDigest(reference.TrimNamed(ref.DockerReference()), dgst); err == nil {
+					info.Location = named.String()
+				}
+			}
+			return info, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,99 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDirIndex writes an OCI index in dir: layout referencing an image and,
+// if predicateType isn't empty, a BuildKit attestation manifest.
+func writeDirIndex(t *testing.T, predicateType string) (string, digest.Digest) {
+	path := filepath.Join(t.TempDir(), "index")
+	require.NoError(t, os.MkdirAll(path, 0755))
+
+	manifests := []map[string]interface{}{{
+		"mediaType": imgspecv1.MediaTypeImageManifest,
+		"digest":    digest.FromString("image"),
+		"size":      5,
+		"platform":  map[string]string{"architecture": "amd64", "os": "linux"},
+	}}
+	sbomDigest := digest.FromString("sbom")
+	if predicateType != "" {
+		attestation, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     imgspecv1.MediaTypeImageManifest,
+			"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": digest.FromString("{}"), "size": 2},
+			"layers": []map[string]interface{}{{
+				"mediaType":   "application/vnd.in-toto+json",
+				"digest":      sbomDigest,
+				"size":        4,
+				"annotations": map[string]string{inTotoPredicateTypeAnnotation: predicateType},
+			}},
+		})
+		require.NoError(t, err)
+		attestationDigest := digest.FromBytes(attestation)
+		require.NoError(t, os.WriteFile(filepath.Join(path, attestationDigest.Encoded()+".manifest.json"), attestation, 0644))
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType":   imgspecv1.MediaTypeImageManifest,
+			"digest":      attestationDigest,
+			"size":        len(attestation),
+			"platform":    map[string]string{"architecture": "unknown", "os": "unknown"},
+			"annotations": map[string]string{attestationReferenceTypeAnnotation: attestationManifestType, "vnd.docker.reference.digest": digest.FromString("image").String()},
+		})
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     imgspecv1.MediaTypeImageIndex,
+		"manifests":     manifests,
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "manifest.json"), index, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "version"), []byte("Directory Transport Version: 1.1\n"), 0644))
+	return path, sbomDigest
+}
+
+func TestFindSBOM(t *testing.T) {
+	for predicateType, found := range map[string]bool{
+		"https://spdx.dev/Document":        true,
+		"https://slsa.dev/provenance/v0.2": false,
+		"":                                 false,
+	} {
+		path, sbomDigest := writeDirIndex(t, predicateType)
+		ref, err := alltransports.ParseImageName("dir:" + path)
+		require.NoError(t, err)
+		source, err := InspectSource(context.Background(), nil, ref, 0)
+		require.NoError(t, err)
+
+		sbom, err := FindSBOM(context.Background(), nil, ref, source)
+		require.NoError(t, err, predicateType)
+		if !found {
+			assert.Nil(t, sbom, predicateType)
+			continue
+		}
+		require.NotNil(t, sbom)
+		assert.Equal(t, sbomDigest, sbom.Digest)
+		assert.Equal(t, predicateType, sbom.PredicateType)
+		assert.Empty(t, sbom.Location)
+	}
+
+	srcPath, _ := writeDirImage(t, nil)
+	ref, err := alltransports.ParseImageName("dir:" + srcPath)
+	require.NoError(t, err)
+	source, err := InspectSource(context.Background(), nil, ref, 0)
+	require.NoError(t, err)
+	sbom, err := FindSBOM(context.Background(), nil, ref, source)
+	assert.NoError(t, err)
+	assert.Nil(t, sbom)
+}
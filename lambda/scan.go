@@ -0,0 +1,164 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/opencontainers/go-digest"
+)
+
+// scanSeverities are the ECR finding severities, from lowest to highest.
+// UNDEFINED findings are never counted against the threshold.
+var scanSeverities = []string{"INFORMATIONAL", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// ParseScanSeverity returns the rank of a ScanSeverityThreshold value.
+func ParseScanSeverity(severity string) (int, error) {
+	for i, s := range scanSeverities {
+		if strings.EqualFold(s, severity) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scan severity %q, expected one of %s", severity, strings.Join(scanSeverities, ", "))
+}
+
+// CheckScanFindings returns an error if counts, finding counts by severity,
+// has findings at or above threshold.
+func CheckScanFindings(counts map[string]int32, threshold string) error {
+	rank, err := ParseScanSeverity(threshold)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for severity, count := range counts {
+		r, err := ParseScanSeverity(severity)
+		if err != nil || r < rank || count == 0 {
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%d %s", count, strings.ToUpper(severity)))
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("source image scan has findings at or above %s: %s", strings.ToUpper(threshold), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type describeImageScanFindingsAPIClient interface {
+	DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error)
+}
+
+// GetECRScanFindings returns the finding counts of the completed ECR scan
+// of image dgst in repo.
+func GetECRScanFindings(ctx context.Context, client describeImageScanFindingsAPIClient, repo ECRRepository, dgst digest.Digest) (map[string]int32, error) {
+	out, err := client.DescribeImageScanFindings(ctx, &ecr.DescribeImageScanFindingsInput{
+		RegistryId:     aws.String(repo.RegistryID),
+		RepositoryName: aws.String(repo.Name),
+		ImageId:        &ecrtypes.ImageIdentifier{ImageDigest: aws.String(dgst.String())},
+		MaxResults:     aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading scan findings of %s failed: %v", dgst, err)
+	}
+	if out.ImageScanStatus == nil || out.ImageScanStatus.Status != ecrtypes.ScanStatusComplete {
+		status := "unknown"
+		if out.ImageScanStatus != nil {
+			status = string(out.ImageScanStatus.Status)
+		}
+		return nil, fmt.Errorf("scan of %s is not complete, status %s", dgst, status)
+	}
+	counts := make(map[string]int32)
+	if out.ImageScanFindings != nil {
+		for severity, count := range out.ImageScanFindings.FindingSeverityCounts {
+			counts[severity] = count
+		}
+	}
+	return counts, nil
+}
+
+type lambdaInvokeAPIClient interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// scanRequest is the event a ScanLambdaArn function is invoked with.
+type scanRequest struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// scanResponse is what a ScanLambdaArn function returns, finding counts by
+// ECR severity name.
+type scanResponse struct {
+	FindingSeverityCounts map[string]int32 `json:"findingSeverityCounts"`
+}
+
+// InvokeScanLambda asks the scan function arn to scan image, returning its
+// finding counts.
+func InvokeScanLambda(ctx context.Context, client lambdaInvokeAPIClient, arn string, image string, dgst digest.Digest) (map[string]int32, error) {
+	payload, err := json.Marshal(scanRequest{Image: image, Digest: dgst.String()})
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(arn),
+		Payload:      payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invoking scan function %s failed: %v", arn, err)
+	}
+	if out.FunctionError != nil {
+		return nil, fmt.Errorf("scan function %s failed: %s: %s", arn, *out.FunctionError, out.Payload)
+	}
+	var resp scanResponse
+	if err := json.Unmarshal(out.Payload, &resp); err != nil {
+		return nil, fmt.Errorf("scan function %s returned an invalid response: %v", arn, err)
+	}
+	if resp.FindingSeverityCounts == nil {
+		return nil, fmt.Errorf("scan function %s returned no findingSeverityCounts", arn)
+	}
+	return resp.FindingSeverityCounts, nil
+}
+
+// NewLambdaClient returns a Lambda client for the region of the function arn.
+func NewLambdaClient(ctx context.Context, arn string) (*lambda.Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if parts := strings.Split(arn, ":"); len(parts) > 3 && parts[3] != "" {
+		opts = append(opts, config.WithRegion(parts[3]))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	return lambda.NewFromConfig(cfg), nil
+}
+
+// ScanSource returns the finding counts for the source image, from the
+// scan function arn when set and from ECR image scanning otherwise.
+func ScanSource(ctx context.Context, srcImage string, srcInfo ImageRefInfo, dgst digest.Digest, arn string) (map[string]int32, error) {
+	if arn != "" {
+		client, err := NewLambdaClient(ctx, arn)
+		if err != nil {
+			return nil, err
+		}
+		return InvokeScanLambda(ctx, client, arn, srcImage, dgst)
+	}
+	repo, ok := GetECRRepository(srcInfo)
+	if !ok {
+		return nil, fmt.Errorf("%v requires an ECR source or %v", SCAN_SEVERITY_THRESHOLD, SCAN_LAMBDA_ARN)
+	}
+	client, err := NewECRClient(ctx, repo.Region)
+	if err != nil {
+		return nil, err
+	}
+	return GetECRScanFindings(ctx, client, repo, dgst)
+}
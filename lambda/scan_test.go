@@ -0,0 +1,74 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeScanFindingsClient struct {
+	status ecrtypes.ScanStatus
+	counts map[string]int32
+}
+
+func (c *fakeScanFindingsClient) DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error) {
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus:   &ecrtypes.ImageScanStatus{Status: c.status},
+		ImageScanFindings: &ecrtypes.ImageScanFindings{FindingSeverityCounts: c.counts},
+	}, nil
+}
+
+type fakeLambdaClient struct {
+	request  scanRequest
+	response string
+}
+
+func (c *fakeLambdaClient) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	if err := json.Unmarshal(params.Payload, &c.request); err != nil {
+		return nil, err
+	}
+	return &lambda.InvokeOutput{Payload: []byte(c.response)}, nil
+}
+
+func TestCheckScanFindings(t *testing.T) {
+	counts := map[string]int32{"LOW": 4, "HIGH": 1, "CRITICAL": 0, "UNDEFINED": 2}
+	assert.NoError(t, CheckScanFindings(counts, "CRITICAL"))
+	assert.EqualError(t, CheckScanFindings(counts, "high"), "source image scan has findings at or above HIGH: 1 HIGH")
+	assert.EqualError(t, CheckScanFindings(counts, "LOW"), "source image scan has findings at or above LOW: 1 HIGH, 4 LOW")
+	assert.Error(t, CheckScanFindings(counts, "SEVERE"))
+}
+
+func TestGetECRScanFindings(t *testing.T) {
+	repo := ECRRepository{RegistryID: "123456789012", Region: "us-west-2", Name: "app"}
+	dgst := digest.FromString("image")
+
+	counts, err := GetECRScanFindings(context.TODO(), &fakeScanFindingsClient{status: ecrtypes.ScanStatusComplete, counts: map[string]int32{"HIGH": 2}}, repo, dgst)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int32{"HIGH": 2}, counts)
+
+	_, err = GetECRScanFindings(context.TODO(), &fakeScanFindingsClient{status: ecrtypes.ScanStatusInProgress}, repo, dgst)
+	assert.Error(t, err)
+}
+
+func TestInvokeScanLambda(t *testing.T) {
+	dgst := digest.FromString("image")
+	client := &fakeLambdaClient{response: `{"findingSeverityCounts": {"MEDIUM": 3}}`}
+	counts, err := InvokeScanLambda(context.TODO(), client, "arn:aws:lambda:us-west-2:123456789012:function:scan", "docker://nginx:1.25", dgst)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int32{"MEDIUM": 3}, counts)
+	assert.Equal(t, scanRequest{Image: "docker://nginx:1.25", Digest: dgst.String()}, client.request)
+
+	client = &fakeLambdaClient{response: `{}`}
+	_, err = InvokeScanLambda(context.TODO(), client, "scan", "docker://nginx:1.25", dgst)
+	assert.Error(t, err)
+}
@@ -0,0 +1,167 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
+)
+
+// placeholderRe matches {name} placeholders and {stackTag:<key>} ones,
+// whose key may have any characters tag keys have.
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z]+(?::[^{}]+)?)\}`)
+
+// stackTagPrefix is the prefix of the placeholders of stack tags.
+const stackTagPrefix = "stackTag:"
+
+// ExpandTemplate replaces {name} placeholders in tmpl with values from vars.
+// Unknown placeholders are an error rather than being left in place.
+func ExpandTemplate(tmpl string, vars map[string]string) (string, error) {
+	var unknown []string
+	out := placeholderRe.ReplaceAllStringFunc(tmpl, func(p string) string {
+		name := p[1 : len(p)-1]
+		v, ok := vars[name]
+		if !ok {
+			unknown = append(unknown, p)
+			return p
+		}
+		return v
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholder %s in template %q", strings.Join(unknown, ", "), tmpl)
+	}
+	return out, nil
+}
+
+// StackTemplateVars returns the placeholders derived from the stack that
+// sent event. destRegistry is the ECR registry of the stack's account and
+// region, and dnsSuffix the DNS suffix of its partition, e.g.
+// amazonaws.com.cn in China. The stack tags are added by StackTagVars.
+// StackId has the form
+// arn:<partition>:cloudformation:<region>:<account>:stack/<name>/<guid>
+func StackTemplateVars(event cfn.Event) map[string]string {
+	vars := map[string]string{
+		"stackId":           event.StackID,
+		"logicalResourceId": event.LogicalResourceID,
+	}
+	parts := strings.SplitN(event.StackID, ":", 6)
+	if len(parts) == 6 {
+		vars["region"] = parts[3]
+		vars["accountId"] = parts[4]
+		vars["destRegistry"] = ECRRegistryHost(parts[4], parts[3])
+		vars["dnsSuffix"] = awsDNSSuffix(parts[3])
+		if stack := strings.Split(parts[5], "/"); len(stack) >= 2 {
+			vars["stackName"] = stack[1]
+		}
+	}
+	return vars
+}
+
+// usesStackTags reports whether tmpl has {stackTag:<key>} placeholders.
+func usesStackTags(tmpl string) bool {
+	return strings.Contains(tmpl, "{"+stackTagPrefix)
+}
+
+type describeStacksAPIClient interface {
+	DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error)
+}
+
+// StackTagVars returns the {stackTag:<key>} placeholders of the tags of the
+// stack stackID. CloudFormation requests don't carry them, so they are
+// looked up.
+func StackTagVars(ctx context.Context, client describeStacksAPIClient, stackID string) (map[string]string, error) {
+	out, err := client.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(stackID)})
+	if err != nil {
+		return nil, fmt.Errorf("error reading the tags of stack %s: %v", stackID, err.Error())
+	}
+	if len(out.Stacks) == 0 {
+		return nil, fmt.Errorf("stack %s not found", stackID)
+	}
+	vars := make(map[string]string, len(out.Stacks[0].Tags))
+	for _, tag := range out.Stacks[0].Tags {
+		vars[stackTagPrefix+aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return vars, nil
+}
+
+// lookupStackTagVars returns the stack tag placeholders of stackID.
+func lookupStackTagVars(ctx context.Context, stackID string) (map[string]string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	return StackTagVars(ctx, cloudformation.NewFromConfig(cfg), stackID)
+}
+
+// sourcePlaceholders are the placeholders SourceTemplateVars may define.
+var sourcePlaceholders = []string{"srcRegistry", "srcPath", "srcTag", "srcDigest", "srcShortDigest"}
+
+// SourceTemplateVars returns the placeholders derived from srcImage, a
+// docker reference: its registry host, repository path, tag and digest.
+// srcShortDigest is the first 12 hex characters of the digest. srcTag and
+// the digests are only defined when srcImage has them; the digest of a
+// tag isn't resolved.
+func SourceTemplateVars(srcImage string) (map[string]string, error) {
+	pinned, isPinned := SplitTagAndDigest(srcImage)
+	if isPinned {
+		srcImage = pinned.DigestImage
+	}
+	ref, err := alltransports.ParseImageName(srcImage)
+	if err != nil {
+		return nil, err
+	}
+	named := ref.DockerReference()
+	if named == nil {
+		return nil, fmt.Errorf("source placeholders require a docker SrcImage, got %v", srcImage)
+	}
+	vars := map[string]string{
+		"srcRegistry": reference.Domain(named),
+		"srcPath":     reference.Path(named),
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		vars["srcTag"] = tagged.Tag()
+	}
+	if isPinned {
+		vars["srcTag"] = pinned.Tag
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		vars["srcDigest"] = digested.Digest().String()
+		short, err := DigestTag(digested.Digest(), "", defaultDigestTagLength)
+		if err != nil {
+			return nil, err
+		}
+		vars["srcShortDigest"] = short
+	}
+	return vars, nil
+}
+
+// usesSourcePlaceholders reports whether tmpl has source placeholders.
+func usesSourcePlaceholders(tmpl string) bool {
+	for _, p := range sourcePlaceholders {
+		if strings.Contains(tmpl, "{"+p+"}") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSourcePlaceholders returns an error naming the first source
+// placeholder of tmpl that srcImage doesn't define.
+func checkSourcePlaceholders(tmpl string, srcImage string, vars map[string]string) error {
+	for _, p := range sourcePlaceholders {
+		if _, ok := vars[p]; !ok && strings.Contains(tmpl, "{"+p+"}") {
+			return fmt.Errorf("placeholder {%s} in template %q is not defined for SrcImage %v", p, tmpl, srcImage)
+		}
+	}
+	return nil
+}
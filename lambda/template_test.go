@@ -0,0 +1,109 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cfntypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	vars := map[string]string{"stackName": "my-stack", "region": "us-east-1"}
+
+	s, err := ExpandTemplate("docker://123.dkr.ecr.{region}.amazonaws.com/{stackName}:latest", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker://123.dkr.ecr.us-east-1.amazonaws.com/my-stack:latest", s)
+
+	s, err = ExpandTemplate("docker://nginx:latest", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "docker://nginx:latest", s)
+
+	_, err = ExpandTemplate("docker://nginx:{tag}", vars)
+	assert.EqualError(t, err, `unknown placeholder {tag} in template "docker://nginx:{tag}"`)
+}
+
+func TestStackTemplateVars(t *testing.T) {
+	vars := StackTemplateVars(cfn.Event{
+		StackID:           "arn:aws:cloudformation:us-west-2:123456789012:stack/my-stack/0b6bd0e0-1234-11ee-be56-0242ac120002",
+		LogicalResourceID: "CustomResource",
+	})
+	assert.Equal(t, "my-stack", vars["stackName"])
+	assert.Equal(t, "us-west-2", vars["region"])
+	assert.Equal(t, "123456789012", vars["accountId"])
+	assert.Equal(t, "CustomResource", vars["logicalResourceId"])
+	assert.Equal(t, "123456789012.dkr.ecr.us-west-2.amazonaws.com", vars["destRegistry"])
+
+	vars = StackTemplateVars(cfn.Event{StackID: "arn:aws-cn:cloudformation:cn-north-1:123456789012:stack/my-stack/guid"})
+	assert.Equal(t, "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", vars["destRegistry"])
+	assert.Equal(t, "amazonaws.com.cn", vars["dnsSuffix"])
+
+	vars = StackTemplateVars(cfn.Event{StackID: "not-an-arn"})
+	_, ok := vars["stackName"]
+	assert.False(t, ok)
+}
+
+func TestSourceTemplateVars(t *testing.T) {
+	const dgst = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	stack := map[string]string{"destRegistry": "123456789012.dkr.ecr.us-west-2.amazonaws.com"}
+
+	for _, tc := range []struct{ src, tmpl, expected string }{
+		{"docker://nginx:1.25", "docker://{destRegistry}/mirror/{srcPath}:{srcTag}", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/mirror/library/nginx:1.25"},
+		{"docker://ghcr.io/org/app:v2", "docker://{destRegistry}/{srcRegistry}/{srcPath}:{srcTag}", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/ghcr.io/org/app:v2"},
+		{"docker://quay.io/org/app@" + dgst, "docker://{destRegistry}/{srcPath}:sha-{srcShortDigest}", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/org/app:sha-0123456789ab"},
+		{"docker://nginx:1.25@" + dgst, "docker://{destRegistry}/{srcPath}:{srcTag}-{srcShortDigest}", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/library/nginx:1.25-0123456789ab"},
+		{"docker://quay.io/org/app@" + dgst, "docker://{destRegistry}/{srcPath}@{srcDigest}", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/org/app@" + dgst},
+	} {
+		vars, err := SourceTemplateVars(tc.src)
+		assert.NoError(t, err)
+		assert.NoError(t, checkSourcePlaceholders(tc.tmpl, tc.src, vars))
+		for k, v := range stack {
+			vars[k] = v
+		}
+		s, err := ExpandTemplate(tc.tmpl, vars)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, s)
+	}
+
+	vars, err := SourceTemplateVars("docker://nginx:1.25")
+	assert.NoError(t, err)
+	assert.EqualError(t, checkSourcePlaceholders("docker://registry/{srcPath}:{srcShortDigest}", "docker://nginx:1.25", vars),
+		`placeholder {srcShortDigest} in template "docker://registry/{srcPath}:{srcShortDigest}" is not defined for SrcImage docker://nginx:1.25`)
+	_, err = SourceTemplateVars("dir:/tmp/image")
+	assert.Error(t, err)
+	assert.False(t, usesSourcePlaceholders("docker://{destRegistry}/{stackName}:latest"))
+}
+
+type fakeCloudFormationClient struct {
+	tags []cfntypes.Tag
+}
+
+func (c *fakeCloudFormationClient) DescribeStacks(ctx context.Context, params *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	return &cloudformation.DescribeStacksOutput{Stacks: []cfntypes.Stack{{StackId: params.StackName, Tags: c.tags}}}, nil
+}
+
+func TestStackTagVars(t *testing.T) {
+	client := &fakeCloudFormationClient{tags: []cfntypes.Tag{
+		{Key: aws.String("team"), Value: aws.String("payments")},
+		{Key: aws.String("aws:cdk:app"), Value: aws.String("shop")},
+	}}
+	vars, err := StackTagVars(context.Background(), client, "arn:aws:cloudformation:us-east-1:123456789012:stack/my-stack/guid")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"stackTag:team": "payments", "stackTag:aws:cdk:app": "shop"}, vars)
+
+	tmpl := "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/{stackTag:team}/{stackTag:aws:cdk:app}:latest"
+	assert.True(t, usesStackTags(tmpl))
+	s, err := ExpandTemplate(tmpl, vars)
+	require.NoError(t, err)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-east-1.amazonaws.com/payments/shop:latest", s)
+
+	_, err = ExpandTemplate("docker://registry/{stackTag:owner}:latest", vars)
+	assert.EqualError(t, err, `unknown placeholder {stackTag:owner} in template "docker://registry/{stackTag:owner}:latest"`)
+}
@@ -0,0 +1,77 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const pemPrefix = "-----BEGIN"
+
+// resolvePEM returns s if it is PEM, otherwise it fetches s as a Secrets
+// Manager secret id.
+func resolvePEM(s string) (string, error) {
+	if s == "" || strings.HasPrefix(strings.TrimSpace(s), pemPrefix) {
+		return s, nil
+	}
+	return GetSecret(s)
+}
+
+// WriteCertDir writes the TLS material of creds into a new directory laid
+// out for types.SystemContext.DockerCertPath, or returns "" if creds have
+// none. The caller must remove the directory.
+func WriteCertDir(creds Creds) (string, error) {
+	if creds.ClientCert == "" && creds.ClientKey == "" && creds.CABundle == "" {
+		return "", nil
+	}
+	if (creds.ClientCert == "") != (creds.ClientKey == "") {
+		return "", errors.New("clientCert and clientKey must be set together")
+	}
+
+	clientCert, err := resolvePEM(creds.ClientCert)
+	if err != nil {
+		return "", err
+	}
+	clientKey, err := resolvePEM(creds.ClientKey)
+	if err != nil {
+		return "", err
+	}
+	caBundle, err := resolvePEM(creds.CABundle)
+	if err != nil {
+		return "", err
+	}
+
+	files := map[string]string{}
+	if clientCert != "" {
+		if _, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey)); err != nil {
+			return "", fmt.Errorf("invalid client certificate and key: %v", err.Error())
+		}
+		files["client.cert"] = clientCert
+		files["client.key"] = clientKey
+	}
+	if caBundle != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(caBundle)) {
+			return "", errors.New("invalid caBundle: no PEM certificates found")
+		}
+		files["ca.crt"] = caBundle
+	}
+
+	dir, err := os.MkdirTemp("", "certs-")
+	if err != nil {
+		return "", err
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
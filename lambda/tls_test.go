@@ -0,0 +1,110 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClientCert returns a self-signed client certificate and key as PEM.
+func newClientCert(t *testing.T) (certPEM string, keyPEM string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ecr-deployment-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		cert
+}
+
+func TestWriteCertDir(t *testing.T) {
+	certPEM, keyPEM, _ := newClientCert(t)
+
+	dir, err := WriteCertDir(Creds{Username: "user"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", dir)
+
+	dir, err = WriteCertDir(Creds{ClientCert: certPEM, ClientKey: keyPEM, CABundle: certPEM})
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.FileExists(t, dir+"/client.cert")
+	assert.FileExists(t, dir+"/client.key")
+	assert.FileExists(t, dir+"/ca.crt")
+
+	_, err = WriteCertDir(Creds{ClientCert: certPEM})
+	assert.Error(t, err)
+
+	_, otherKeyPEM, _ := newClientCert(t)
+	_, err = WriteCertDir(Creds{ClientCert: certPEM, ClientKey: otherKeyPEM})
+	assert.Error(t, err)
+
+	_, err = WriteCertDir(Creds{CABundle: "-----BEGIN CERTIFICATE-----\nnope\n-----END CERTIFICATE-----\n"})
+	assert.Error(t, err)
+}
+
+func TestMTLSCreds(t *testing.T) {
+	certPEM, keyPEM, cert := newClientCert(t)
+
+	var peerCN string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	creds, err := json.Marshal(Creds{ClientCert: certPEM, ClientKey: keyPEM, CABundle: serverCA})
+	require.NoError(t, err)
+
+	image := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latest"
+	opts := NewImageOpts(image)
+	opts.SetCreds(string(creds))
+	sys, err := opts.NewSystemContext()
+	require.NoError(t, err)
+
+	ref, err := alltransports.ParseImageName(image)
+	require.NoError(t, err)
+	_, _, err = GetManifestDigest(context.Background(), sys, ref)
+	assert.Error(t, err)
+	assert.Equal(t, "ecr-deployment-test", peerCN)
+
+	certDir := sys.DockerCertPath
+	assert.NoError(t, opts.Close())
+	assert.NoDirExists(t, certDir)
+}
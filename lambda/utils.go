@@ -7,17 +7,26 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -25,6 +34,102 @@ const (
 	DEST_IMAGE string = "DestImage"
 	SRC_CREDS  string = "SrcCreds"
 	DEST_CREDS string = "DestCreds"
+
+	REGISTRY_CREDENTIALS string = "RegistryCredentials"
+
+	DEST_IMAGES       string = "DestImages"
+	DEST_RESULTS      string = "DestResults"
+	DEST_DIGESTS      string = "DestDigests"
+	DEST_IMAGES_CREDS string = "DestImagesCreds"
+
+	DEST_IMAGE_TEMPLATE string = "DestImageTemplate"
+	DEST_MANIFEST_TYPE  string = "DestManifestType"
+	DIGEST_ALGORITHM    string = "DigestAlgorithm"
+	CONVERT_SCHEMA1     string = "ConvertSchema1"
+	NORMALIZE_DEST_PATH string = "NormalizeDestPath"
+	DEST_ARCHIVE_S3_URI string = "DestArchiveS3Uri"
+
+	// ENCODE_SOURCE_REGISTRY_IN_PATH prefixes the destination repository with
+	// the source registry host, so same-named upstream repos don't collide.
+	ENCODE_SOURCE_REGISTRY_IN_PATH string = "EncodeSourceRegistryInPath"
+
+	ALLOWED_SOURCE_MEDIA_TYPES string = "AllowedSourceMediaTypes"
+	MANIFEST_ANNOTATIONS       string = "ManifestAnnotations"
+
+	COMPRESSION_FORMAT string = "CompressionFormat"
+
+	TAG_FROM_DIGEST        string = "TagFromDigest"
+	TAG_FROM_DIGEST_PREFIX string = "TagFromDigestPrefix"
+	TAG_FROM_DIGEST_LENGTH string = "TagFromDigestLength"
+
+	FORCE  string = "Force"
+	POLICY string = "Policy"
+
+	SKIP_IF_TAG_EXISTS string = "SkipIfTagExists"
+	MAX_IMAGE_AGE_DAYS string = "MaxImageAgeDays"
+
+	// DEST_REPOSITORY_WAIT_SECONDS checks the ECR destination repository
+	// exists before copying, waiting up to this long for it to appear.
+	DEST_REPOSITORY_WAIT_SECONDS string = "DestRepositoryWaitSeconds"
+	SCAN_ON_PUSH_WAIT_SECONDS    string = "ScanOnPushWaitSeconds"
+
+	PUBLIC_REGISTRY_ALIAS          string = "PublicRegistryAlias"
+	CREATE_PUBLIC_REPOSITORY       string = "CreatePublicRepository"
+	PUBLIC_REPOSITORY_CATALOG_DATA string = "PublicRepositoryCatalogData"
+
+	RETURN_LAYER_INFO string = "ReturnLayerInfo"
+
+	SCAN_SEVERITY_THRESHOLD string = "ScanSeverityThreshold"
+	SCAN_LAMBDA_ARN         string = "ScanLambdaArn"
+
+	SUGGEST_SOURCE_TAGS string = "SuggestSourceTags"
+
+	BLOB_UPLOAD_INVALID_RETRIES string = "BlobUploadInvalidRetries"
+
+	LOG_LEVEL string = "LogLevel"
+
+	MAX_CONFIG_SIZE string = "MaxConfigSize"
+
+	ENSURE_REPLICATION_REGIONS string = "EnsureReplicationRegions"
+
+	BLOB_CONCURRENCY string = "BlobConcurrency"
+
+	REPORT_DESTINATION string = "ReportDestination"
+
+	SRC_DOCKER_DAEMON_HOST string = "SrcDockerDaemonHost"
+
+	REQUIRE_TAG_IMMUTABILITY string = "RequireTagImmutability"
+
+	VERIFY_ONLY        string = "VerifyOnly"
+	VERIFY_ONLY_LAYERS string = "VerifyOnlyLayers"
+
+	DEST_TAG_SUFFIX string = "DestTagSuffix"
+
+	PRUNE_OLDER_THAN string = "PruneOlderThan"
+
+	ECR_MAX_LAYERS        string = "ECRMaxLayers"
+	ECR_MAX_LAYER_SIZE    string = "ECRMaxLayerSize"
+	ECR_MAX_MANIFEST_SIZE string = "ECRMaxManifestSize"
+
+	ALSO_TAG_WITH_DIGEST string = "AlsoTagWithDigest"
+
+	SRC_USE_PLAIN_HTTP  string = "SrcUsePlainHTTP"
+	DEST_USE_PLAIN_HTTP string = "DestUsePlainHTTP"
+
+	LATEST_N_TAGS     string = "LatestNTags"
+	LATEST_TAGS_ORDER string = "LatestTagsOrder"
+	SEMVER_CONSTRAINT string = "SemverConstraint"
+	TAG_RESULTS       string = "TagResults"
+
+	EXTRACT_SBOM string = "ExtractSBOM"
+
+	VERIFY_AFTER_PUSH       string = "VerifyAfterPush"
+	VERIFY_LAYER_AFTER_PUSH string = "VerifyLayerAfterPush"
+
+	RETURN_DEST_TAGS       string = "ReturnDestTags"
+	RETURN_DEST_TAGS_LIMIT string = "ReturnDestTagsLimit"
+
+	DOWNLOAD_FOREIGN_LAYERS string = "DownloadForeignLayers"
 )
 
 type ECRAuth struct {
@@ -45,10 +150,17 @@ func GetECRRegion(uri string) string {
 }
 
 func GetECRLogin(region string) ([]ECRAuth, error) {
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithRegion(region),
-	)
+	return getECRLogin(region, nil)
+}
+
+// getECRLogin logs in to ECR in region with provider, or with the default
+// credentials if provider is nil.
+func getECRLogin(region string, provider aws.CredentialsProvider) ([]ECRAuth, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if provider != nil {
+		opts = append(opts, config.WithCredentialsProvider(provider))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
 	}
@@ -86,14 +198,19 @@ type ImageOpts struct {
 	requireECRLogin bool
 	region          string
 	creds           string
+	certDir         string
+	// ecrPublicLogin logs in to ECR Public when there are no creds.
+	ecrPublicLogin bool
 }
 
 func NewImageOpts(uri string) *ImageOpts {
-	requireECRLogin := strings.Contains(uri, "dkr.ecr")
+	// Only registry images log in; a local path may still look like an ECR
+	// host, e.g. dir:/tmp/123456789012.dkr.ecr.us-east-1.amazonaws.com/app.
+	requireECRLogin := strings.HasPrefix(uri, docker.Transport.Name()+"://") && strings.Contains(uri, "dkr.ecr")
 	if requireECRLogin {
-		return &ImageOpts{uri, requireECRLogin, GetECRRegion(uri), ""}
+		return &ImageOpts{uri: uri, requireECRLogin: requireECRLogin, region: GetECRRegion(uri)}
 	} else {
-		return &ImageOpts{uri, requireECRLogin, "", ""}
+		return &ImageOpts{uri: uri, requireECRLogin: requireECRLogin}
 	}
 }
 
@@ -105,6 +222,171 @@ func (s *ImageOpts) SetCreds(creds string) {
 	s.creds = creds
 }
 
+// SetECRPublicLogin makes NewSystemContext log in to ECR Public, which is
+// only needed to push there.
+func (s *ImageOpts) SetECRPublicLogin() {
+	s.ecrPublicLogin = true
+}
+
+// Creds are the registry credentials of one side of the copy. They are
+// given either as "user:password" or as a JSON object with the fields below.
+type Creds struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// BearerToken is sent as is in the Authorization header, for registries
+	// that accept a static token instead of a user and password.
+	BearerToken string `json:"bearerToken,omitempty"`
+	// IdentityToken is an OAuth2 refresh token exchanged at the registry's
+	// token endpoint for access tokens, e.g. for Google Artifact Registry.
+	IdentityToken string `json:"identityToken,omitempty"`
+	// ClientCert and ClientKey are a PEM client certificate and key for
+	// registries that require mTLS. CABundle holds PEM CA certificates
+	// trusted in addition to the system ones. Each can also be the id of a
+	// Secrets Manager secret holding the PEM.
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	CABundle   string `json:"caBundle,omitempty"`
+	// VaultPath reads the creds from this HashiCorp Vault secret instead,
+	// using VAULT_ADDR and VAULT_TOKEN.
+	VaultPath string `json:"vaultPath,omitempty"`
+	// AWSAccessKeyID, AWSSecretAccessKey and AWSSessionToken are AWS
+	// credentials to log in to an ECR registry with, e.g. one in another
+	// partition, which the function's own credentials can't reach.
+	AWSAccessKeyID     string `json:"awsAccessKeyId,omitempty"`
+	AWSSecretAccessKey string `json:"awsSecretAccessKey,omitempty"`
+	AWSSessionToken    string `json:"awsSessionToken,omitempty"`
+}
+
+// awsCredentials returns the AWS credentials of c, or nil if it has none.
+func (c Creds) awsCredentials() aws.CredentialsProvider {
+	if c.AWSAccessKeyID == "" {
+		return nil
+	}
+	return credentials.NewStaticCredentialsProvider(c.AWSAccessKeyID, c.AWSSecretAccessKey, c.AWSSessionToken)
+}
+
+// ResolveRegistryCreds returns the creds registryCreds holds for host,
+// falling back to the per-image creds when host has no entry. A host with a
+// port, e.g. registry.internal:5000, also matches an entry without one if
+// there is no entry for the port.
+func ResolveRegistryCreds(registryCreds map[string]string, host string, imageCreds string) string {
+	if host == "" {
+		return imageCreds
+	}
+	hostname := host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:i]
+	}
+	fallback, found := "", false
+	for h, creds := range registryCreds {
+		if strings.EqualFold(h, host) {
+			return creds
+		}
+		if hostname != host && strings.EqualFold(h, hostname) {
+			fallback, found = creds, true
+		}
+	}
+	if found {
+		return fallback
+	}
+	return imageCreds
+}
+
+func ParseCreds(s string) (Creds, error) {
+	var creds Creds
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		if err := json.Unmarshal([]byte(s), &creds); err != nil {
+			return Creds{}, fmt.Errorf("error parsing json creds: %v", err.Error())
+		}
+		return creds, nil
+	}
+	token := strings.SplitN(s, ":", 2)
+	creds.Username = token[0]
+	if len(token) == 2 {
+		creds.Password = token[1]
+	}
+	return creds, nil
+}
+
+// RefreshECRLogin fetches a new ECR token into sys, a system context
+// NewSystemContext returned. refreshed is false when s doesn't use ECR auto
+// login.
+func (s *ImageOpts) RefreshECRLogin(sys *types.SystemContext) (refreshed bool, err error) {
+	if !s.requireECRLogin {
+		return false, nil
+	}
+	var provider aws.CredentialsProvider
+	if s.creds != "" {
+		creds, err := ParseCreds(s.creds)
+		if err != nil {
+			return false, err
+		}
+		if provider = creds.awsCredentials(); provider == nil {
+			return false, nil
+		}
+	}
+	auths, err := getECRLogin(s.region, provider)
+	if err != nil {
+		return false, err
+	}
+	if len(auths) == 0 {
+		return false, fmt.Errorf("empty ECR login auth token list")
+	}
+	sys.DockerAuthConfig = &types.DockerAuthConfig{
+		Username: auths[0].User,
+		Password: auths[0].Pass,
+	}
+	return true, nil
+}
+
+// RefreshCreds resolves credsRef, the creds property s's creds came from,
+// again with resolve and updates the auth of sys, a system context
+// NewSystemContext returned, if they changed, e.g. because the secret holding
+// them was rotated. Without a creds property the ECR token is refreshed.
+func (s *ImageOpts) RefreshCreds(sys *types.SystemContext, credsRef string, resolve func(string) (string, error)) (refreshed bool, err error) {
+	if credsRef == "" {
+		return s.RefreshECRLogin(sys)
+	}
+	creds, err := resolve(credsRef)
+	if err != nil {
+		return false, err
+	}
+	if creds == s.creds {
+		// Unchanged AWS credentials can still get a new ECR token.
+		return s.RefreshECRLogin(sys)
+	}
+	parsed, err := ParseCreds(creds)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Credentials for %v changed, using the new ones", s.uri)
+	s.creds = creds
+	if parsed.awsCredentials() != nil {
+		return s.RefreshECRLogin(sys)
+	} else if parsed.BearerToken != "" {
+		sys.DockerBearerRegistryToken = parsed.BearerToken
+	} else if parsed.IdentityToken != "" {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username:      parsed.Username,
+			IdentityToken: parsed.IdentityToken,
+		}
+	} else {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: parsed.Username,
+			Password: parsed.Password,
+		}
+	}
+	return true, nil
+}
+
+// Close removes the files NewSystemContext wrote.
+func (s *ImageOpts) Close() error {
+	if s.certDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.certDir)
+}
+
 func (s *ImageOpts) NewSystemContext() (*types.SystemContext, error) {
 	ctx := &types.SystemContext{
 		DockerRegistryUserAgent: "ecr-deployment",
@@ -112,14 +394,66 @@ func (s *ImageOpts) NewSystemContext() (*types.SystemContext, error) {
 	}
 
 	if s.creds != "" {
-		log.Printf("Credentials login mode for %v", s.uri)
+		creds, err := ParseCreds(s.creds)
+		if err != nil {
+			return nil, err
+		}
+		certDir, err := WriteCertDir(creds)
+		if err != nil {
+			return nil, err
+		}
+		if certDir != "" {
+			log.Printf("Client TLS configuration for %v", s.uri)
 
-		token := strings.SplitN(s.creds, ":", 2)
-		ctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: token[0],
+			s.certDir = certDir
+			ctx.DockerCertPath = certDir
 		}
-		if len(token) == 2 {
-			ctx.DockerAuthConfig.Password = token[1]
+		if provider := creds.awsCredentials(); provider != nil {
+			if !s.requireECRLogin {
+				return nil, fmt.Errorf("AWS credentials require an ECR image, got %v", s.uri)
+			}
+			log.Printf("ECR login mode with explicit AWS credentials for %v", s.uri)
+
+			auths, err := getECRLogin(s.region, provider)
+			if err != nil {
+				return nil, err
+			}
+			if len(auths) == 0 {
+				return nil, fmt.Errorf("empty ECR login auth token list")
+			}
+			ctx.DockerAuthConfig = &types.DockerAuthConfig{
+				Username: auths[0].User,
+				Password: auths[0].Pass,
+			}
+		} else if creds.BearerToken != "" {
+			log.Printf("Bearer token login mode for %v", s.uri)
+
+			ctx.DockerBearerRegistryToken = creds.BearerToken
+		} else if creds.IdentityToken != "" {
+			log.Printf("Identity token login mode for %v", s.uri)
+
+			ctx.DockerAuthConfig = &types.DockerAuthConfig{
+				Username:      creds.Username,
+				IdentityToken: creds.IdentityToken,
+			}
+		} else {
+			log.Printf("Credentials login mode for %v", s.uri)
+
+			ctx.DockerAuthConfig = &types.DockerAuthConfig{
+				Username: creds.Username,
+				Password: creds.Password,
+			}
+		}
+	} else if s.ecrPublicLogin {
+		log.Printf("ECR Public auto login mode for %v", s.uri)
+
+		auth, err := GetECRPublicLogin(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		ctx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: auth.User,
+			Password: auth.Pass,
 		}
 	} else {
 		if s.requireECRLogin {
@@ -142,6 +476,102 @@ func (s *ImageOpts) NewSystemContext() (*types.SystemContext, error) {
 	return ctx, nil
 }
 
+var invalidRepoCharsRe = regexp.MustCompile(`[^a-z0-9._/-]+`)
+
+// NormalizeRepoPath lowercases the repository path of a docker:// image and
+// replaces characters ECR doesn't allow with "-". The registry host, tag and
+// digest are left untouched. Other transports are returned unchanged.
+func NormalizeRepoPath(image string) string {
+	const prefix = "docker://"
+	if !strings.HasPrefix(image, prefix) {
+		return image
+	}
+	name := strings.TrimPrefix(image, prefix)
+
+	suffix := ""
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, suffix = name[:i], name[i:]+suffix
+	}
+
+	host := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, name = first+"/", name[i+1:]
+		}
+	}
+
+	path := invalidRepoCharsRe.ReplaceAllString(strings.ToLower(name), "-")
+	return prefix + host + path + suffix
+}
+
+// ImageRefInfo holds the parts of an image reference that identify where
+// the image lives. Fields are empty when the transport doesn't provide them.
+type ImageRefInfo struct {
+	Transport  string
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+func GetImageRefInfo(ref types.ImageReference) ImageRefInfo {
+	info := ImageRefInfo{Transport: ref.Transport().Name()}
+	named := ref.DockerReference()
+	if named == nil {
+		return info
+	}
+	info.Registry = reference.Domain(named)
+	info.Repository = reference.Path(named)
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		info.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		info.Digest = digested.Digest().String()
+	}
+	return info
+}
+
+func (i ImageRefInfo) Fields() logrus.Fields {
+	return logrus.Fields{
+		"transport":  i.Transport,
+		"registry":   i.Registry,
+		"repository": i.Repository,
+		"tag":        i.Tag,
+		"digest":     i.Digest,
+	}
+}
+
+// AddTo stores the non-empty fields in data with keys like <prefix>Registry
+// and removes the keys of empty ones.
+func (i ImageRefInfo) AddTo(data map[string]interface{}, prefix string) {
+	for k, v := range map[string]string{
+		"Registry":   i.Registry,
+		"Repository": i.Repository,
+		"Tag":        i.Tag,
+		"Digest":     i.Digest,
+	} {
+		if v != "" {
+			data[prefix+k] = v
+		} else {
+			delete(data, prefix+k)
+		}
+	}
+}
+
+// logTiming logs how long a stage of the copy took, as structured fields for
+// CloudWatch Logs Insights queries, and records it as a span of the trace.
+func logTiming(ctx context.Context, stage string, start time.Time) {
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"stage":      stage,
+		"durationMs": time.Since(start).Milliseconds(),
+	}).Debug("Stage finished")
+	recordSpan(ctx, stage, start)
+}
+
 func Dumps(v interface{}) string {
 	bytes, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
@@ -167,20 +597,126 @@ func GetCredsType(s string) string {
 }
 
 func GetSecret(secretId string) (secret string, err error) {
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-	)
+	timeout, err := parseSecretTimeout(os.Getenv(EnvSecretTimeout))
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cfg, err := config.LoadDefaultConfig(ctx)
 	log.Printf("get secret id: %s of region: %s", secretId, cfg.Region)
 	if err != nil {
 		return "", fmt.Errorf("api client configuration error: %v", err.Error())
 	}
 
+	retries, err := parseSecretRetries(os.Getenv(EnvSecretRetries))
+	if err != nil {
+		return "", err
+	}
 	client := secretsmanager.NewFromConfig(cfg)
-	resp, err := client.GetSecretValue(context.TODO(), &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretId),
-	})
+	resp, err := getSecretValue(ctx, client, secretId, retries, secretRetryInterval)
 	if err != nil {
-		return "", fmt.Errorf("fetch secret value error: %v", err.Error())
+		return "", fmt.Errorf("failed to fetch credentials from %s: %s", secretId, secretErrorReason(err))
+	}
+	if resp.SecretString == nil {
+		return "", fmt.Errorf("failed to fetch credentials from %s: secret has no string value", secretId)
 	}
 	return *resp.SecretString, nil
 }
+
+const (
+	EnvSecretTimeout     = "SECRET_TIMEOUT"
+	defaultSecretTimeout = 5 * time.Second
+)
+
+func parseSecretTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultSecretTimeout, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", EnvSecretTimeout, err)
+	}
+	if timeout <= 0 {
+		return 0, errors.New(EnvSecretTimeout + " must be positive")
+	}
+	return timeout, nil
+}
+
+const (
+	EnvSecretRetries     = "SECRET_RETRIES"
+	defaultSecretRetries = 3
+)
+
+// secretRetryInterval is the wait before the first retry, doubled for each
+// one after it.
+var secretRetryInterval = 200 * time.Millisecond
+
+func parseSecretRetries(s string) (int, error) {
+	if s == "" {
+		return defaultSecretRetries, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %v", EnvSecretRetries, err)
+	}
+	if n < 0 {
+		return 0, errors.New(EnvSecretRetries + " must not be negative")
+	}
+	return n, nil
+}
+
+type secretValueAPIClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// getSecretValue fetches secretId, retrying up to retries times when
+// Secrets Manager can't decrypt it, e.g. because KMS is throttling. The SDK
+// already retries throttling of Secrets Manager itself, and other errors,
+// like access denied, won't go away by retrying.
+func getSecretValue(ctx context.Context, client secretValueAPIClient, secretId string, retries int, interval time.Duration) (*secretsmanager.GetSecretValueOutput, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(secretId),
+		})
+		if err == nil || attempt >= retries || !isSecretDecryptionError(err) {
+			return resp, err
+		}
+		loggerFrom(ctx).Warnf("Decrypting secret %s failed, retrying in %v: %v", secretId, interval, err)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		interval *= 2
+	}
+}
+
+// isSecretDecryptionError reports whether err is a failure to decrypt a
+// secret with its KMS key.
+func isSecretDecryptionError(err error) bool {
+	var decryption *smtypes.DecryptionFailure
+	if errors.As(err, &decryption) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "KMSThrottlingException"
+}
+
+// secretErrorReason describes why fetching a secret failed, telling a
+// missing secret apart from one the handler may not read.
+func secretErrorReason(err error) string {
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return "secret not found: " + notFound.ErrorMessage()
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDeniedException" {
+		return "access denied, check that the handler role allows secretsmanager:GetSecretValue: " + apiErr.ErrorMessage()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out, raise " + EnvSecretTimeout + " if Secrets Manager is slow to respond"
+	}
+	return err.Error()
+}
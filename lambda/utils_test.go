@@ -4,9 +4,24 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetECRRegion(t *testing.T) {
@@ -31,3 +46,316 @@ func TestGetCredsType(t *testing.T) {
 	assert.Equal(t, SECRET_TEXT, GetCredsType("username:password"))
 	assert.Equal(t, SECRET_NAME, GetCredsType(""))
 }
+
+func TestGetImageRefInfo(t *testing.T) {
+	ref, err := alltransports.ParseImageName("docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/team/test:ubuntu")
+	assert.NoError(t, err)
+	info := GetImageRefInfo(ref)
+	assert.Equal(t, ImageRefInfo{
+		Transport:  "docker",
+		Registry:   "1234567890.dkr.ecr.us-west-2.amazonaws.com",
+		Repository: "team/test",
+		Tag:        "ubuntu",
+	}, info)
+
+	data := make(map[string]interface{})
+	info.AddTo(data, "Dest")
+	assert.Equal(t, map[string]interface{}{
+		"DestRegistry":   "1234567890.dkr.ecr.us-west-2.amazonaws.com",
+		"DestRepository": "team/test",
+		"DestTag":        "ubuntu",
+	}, data)
+
+	ref, err = alltransports.ParseImageName("docker://nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	info = GetImageRefInfo(ref)
+	assert.Equal(t, "docker.io", info.Registry)
+	assert.Equal(t, "library/nginx", info.Repository)
+	assert.Equal(t, "", info.Tag)
+	assert.Equal(t, "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", info.Digest)
+
+	ref, err = alltransports.ParseImageName("dir:/tmp/nginx.dir")
+	assert.NoError(t, err)
+	assert.Equal(t, ImageRefInfo{Transport: "dir"}, GetImageRefInfo(ref))
+}
+
+func TestParseCreds(t *testing.T) {
+	creds, err := ParseCreds("username:pass:word")
+	assert.NoError(t, err)
+	assert.Equal(t, Creds{Username: "username", Password: "pass:word"}, creds)
+
+	creds, err = ParseCreds(`{"username": "username", "password": "password"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, Creds{Username: "username", Password: "password"}, creds)
+
+	creds, err = ParseCreds(`{"bearerToken": "token"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, Creds{BearerToken: "token"}, creds)
+
+	_, err = ParseCreds(`{"username": `)
+	assert.Error(t, err)
+}
+
+func TestBearerTokenCreds(t *testing.T) {
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	destImage := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latest"
+	opts := NewImageOpts(destImage)
+	opts.SetCreds(`{"bearerToken": "static-token"}`)
+	sys, err := opts.NewSystemContext()
+	assert.NoError(t, err)
+	sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+
+	ref, err := alltransports.ParseImageName(destImage)
+	assert.NoError(t, err)
+	_, _, err = GetManifestDigest(context.Background(), sys, ref)
+	assert.Error(t, err)
+	assert.Equal(t, "Bearer static-token", authorization)
+}
+
+func TestIdentityTokenCreds(t *testing.T) {
+	var refreshToken, authorization string
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.NoError(t, r.ParseForm())
+			assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+			refreshToken = r.PostForm.Get("refresh_token")
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "exchanged-token"}`)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	destImage := "docker://" + strings.TrimPrefix(server.URL, "https://") + "/test:latest"
+	opts := NewImageOpts(destImage)
+	opts.SetCreds(`{"username": "oauth2accesstoken", "identityToken": "refresh-token"}`)
+	sys, err := opts.NewSystemContext()
+	assert.NoError(t, err)
+	sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+
+	ref, err := alltransports.ParseImageName(destImage)
+	assert.NoError(t, err)
+	_, _, err = GetManifestDigest(context.Background(), sys, ref)
+	assert.Error(t, err)
+	assert.Equal(t, "refresh-token", refreshToken)
+	assert.Equal(t, "Bearer exchanged-token", authorization)
+}
+
+func TestAWSCredentialsRequireECRImage(t *testing.T) {
+	opts := NewImageOpts("docker://registry.example.com/app:1.0")
+	opts.SetCreds(`{"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret"}`)
+	_, err := opts.NewSystemContext()
+	assert.Error(t, err)
+
+	creds, err := ParseCreds(`{"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret", "awsSessionToken": "token"}`)
+	assert.NoError(t, err)
+	value, err := creds.awsCredentials().Retrieve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIAEXAMPLE", value.AccessKeyID)
+	assert.Equal(t, "token", value.SessionToken)
+	assert.Nil(t, Creds{Username: "user", Password: "pass"}.awsCredentials())
+}
+
+func TestNormalizeRepoPath(t *testing.T) {
+	assert.Equal(t,
+		"docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/team/my-app:Latest",
+		NormalizeRepoPath("docker://1234567890.dkr.ecr.us-west-2.amazonaws.com/Team/My App:Latest"),
+	)
+	assert.Equal(t,
+		"docker://registry.local:5000/team/app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		NormalizeRepoPath("docker://registry.local:5000/TEAM/App@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+	)
+	assert.Equal(t, "docker://library/nginx-x", NormalizeRepoPath("docker://Library/NGINX+x"))
+	assert.Equal(t, "docker://localhost/app:v1", NormalizeRepoPath("docker://localhost/APP:v1"))
+	assert.Equal(t, "dir:/tmp/Nginx", NormalizeRepoPath("dir:/tmp/Nginx"))
+}
+
+func TestResolveRegistryCreds(t *testing.T) {
+	registryCreds := map[string]string{
+		"docker.io":      "hub-secret",
+		"Quay.io":        "quay-user:quay-pass",
+		"localhost:5000": "local-user:local-pass",
+	}
+
+	assert.Equal(t, "hub-secret", ResolveRegistryCreds(registryCreds, "docker.io", "image-secret"))
+	assert.Equal(t, "quay-user:quay-pass", ResolveRegistryCreds(registryCreds, "quay.io", ""))
+	assert.Equal(t, "local-user:local-pass", ResolveRegistryCreds(registryCreds, "localhost:5000", ""))
+	assert.Equal(t, "image-secret", ResolveRegistryCreds(registryCreds, "ghcr.io", "image-secret"))
+	assert.Equal(t, "", ResolveRegistryCreds(registryCreds, "ghcr.io", ""))
+	assert.Equal(t, "image-secret", ResolveRegistryCreds(registryCreds, "", "image-secret"))
+	assert.Equal(t, "image-secret", ResolveRegistryCreds(nil, "docker.io", "image-secret"))
+
+	// A port falls back to the bare hostname, but an exact entry wins.
+	assert.Equal(t, "quay-user:quay-pass", ResolveRegistryCreds(registryCreds, "quay.io:443", ""))
+	assert.Equal(t, "local-user:local-pass", ResolveRegistryCreds(map[string]string{
+		"localhost":      "other",
+		"localhost:5000": "local-user:local-pass",
+	}, "localhost:5000", ""))
+	assert.Equal(t, "image-secret", ResolveRegistryCreds(registryCreds, "localhost:5001", "image-secret"))
+}
+
+func TestTokenScopeWithPortAndPath(t *testing.T) {
+	var scope, tokenAuth, manifestAuth string
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			scope = r.URL.Query().Get("scope")
+			tokenAuth = r.Header.Get("Authorization")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token": "registry-token"}`))
+		case r.Header.Get("Authorization") != "Bearer registry-token":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry.internal"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			manifestAuth = r.Header.Get("Authorization")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	// e.g. docker://127.0.0.1:<port>/team/sub/app:1.0
+	host := strings.TrimPrefix(server.URL, "https://")
+	image := "docker://" + host + "/team/sub/app:1.0"
+	ref, err := alltransports.ParseImageName(image)
+	assert.NoError(t, err)
+	info := GetImageRefInfo(ref)
+	assert.Equal(t, host, info.Registry)
+	assert.Equal(t, "team/sub/app", info.Repository)
+	assert.Equal(t, "1.0", info.Tag)
+
+	opts := NewImageOpts(image)
+	opts.SetCreds(ResolveRegistryCreds(map[string]string{host: "user:pass"}, info.Registry, ""))
+	sys, err := opts.NewSystemContext()
+	assert.NoError(t, err)
+	sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+
+	_, exists, err := GetManifestDigest(context.Background(), sys, ref)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, "repository:team/sub/app:pull", scope)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", tokenAuth)
+	assert.Equal(t, "Bearer registry-token", manifestAuth)
+}
+
+func TestSecretErrorReason(t *testing.T) {
+	notFound := &smtypes.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+	assert.Equal(t, "secret not found: Secrets Manager can't find the specified secret.", secretErrorReason(fmt.Errorf("operation error: %w", notFound)))
+
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}
+	assert.Contains(t, secretErrorReason(denied), "access denied")
+	assert.Contains(t, secretErrorReason(denied), "not authorized")
+
+	assert.Contains(t, secretErrorReason(context.DeadlineExceeded), EnvSecretTimeout)
+	assert.Equal(t, "boom", secretErrorReason(errors.New("boom")))
+}
+
+type fakeSecretsManagerClient struct {
+	errs  []error
+	calls int
+}
+
+func (c *fakeSecretsManagerClient) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return nil, c.errs[c.calls-1]
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String("user:pass")}, nil
+}
+
+func TestGetSecretValueRetries(t *testing.T) {
+	decryption := &smtypes.DecryptionFailure{Message: aws.String("KMS is throttling")}
+	client := &fakeSecretsManagerClient{errs: []error{fmt.Errorf("operation error: %w", decryption)}}
+	resp, err := getSecretValue(context.Background(), client, "registry", 3, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "user:pass", aws.ToString(resp.SecretString))
+	assert.Equal(t, 2, client.calls)
+
+	// Retries are bounded.
+	client = &fakeSecretsManagerClient{errs: []error{decryption, decryption, decryption, decryption}}
+	_, err = getSecretValue(context.Background(), client, "registry", 2, time.Millisecond)
+	assert.ErrorAs(t, err, &decryption)
+	assert.Equal(t, 3, client.calls)
+
+	client = &fakeSecretsManagerClient{errs: []error{&smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}}}
+	_, err = getSecretValue(context.Background(), client, "registry", 3, time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestParseSecretRetries(t *testing.T) {
+	n, err := parseSecretRetries("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultSecretRetries, n)
+	n, err = parseSecretRetries("0")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = parseSecretRetries("-1")
+	assert.Error(t, err)
+}
+
+func TestParseSecretTimeout(t *testing.T) {
+	timeout, err := parseSecretTimeout("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultSecretTimeout, timeout)
+	timeout, err = parseSecretTimeout("2s")
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, timeout)
+	_, err = parseSecretTimeout("-1s")
+	assert.Error(t, err)
+}
+
+func TestRefreshCredsAfterRotation(t *testing.T) {
+	const secretArn = "arn:aws:secretsmanager:us-west-2:123456789012:secret:registry"
+	secret := "user:old-pass"
+	resolve := func(ref string) (string, error) {
+		assert.Equal(t, secretArn, ref)
+		return secret, nil
+	}
+
+	opts := NewImageOpts("docker://registry.example.com/app:1.0")
+	creds, _ := resolve(secretArn)
+	opts.SetCreds(creds)
+	sys, err := opts.NewSystemContext()
+	assert.NoError(t, err)
+
+	// The registry only accepts the rotated password.
+	secret = "user:new-pass"
+	attempts := 0
+	err = retryOnUnauthorized(context.Background(), func() error {
+		attempts++
+		if sys.DockerAuthConfig.Password != "new-pass" {
+			return docker.ErrUnauthorizedForCredentials{Err: errors.New("invalid username/password")}
+		}
+		return nil
+	}, func() (bool, error) {
+		return opts.RefreshCreds(sys, secretArn, resolve)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	refreshed, err := opts.RefreshCreds(sys, secretArn, resolve)
+	assert.NoError(t, err)
+	assert.False(t, refreshed)
+}
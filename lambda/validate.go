@@ -0,0 +1,394 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"cdk-ecr-deployment-handler/internal/tarfile"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// invokerValidate as INVOKER makes every invocation a validation of the
+// resource properties it carries, without copying anything.
+const invokerValidate = "VALIDATE"
+
+// ValidationResult is the response of a validation invocation.
+type ValidationResult struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+}
+
+var (
+	validatedBoolProps = []string{
+		ALSO_TAG_WITH_DIGEST, CONVERT_SCHEMA1, CREATE_PUBLIC_REPOSITORY, DOWNLOAD_FOREIGN_LAYERS,
+		ENCODE_SOURCE_REGISTRY_IN_PATH, EXTRACT_SBOM, FORCE, NORMALIZE_DEST_PATH, REQUIRE_TAG_IMMUTABILITY, RETURN_DEST_TAGS,
+		RETURN_LAYER_INFO, SKIP_IF_TAG_EXISTS, SUGGEST_SOURCE_TAGS, TAG_FROM_DIGEST,
+		VERIFY_AFTER_PUSH, VERIFY_LAYER_AFTER_PUSH, VERIFY_ONLY, VERIFY_ONLY_LAYERS, SRC_USE_PLAIN_HTTP, DEST_USE_PLAIN_HTTP,
+	}
+	validatedIntProps = []string{
+		BLOB_CONCURRENCY, BLOB_UPLOAD_INVALID_RETRIES, DEST_REPOSITORY_WAIT_SECONDS,
+		ECR_MAX_LAYERS, ECR_MAX_LAYER_SIZE, ECR_MAX_MANIFEST_SIZE, LATEST_N_TAGS, MAX_CONFIG_SIZE, MAX_IMAGE_AGE_DAYS,
+		RETURN_DEST_TAGS_LIMIT, SCAN_ON_PUSH_WAIT_SECONDS, TAG_FROM_DIGEST_LENGTH,
+	}
+	validatedStrMapProps = []string{
+		DEST_IMAGES_CREDS, MANIFEST_ANNOTATIONS, PUBLIC_REPOSITORY_CATALOG_DATA, REGISTRY_CREDENTIALS,
+	}
+	validatedStrProps = []string{
+		COMPRESSION_FORMAT, DEST_ARCHIVE_S3_URI, DEST_CREDS, DEST_IMAGE, DEST_IMAGE_TEMPLATE, DEST_TAG_SUFFIX,
+		DEST_MANIFEST_TYPE, DIGEST_ALGORITHM, LATEST_TAGS_ORDER, LOG_LEVEL, POLICY,
+		PRUNE_OLDER_THAN, PUBLIC_REGISTRY_ALIAS, REPORT_DESTINATION, SCAN_LAMBDA_ARN, SCAN_SEVERITY_THRESHOLD, SEMVER_CONSTRAINT, SRC_CREDS, SRC_DOCKER_DAEMON_HOST, SRC_IMAGE,
+		TAG_FROM_DIGEST_PREFIX,
+	}
+)
+
+// handleValidate validates the resource properties of raw, either a
+// CloudFormation request or the bare properties.
+func handleValidate(raw json.RawMessage) (*ValidationResult, error) {
+	var event cfn.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+	if event.ResourceProperties == nil {
+		if err := json.Unmarshal(raw, &event.ResourceProperties); err != nil {
+			return nil, err
+		}
+	}
+	errs := ValidateProps(event)
+	return &ValidationResult{Valid: len(errs) == 0, Errors: errs}, nil
+}
+
+// ValidateProps checks the resource properties of event the way a copy
+// would read them, without calling registries, Secrets Manager or any other
+// service, and returns every problem found. DestImageTemplate is only
+// expanded for events with a StackId, and without stack tag placeholders,
+// which would have to be looked up.
+func ValidateProps(event cfn.Event) []string {
+	props := event.ResourceProperties
+	errs := []string{}
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// Props that can't be read are reported once here and read as their
+	// defaults below, so the checks of the others still run.
+	unreadable := map[string]bool{}
+	read := func(k string, err error) {
+		if err != nil {
+			unreadable[k] = true
+			add(err)
+		}
+	}
+	// Props with a range of their own are checked with it below.
+	rangeChecked := map[string]bool{BLOB_CONCURRENCY: true, MAX_CONFIG_SIZE: true, TAG_FROM_DIGEST_LENGTH: true}
+
+	for _, k := range validatedBoolProps {
+		_, err := getBoolPropsDefault(props, k, false)
+		read(k, err)
+	}
+	for _, k := range validatedIntProps {
+		v, err := getIntPropsDefault(props, k, 0)
+		read(k, err)
+		if err == nil && v < 0 && !rangeChecked[k] {
+			add(fmt.Errorf("%v must not be negative, got %d", k, v))
+		}
+	}
+	for _, k := range validatedStrMapProps {
+		_, err := getStrMapPropsDefault(props, k)
+		read(k, err)
+	}
+	for _, k := range validatedStrProps {
+		_, err := getStrPropsDefault(props, k, "")
+		read(k, err)
+	}
+	destImages, err := getStrListPropsDefault(props, DEST_IMAGES)
+	read(DEST_IMAGES, err)
+	_, err = getStrListPropsDefault(props, ALLOWED_SOURCE_MEDIA_TYPES)
+	read(ALLOWED_SOURCE_MEDIA_TYPES, err)
+	replicationRegions, err := getStrListPropsDefault(props, ENSURE_REPLICATION_REGIONS)
+	read(ENSURE_REPLICATION_REGIONS, err)
+	str := func(k string) string {
+		v, _ := getStrPropsDefault(props, k, "")
+		return v
+	}
+	flag := func(k string) bool {
+		v, _ := getBoolPropsDefault(props, k, false)
+		return v
+	}
+	num := func(k string, d int) int {
+		if unreadable[k] {
+			return d
+		}
+		v, _ := getIntPropsDefault(props, k, d)
+		return v
+	}
+	strMap := func(k string) map[string]string {
+		v, _ := getStrMapPropsDefault(props, k)
+		return v
+	}
+
+	var srcRef types.ImageReference
+	if srcImage := str(SRC_IMAGE); unreadable[SRC_IMAGE] {
+		// Reported already.
+	} else if srcImage == "" {
+		add(fmt.Errorf("%v is required", SRC_IMAGE))
+	} else {
+		srcRef, err = parseValidatedImage(SRC_IMAGE, srcImage)
+		add(err)
+	}
+
+	destImage, tmpl := str(DEST_IMAGE), str(DEST_IMAGE_TEMPLATE)
+	switch {
+	case unreadable[DEST_IMAGE] || unreadable[DEST_IMAGE_TEMPLATE] || unreadable[DEST_IMAGES]:
+		// Which of them is given can't be told.
+	case destImage != "" && tmpl != "":
+		add(fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGE, DEST_IMAGE_TEMPLATE))
+	case destImage != "" && len(destImages) > 0:
+		add(fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGE, DEST_IMAGES))
+	case destImage == "" && tmpl == "" && len(destImages) == 0:
+		add(fmt.Errorf("one of %v, %v or %v is required", DEST_IMAGE, DEST_IMAGE_TEMPLATE, DEST_IMAGES))
+	case tmpl != "" && event.StackID != "" && !usesStackTags(tmpl):
+		expanded, err := resolveDestImageTemplate(context.Background(), event)
+		add(err)
+		if err == nil {
+			destImage, _ = getStrPropsDefault(expanded, DEST_IMAGE, "")
+		}
+	}
+	add(checkBlobConcurrency(num(BLOB_CONCURRENCY, defaultBlobConcurrency)))
+	add(checkMaxConfigSize(num(MAX_CONFIG_SIZE, maxConfigSizeLimit)))
+	// Copies only write sha256 digests, a tag can take all 64 characters of one.
+	if err := checkDigestTagLength(num(TAG_FROM_DIGEST_LENGTH, defaultDigestTagLength), digest.Canonical.Size()*2); err != nil {
+		add(fmt.Errorf("%v: %v", TAG_FROM_DIGEST_LENGTH, err))
+	}
+	if len(destImages) > 0 && num(LATEST_N_TAGS, 0) > 0 {
+		add(fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGES, LATEST_N_TAGS))
+	}
+	if len(destImages) > 0 && str(SEMVER_CONSTRAINT) != "" {
+		add(fmt.Errorf("%v and %v are mutually exclusive", DEST_IMAGES, SEMVER_CONSTRAINT))
+	}
+
+	var destRefs []types.ImageReference
+	if destImage != "" {
+		destImages = append([]string{destImage}, destImages...)
+	}
+	for _, image := range destImages {
+		if ref, err := parseValidatedImage(DEST_IMAGE, image); err != nil {
+			add(err)
+		} else {
+			destRefs = append(destRefs, ref)
+		}
+	}
+
+	isDocker := func(ref types.ImageReference) bool {
+		return ref.Transport().Name() == docker.Transport.Name()
+	}
+	if flag(SRC_USE_PLAIN_HTTP) && srcRef != nil && !isDocker(srcRef) {
+		add(fmt.Errorf("%v requires a docker image", SRC_USE_PLAIN_HTTP))
+	}
+	if str(SRC_DOCKER_DAEMON_HOST) != "" && srcRef != nil && !isDockerDaemon(srcRef) {
+		add(fmt.Errorf("%v requires a docker-daemon SrcImage", SRC_DOCKER_DAEMON_HOST))
+	}
+	for _, ref := range destRefs {
+		if flag(DEST_USE_PLAIN_HTTP) && !isDocker(ref) {
+			add(fmt.Errorf("%v requires a docker image", DEST_USE_PLAIN_HTTP))
+		}
+		if flag(ALSO_TAG_WITH_DIGEST) && !isDocker(ref) {
+			add(fmt.Errorf("%v requires a docker destination", ALSO_TAG_WITH_DIGEST))
+		}
+		_, isECR := GetECRRepository(GetImageRefInfo(ref))
+		if num(DEST_REPOSITORY_WAIT_SECONDS, -1) >= 0 && !isECR {
+			add(fmt.Errorf("%v requires an ECR destination", DEST_REPOSITORY_WAIT_SECONDS))
+		}
+		if num(SCAN_ON_PUSH_WAIT_SECONDS, -1) >= 0 && !isECR {
+			add(fmt.Errorf("%v requires an ECR destination", SCAN_ON_PUSH_WAIT_SECONDS))
+		}
+		if len(replicationRegions) > 0 && !isECR {
+			add(fmt.Errorf("%v requires an ECR destination", ENSURE_REPLICATION_REGIONS))
+		}
+		if str(PRUNE_OLDER_THAN) != "" && !isECR {
+			add(fmt.Errorf("%v requires an ECR destination", PRUNE_OLDER_THAN))
+		}
+		_, isArchive := GetArchivePath(transports.ImageName(ref))
+		if str(DEST_ARCHIVE_S3_URI) != "" && !isArchive {
+			add(fmt.Errorf("%v requires an oci-archive or docker-archive DestImage", DEST_ARCHIVE_S3_URI))
+		}
+		if len(strMap(MANIFEST_ANNOTATIONS)) > 0 && isArchive {
+			add(fmt.Errorf("%v can't be added to oci-archive or docker-archive destinations", MANIFEST_ANNOTATIONS))
+		}
+	}
+	if uri := str(DEST_ARCHIVE_S3_URI); uri != "" {
+		if s3uri, err := tarfile.ParseS3Uri(uri); err != nil {
+			add(fmt.Errorf("%v: %v", DEST_ARCHIVE_S3_URI, err))
+		} else if s3uri.Bucket == "" || s3uri.Key == "" {
+			add(fmt.Errorf("%v must include a bucket and a key: %v", DEST_ARCHIVE_S3_URI, uri))
+		}
+	}
+
+	if flag(CREATE_PUBLIC_REPOSITORY) {
+		if str(PUBLIC_REGISTRY_ALIAS) == "" {
+			add(fmt.Errorf("%v requires %v", CREATE_PUBLIC_REPOSITORY, PUBLIC_REGISTRY_ALIAS))
+		}
+		if _, err := ParsePublicCatalogData(strMap(PUBLIC_REPOSITORY_CATALOG_DATA)); err != nil {
+			add(fmt.Errorf("%v: %v", PUBLIC_REPOSITORY_CATALOG_DATA, err))
+		}
+	}
+	if threshold := str(SCAN_SEVERITY_THRESHOLD); threshold != "" {
+		if _, err := ParseScanSeverity(threshold); err != nil {
+			add(fmt.Errorf("%v: %v", SCAN_SEVERITY_THRESHOLD, err))
+		}
+	}
+	if age := str(PRUNE_OLDER_THAN); age != "" {
+		if _, err := parsePruneOlderThan(age); err != nil {
+			add(err)
+		}
+	}
+	if c := str(SEMVER_CONSTRAINT); c != "" {
+		if _, err := ParseSemverConstraint(c); err != nil {
+			add(fmt.Errorf("%v: %v", SEMVER_CONSTRAINT, err))
+		}
+	}
+	if order := str(LATEST_TAGS_ORDER); order != "" && order != latestTagsSemver && order != latestTagsPushedAt {
+		add(fmt.Errorf("invalid %v %q, expected %v or %v", LATEST_TAGS_ORDER, order, latestTagsSemver, latestTagsPushedAt))
+	}
+	if level := str(LOG_LEVEL); level != "" {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			add(fmt.Errorf("%v: %v", LOG_LEVEL, err))
+		}
+	}
+	if _, closeReport, err := ReportWriter(context.Background(), str(REPORT_DESTINATION)); err != nil {
+		add(err)
+	} else {
+		closeReport()
+	}
+	_, err = ParseManifestFormat(str(DEST_MANIFEST_TYPE))
+	add(err)
+	_, err = ParseDigestAlgorithm(str(DIGEST_ALGORITHM))
+	add(err)
+	_, err = ResolveCompression(str(COMPRESSION_FORMAT))
+	add(err)
+	// A policy file is read from the Lambda image, only inline ones are checked.
+	if policy := str(POLICY); strings.HasPrefix(strings.TrimSpace(policy), "{") {
+		if _, err := signature.NewPolicyFromBytes([]byte(policy)); err != nil {
+			add(fmt.Errorf("invalid policy: %v", err.Error()))
+		}
+	}
+
+	// SrcCreds and DestCreds are optional, an entry of a map must hold creds.
+	credsProps := map[string]string{}
+	for _, k := range []string{SRC_CREDS, DEST_CREDS} {
+		if creds := str(k); creds != "" {
+			credsProps[k] = creds
+		}
+	}
+	destImagesCreds := strMap(DEST_IMAGES_CREDS)
+	for key, creds := range destImagesCreds {
+		credsProps[fmt.Sprintf("%v[%q]", DEST_IMAGES_CREDS, key)] = creds
+	}
+	for key, creds := range strMap(REGISTRY_CREDENTIALS) {
+		credsProps[fmt.Sprintf("%v[%q]", REGISTRY_CREDENTIALS, key)] = creds
+	}
+	keys := make([]string, 0, len(credsProps))
+	for k := range credsProps {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := validateCreds(credsProps[k]); err != nil {
+			add(fmt.Errorf("%v: %v", k, err))
+		}
+	}
+	if !unreadable[DEST_IMAGES] {
+		given := make(map[string]bool, len(destImages))
+		for _, image := range destImages {
+			given[image] = true
+		}
+		unused := []string{}
+		for key := range destImagesCreds {
+			if !given[key] {
+				unused = append(unused, key)
+			}
+		}
+		sort.Strings(unused)
+		for _, key := range unused {
+			add(fmt.Errorf("%v[%q] isn't one of %v", DEST_IMAGES_CREDS, key, DEST_IMAGES))
+		}
+	}
+	return errs
+}
+
+// parseValidatedImage parses image as the copy would, including names with
+// both a tag and a digest.
+func parseValidatedImage(prop string, image string) (types.ImageReference, error) {
+	if prop == DEST_IMAGE {
+		qualified, _, err := QualifyImage(image, os.Getenv(EnvDefaultDestRegistry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %v", prop, image, err.Error())
+		}
+		image = qualified
+	}
+	if pinned, ok := SplitTagAndDigest(image); ok {
+		image = pinned.TagImage
+	}
+	ref, err := alltransports.ParseImageName(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v %q: %v", prop, image, err.Error())
+	}
+	return ref, nil
+}
+
+// validateCreds checks that creds aren't empty and that inline JSON creds
+// give the fields that only work together. Secrets aren't fetched, so creds
+// given as a secret id or "user:password" always pass, and so do the fields
+// of JSON creds with a vaultPath, which Vault can fill in.
+func validateCreds(creds string) error {
+	if strings.TrimSpace(creds) == "" {
+		return fmt.Errorf("no creds given")
+	}
+	if GetCredsType(creds) != SECRET_TEXT || !strings.HasPrefix(strings.TrimSpace(creds), "{") {
+		return nil
+	}
+	c, err := ParseCreds(creds)
+	if err != nil {
+		return err
+	}
+	if c == (Creds{}) {
+		return fmt.Errorf("no creds given")
+	}
+	if c.VaultPath != "" {
+		return nil
+	}
+	pairs := []struct {
+		name, other   string
+		given, needed bool
+	}{
+		{"username", "password", c.Username != "", c.Password != ""},
+		{"password", "username", c.Password != "", c.Username != ""},
+		{"clientCert", "clientKey", c.ClientCert != "", c.ClientKey != ""},
+		{"clientKey", "clientCert", c.ClientKey != "", c.ClientCert != ""},
+		{"awsAccessKeyId", "awsSecretAccessKey", c.AWSAccessKeyID != "", c.AWSSecretAccessKey != ""},
+		{"awsSecretAccessKey", "awsAccessKeyId", c.AWSSecretAccessKey != "", c.AWSAccessKeyID != ""},
+		{"awsSessionToken", "awsAccessKeyId", c.AWSSessionToken != "", c.AWSAccessKeyID != ""},
+	}
+	for _, p := range pairs {
+		if p.given && !p.needed {
+			return fmt.Errorf("%v requires %v", p.name, p.other)
+		}
+	}
+	return nil
+}
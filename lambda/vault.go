@@ -0,0 +1,102 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EnvVaultAddr      = "VAULT_ADDR"
+	EnvVaultToken     = "VAULT_TOKEN"
+	EnvVaultNamespace = "VAULT_NAMESPACE"
+)
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// ReadVaultSecret reads the secret at path, e.g. "secret/data/registry",
+// with the Vault HTTP API and returns its fields as JSON creds. Both KV
+// version 1 and 2 secrets are supported, their fields must be named like
+// the Creds JSON fields.
+func ReadVaultSecret(path string) (string, error) {
+	addr := os.Getenv(EnvVaultAddr)
+	token := os.Getenv(EnvVaultToken)
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("%s and %s must be set to read creds from vault", EnvVaultAddr, EnvVaultToken)
+	}
+	url := strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv(EnvVaultNamespace); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetch vault secret %s error: %v", path, err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("fetch vault secret %s error: %v", path, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch vault secret %s error: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("error parsing vault secret %s: %v", path, err.Error())
+	}
+	if secret.Data == nil {
+		return "", errors.New("vault secret " + path + " has no data")
+	}
+	// KV version 2 nests the fields under data.data next to data.metadata.
+	if nested, ok := secret.Data["data"]; ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return string(nested), nil
+		}
+	}
+	b, err := json.Marshal(secret.Data)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// mergeVaultCreds returns the creds of the Vault secret, with each field
+// also given in inline, e.g. a clientCert or caBundle next to the
+// vaultPath, taking precedence over the secret's, as JSON creds.
+func mergeVaultCreds(inline Creds, secret string) (string, error) {
+	merged, err := ParseCreds(secret)
+	if err != nil {
+		return "", err
+	}
+	inline.VaultPath = ""
+	// Empty fields are omitted, so only the ones given override the secret.
+	b, err := json.Marshal(inline)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(b, &merged); err != nil {
+		return "", err
+	}
+	merged.VaultPath = ""
+	b, err = json.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
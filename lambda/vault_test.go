@@ -0,0 +1,65 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadVaultSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/registry":
+			w.Write([]byte(`{"data":{"data":{"username":"user","password":"pass"},"metadata":{"version":1}}}`))
+		case "/v1/kv/registry":
+			w.Write([]byte(`{"data":{"username":"user","password":"pass"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer srv.Close()
+	t.Setenv(EnvVaultAddr, srv.URL)
+	t.Setenv(EnvVaultToken, "s.token")
+
+	for _, path := range []string{"secret/data/registry", "kv/registry"} {
+		secret, err := ReadVaultSecret(path)
+		require.NoError(t, err, path)
+		creds, err := ParseCreds(secret)
+		require.NoError(t, err)
+		assert.Equal(t, Creds{Username: "user", Password: "pass"}, creds)
+	}
+
+	secret, err := parseCreds(`{"vaultPath": "secret/data/registry"}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"username":"user","password":"pass"}`, secret)
+
+	// Fields given inline next to vaultPath win over the secret's.
+	secret, err = parseCreds(`{"vaultPath": "kv/registry", "password": "inline", "caBundle": "ca"}`)
+	require.NoError(t, err)
+	creds, err := ParseCreds(secret)
+	require.NoError(t, err)
+	assert.Equal(t, Creds{Username: "user", Password: "inline", CABundle: "ca"}, creds)
+
+	_, err = ReadVaultSecret("secret/data/missing")
+	assert.Contains(t, err.Error(), "404")
+
+	t.Setenv(EnvVaultToken, "wrong")
+	_, err = ReadVaultSecret("secret/data/registry")
+	assert.Contains(t, err.Error(), "permission denied")
+
+	t.Setenv(EnvVaultToken, "")
+	_, err = ReadVaultSecret("secret/data/registry")
+	assert.Error(t, err)
+}
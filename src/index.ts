@@ -4,7 +4,7 @@
 
 import * as child_process from 'child_process';
 import * as path from 'path';
-import { aws_ec2 as ec2, aws_iam as iam, aws_lambda as lambda, Duration, CustomResource, Token } from 'aws-cdk-lib';
+import { aws_ec2 as ec2, aws_iam as iam, aws_lambda as lambda, Aws, Duration, CustomResource, Token } from 'aws-cdk-lib';
 import { PolicyStatement, AddToPrincipalPolicyResult } from 'aws-cdk-lib/aws-iam';
 import { RuntimeFamily } from 'aws-cdk-lib/aws-lambda';
 import { Construct } from 'constructs';
@@ -181,6 +181,7 @@ export class ECRDeployment extends Construct {
           'ecr:DescribeRepositories',
           'ecr:ListImages',
           'ecr:DescribeImages',
+          'ecr:DescribePullThroughCacheRules',
           'ecr:BatchGetImage',
           'ecr:ListTagsForResource',
           'ecr:DescribeImageScanFindings',
@@ -191,6 +192,15 @@ export class ECRDeployment extends Construct {
         ],
         resources: ['*'],
       }));
+    // Stack tags used by the DestImageTemplate property, requests only come
+    // from the stack of the function.
+    handlerRole.addToPrincipalPolicy(new iam.PolicyStatement({
+      effect: iam.Effect.ALLOW,
+      actions: [
+        'cloudformation:DescribeStacks',
+      ],
+      resources: [Aws.STACK_ID],
+    }));
     handlerRole.addToPrincipalPolicy(new iam.PolicyStatement({
       effect: iam.Effect.ALLOW,
       actions: [
@@ -199,6 +209,43 @@ export class ECRDeployment extends Construct {
       resources: ['*'],
     }));
 
+    const dedupStore = props.environment?.DEDUP_STORE;
+    if (dedupStore && !Token.isUnresolved(dedupStore) && dedupStore.startsWith('dynamodb:')) {
+      handlerRole.addToPrincipalPolicy(new iam.PolicyStatement({
+        effect: iam.Effect.ALLOW,
+        actions: [
+          'dynamodb:GetItem',
+          'dynamodb:PutItem',
+        ],
+        resources: [`arn:${Aws.PARTITION}:dynamodb:${Aws.REGION}:${Aws.ACCOUNT_ID}:table/${dedupStore.substring('dynamodb:'.length)}`],
+      }));
+    }
+
+    const copyReport = props.environment?.COPY_REPORT_S3;
+    if (copyReport && !Token.isUnresolved(copyReport) && copyReport.startsWith('s3://')) {
+      const [bucket, ...prefix] = copyReport.substring('s3://'.length).split('/');
+      const keyPrefix = prefix.join('/');
+      handlerRole.addToPrincipalPolicy(new iam.PolicyStatement({
+        effect: iam.Effect.ALLOW,
+        actions: [
+          's3:PutObject',
+        ],
+        resources: [`arn:${Aws.PARTITION}:s3:::${bucket}/${keyPrefix && !keyPrefix.endsWith('/') ? keyPrefix + '/' : keyPrefix}*`],
+      }));
+    }
+
+    const auditLogGroup = props.environment?.AUDIT_LOG_GROUP;
+    if (auditLogGroup && !Token.isUnresolved(auditLogGroup)) {
+      handlerRole.addToPrincipalPolicy(new iam.PolicyStatement({
+        effect: iam.Effect.ALLOW,
+        actions: [
+          'logs:CreateLogStream',
+          'logs:PutLogEvents',
+        ],
+        resources: [`arn:${Aws.PARTITION}:logs:${Aws.REGION}:${Aws.ACCOUNT_ID}:log-group:${auditLogGroup}:*`],
+      }));
+    }
+
     new CustomResource(this, 'CustomResource', {
       serviceToken: this.handler.functionArn,
       resourceType: 'Custom::CDKBucketDeployment',